@@ -0,0 +1,504 @@
+package learning
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// SlowConsumerPolicy decides what Publish does when a subscriber's buffer is full.
+type SlowConsumerPolicy int
+
+const (
+	// Block makes Publish wait for the subscriber, or for the publish context to end.
+	Block SlowConsumerPolicy = iota
+	// DropOldest discards the oldest buffered message to make room.
+	DropOldest
+	// Disconnect unsubscribes the subscriber, closing its channel.
+	Disconnect
+)
+
+var ErrBrokerClosed = errors.New("broker closed")
+
+type subscribeConfig struct {
+	group  string
+	buffer int
+	policy SlowConsumerPolicy
+}
+
+// SubscribeOption configures a single subscription.
+type SubscribeOption func(*subscribeConfig)
+
+// InGroup makes the subscription a member of a queue group: each message on
+// the topic goes to exactly one member of every group, round-robin.
+func InGroup(name string) SubscribeOption {
+	return func(cfg *subscribeConfig) {
+		cfg.group = name
+	}
+}
+
+// WithBuffer sets the subscription's channel buffer. The default is 16.
+func WithBuffer(n int) SubscribeOption {
+	return func(cfg *subscribeConfig) {
+		cfg.buffer = n
+	}
+}
+
+// WithSlowConsumerPolicy sets what happens when the subscription falls behind.
+// The default is Block.
+func WithSlowConsumerPolicy(p SlowConsumerPolicy) SubscribeOption {
+	return func(cfg *subscribeConfig) {
+		cfg.policy = p
+	}
+}
+
+type subscriber[T any] struct {
+	ch     chan T
+	policy SlowConsumerPolicy
+	done   chan struct{} // closed as soon as the subscriber starts leaving
+	once   sync.Once
+}
+
+type queueGroup[T any] struct {
+	members []*subscriber[T]
+	next    atomic.Uint64
+}
+
+type brokerTopic[T any] struct {
+	subscribers []*subscriber[T]
+	groups      map[string]*queueGroup[T]
+}
+
+// Broker is a topic based pub/sub hub. It generalises the two patterns in
+// concurrency_test.go: broadcast subscribers see every message on a topic,
+// like TestBroadcastUsingChannelClose, and queue groups share the work, like
+// TestPublishToMultipleListeners.
+type Broker[T any] struct {
+	mu     sync.RWMutex
+	topics map[string]*brokerTopic[T]
+	closed bool
+
+	// live has every subscriber so that Close can wake publishers blocked
+	// on them without the write lock, which waits for those publishers.
+	liveMu  sync.Mutex
+	live    map[*subscriber[T]]struct{}
+	closing bool
+}
+
+func NewBroker[T any]() *Broker[T] {
+	return &Broker[T]{topics: make(map[string]*brokerTopic[T]), live: make(map[*subscriber[T]]struct{})}
+}
+
+// Subscribe returns a channel receiving messages published to topic and a func
+// that ends the subscription. The channel is closed when the subscription ends,
+// whether by unsubscribe, by the Disconnect policy or by closing the broker.
+func (b *Broker[T]) Subscribe(topic string, opts ...SubscribeOption) (<-chan T, func()) {
+	cfg := subscribeConfig{buffer: 16}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.policy == DropOldest && cfg.buffer < 1 {
+		// There is no oldest message to drop from an unbuffered channel
+		cfg.buffer = 1
+	}
+	sub := &subscriber[T]{
+		ch:     make(chan T, cfg.buffer),
+		policy: cfg.policy,
+		done:   make(chan struct{}),
+	}
+	b.liveMu.Lock()
+	if b.closing {
+		sub.leave()
+	} else {
+		b.live[sub] = struct{}{}
+	}
+	b.liveMu.Unlock()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		close(sub.ch)
+		return sub.ch, func() {}
+	}
+	t, ok := b.topics[topic]
+	if !ok {
+		t = &brokerTopic[T]{groups: make(map[string]*queueGroup[T])}
+		b.topics[topic] = t
+	}
+	if cfg.group == "" {
+		t.subscribers = append(t.subscribers, sub)
+	} else {
+		g, ok := t.groups[cfg.group]
+		if !ok {
+			g = &queueGroup[T]{}
+			t.groups[cfg.group] = g
+		}
+		g.members = append(g.members, sub)
+	}
+	return sub.ch, func() { b.unsubscribe(topic, cfg.group, sub) }
+}
+
+// Publish delivers msg to every broadcast subscriber of topic and to one member
+// of each queue group. It only returns early when ctx ends while waiting on a
+// blocking subscriber.
+func (b *Broker[T]) Publish(ctx context.Context, topic string, msg T) error {
+	var slow []*subscriber[T]
+	err := func() error {
+		b.mu.RLock()
+		defer b.mu.RUnlock()
+		if b.closed {
+			return ErrBrokerClosed
+		}
+		t, ok := b.topics[topic]
+		if !ok {
+			return nil
+		}
+		targets := make([]*subscriber[T], 0, len(t.subscribers)+len(t.groups))
+		targets = append(targets, t.subscribers...)
+		for _, g := range t.groups {
+			if len(g.members) > 0 {
+				targets = append(targets, g.pick())
+			}
+		}
+		for _, sub := range targets {
+			delivered, err := sub.deliver(ctx, msg)
+			if err != nil {
+				return err
+			}
+			if !delivered && sub.policy == Disconnect {
+				slow = append(slow, sub)
+			}
+		}
+		return nil
+	}()
+	// Disconnecting needs the write lock, so it waits until delivery is over
+	for _, sub := range slow {
+		b.disconnect(topic, sub)
+	}
+	return err
+}
+
+// Close ends every subscription, closing their channels, and makes further
+// publishes fail with ErrBrokerClosed.
+func (b *Broker[T]) Close() {
+	// Signal first, as unsubscribe does, so that publishers blocked on any
+	// subscriber let go of the read lock.
+	b.liveMu.Lock()
+	b.closing = true
+	for sub := range b.live {
+		sub.leave()
+	}
+	b.live = nil
+	b.liveMu.Unlock()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+	b.closed = true
+	for _, t := range b.topics {
+		for _, sub := range t.subscribers {
+			sub.leave()
+			close(sub.ch)
+		}
+		for _, g := range t.groups {
+			for _, sub := range g.members {
+				sub.leave()
+				close(sub.ch)
+			}
+		}
+	}
+	b.topics = nil
+}
+
+func (b *Broker[T]) unsubscribe(topic, group string, sub *subscriber[T]) {
+	// Signal first so that a publisher blocked on this subscriber lets go of
+	// the read lock we are about to ask for.
+	sub.leave()
+	b.liveMu.Lock()
+	delete(b.live, sub)
+	b.liveMu.Unlock()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	t, ok := b.topics[topic]
+	if !ok {
+		return
+	}
+	removed := false
+	if group == "" {
+		t.subscribers, removed = removeSubscriber(t.subscribers, sub)
+	} else if g, ok := t.groups[group]; ok {
+		g.members, removed = removeSubscriber(g.members, sub)
+		if len(g.members) == 0 {
+			delete(t.groups, group)
+		}
+	}
+	if removed {
+		close(sub.ch)
+	}
+	if len(t.subscribers) == 0 && len(t.groups) == 0 {
+		delete(b.topics, topic)
+	}
+}
+
+func (b *Broker[T]) disconnect(topic string, sub *subscriber[T]) {
+	b.mu.RLock()
+	t, ok := b.topics[topic]
+	group := ""
+	if ok {
+		for name, g := range t.groups {
+			for _, m := range g.members {
+				if m == sub {
+					group = name
+				}
+			}
+		}
+	}
+	b.mu.RUnlock()
+	b.unsubscribe(topic, group, sub)
+}
+
+func removeSubscriber[T any](subs []*subscriber[T], sub *subscriber[T]) ([]*subscriber[T], bool) {
+	for i, s := range subs {
+		if s == sub {
+			return append(subs[:i:i], subs[i+1:]...), true
+		}
+	}
+	return subs, false
+}
+
+// pick returns the next group member round-robin. Callers only hold the
+// broker's read lock, hence the atomic counter.
+func (g *queueGroup[T]) pick() *subscriber[T] {
+	n := g.next.Add(1) - 1
+	return g.members[n%uint64(len(g.members))]
+}
+
+func (s *subscriber[T]) leave() {
+	s.once.Do(func() {
+		close(s.done)
+	})
+}
+
+// deliver hands msg to the subscriber according to its policy. It reports
+// false when the message could not be delivered.
+func (s *subscriber[T]) deliver(ctx context.Context, msg T) (bool, error) {
+	select {
+	case <-s.done:
+		return false, nil
+	default:
+	}
+	switch s.policy {
+	case DropOldest:
+		for {
+			select {
+			case s.ch <- msg:
+				return true, nil
+			default:
+			}
+			select {
+			case <-s.ch:
+			default:
+			}
+		}
+	case Disconnect:
+		select {
+		case s.ch <- msg:
+			return true, nil
+		default:
+			return false, nil
+		}
+	default:
+		select {
+		case s.ch <- msg:
+			return true, nil
+		case <-s.done:
+			return false, nil
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+	}
+}
+
+func TestBrokerBroadcast(t *testing.T) {
+	checkGoroutineLeaks(t)
+	broker := NewBroker[int]()
+	defer broker.Close()
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		ch, _ := broker.Subscribe("ticks")
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			expected := 0
+			for v := range ch {
+				if v != expected {
+					t.Errorf("Expected %d got %d", expected, v)
+				}
+				expected++
+			}
+			if expected != 100 {
+				t.Error("Expected every subscriber to see 100 messages. Got:", expected)
+			}
+		}()
+	}
+	for i := 0; i < 100; i++ {
+		if err := broker.Publish(context.Background(), "ticks", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Closing the broker ends every subscriber's range loop
+	broker.Close()
+	wg.Wait()
+
+	if err := broker.Publish(context.Background(), "ticks", 100); err != ErrBrokerClosed {
+		t.Error("Expected publishing to a closed broker to fail. Got:", err)
+	}
+}
+
+func TestBrokerQueueGroup(t *testing.T) {
+	checkGoroutineLeaks(t)
+	broker := NewBroker[struct{}]()
+	workerA, _ := broker.Subscribe("jobs", InGroup("workers"))
+	workerB, _ := broker.Subscribe("jobs", InGroup("workers"))
+	audit, _ := broker.Subscribe("jobs")
+
+	counts := make(chan int, 3)
+	for _, ch := range []<-chan struct{}{workerA, workerB, audit} {
+		go func(ch <-chan struct{}) {
+			counter := 0
+			for range ch {
+				counter++
+			}
+			counts <- counter
+		}(ch)
+	}
+	for i := 0; i < 1000; i++ {
+		broker.Publish(context.Background(), "jobs", struct{}{})
+	}
+	broker.Close()
+
+	total := 0
+	for i := 0; i < 3; i++ {
+		total += <-counts
+	}
+	// The audit subscriber sees all 1000, the two workers split another 1000
+	if total != 2000 {
+		t.Fatal("Expected responses to total 2000 but got:", total)
+	}
+}
+
+func TestBrokerConcurrentPublishers(t *testing.T) {
+	broker := NewBroker[int]()
+	a, _ := broker.Subscribe("jobs", InGroup("workers"), WithBuffer(1000))
+	b, _ := broker.Subscribe("jobs", InGroup("workers"), WithBuffer(1000))
+	wg := sync.WaitGroup{}
+	for p := 0; p < 4; p++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				broker.Publish(context.Background(), "jobs", i)
+			}
+		}()
+	}
+	wg.Wait()
+	if len(a)+len(b) != 400 {
+		t.Error("Expected the group to receive 400 messages. Got:", len(a)+len(b))
+	}
+	broker.Close()
+}
+
+func TestBrokerDropOldest(t *testing.T) {
+	broker := NewBroker[int]()
+	defer broker.Close()
+	ch, _ := broker.Subscribe("prices", WithBuffer(2), WithSlowConsumerPolicy(DropOldest))
+	for i := 0; i < 5; i++ {
+		broker.Publish(context.Background(), "prices", i)
+	}
+	if a, b := <-ch, <-ch; a != 3 || b != 4 {
+		t.Errorf("Expected to keep the latest 3 and 4. Got %d and %d.", a, b)
+	}
+}
+
+func TestBrokerDisconnectsSlowConsumer(t *testing.T) {
+	broker := NewBroker[int]()
+	defer broker.Close()
+	slow, _ := broker.Subscribe("events", WithBuffer(1), WithSlowConsumerPolicy(Disconnect))
+	fast, _ := broker.Subscribe("events", WithBuffer(10))
+	for i := 0; i < 3; i++ {
+		broker.Publish(context.Background(), "events", i)
+	}
+	received := 0
+	for range slow {
+		received++
+	}
+	if received != 1 {
+		t.Error("Expected the slow consumer to get 1 message before being disconnected. Got:", received)
+	}
+	if len(fast) != 3 {
+		t.Error("Expected the fast consumer to get all 3 messages. Got:", len(fast))
+	}
+}
+
+func TestBrokerBlockingPublish(t *testing.T) {
+	checkGoroutineLeaks(t)
+	broker := NewBroker[int]()
+	defer broker.Close()
+	_, unsubscribe := broker.Subscribe("orders", WithBuffer(0))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+	if err := broker.Publish(ctx, "orders", 1); err != context.DeadlineExceeded {
+		t.Error("Expected a blocked publish to time out. Got:", err)
+	}
+
+	// Unsubscribing releases a publisher blocked on the subscriber
+	go func() {
+		time.Sleep(time.Millisecond * 20)
+		unsubscribe()
+	}()
+	if err := broker.Publish(context.Background(), "orders", 2); err != nil {
+		t.Error("Expected publish to return once the subscriber left. Got:", err)
+	}
+}
+
+func TestBrokerCloseReleasesBlockedPublisher(t *testing.T) {
+	checkGoroutineLeaks(t)
+	broker := NewBroker[int]()
+	ch, _ := broker.Subscribe("orders", WithBuffer(0))
+
+	published := make(chan error)
+	go func() {
+		// Blocks holding the read lock, with a context that never ends
+		published <- broker.Publish(context.Background(), "orders", 1)
+	}()
+	time.Sleep(time.Millisecond * 20)
+
+	closed := make(chan struct{})
+	go func() {
+		broker.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Expected Close to return while a publisher was blocked")
+	}
+	if err := <-published; err != nil {
+		t.Error("Expected the blocked publish to return once the subscriber left. Got:", err)
+	}
+	if _, ok := <-ch; ok {
+		t.Error("Expected the subscriber's channel to be closed")
+	}
+	if ch, _ := broker.Subscribe("orders"); ch != nil {
+		if _, ok := <-ch; ok {
+			t.Error("Expected subscribing after Close to return a closed channel")
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package learning
+
+import (
+	"fmt"
+	"math/bits"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// BufferPool hands out []T buffers from power-of-two size classes, each class
+// backed by its own sync.Pool, so a buffer is only ever reused for requests of
+// a similar size. Buffers are not cleared between uses.
+//
+// In debug mode the pool remembers where every outstanding buffer was taken,
+// panics on a double or foreign Put, and reports unreturned buffers via Leaks.
+// That bookkeeping is slow; keep it for tests.
+type BufferPool[T any] struct {
+	classes [64]sync.Pool // class i holds *[]T with capacity 1<<i
+	debug   bool
+
+	gets    atomic.Uint64
+	puts    atomic.Uint64
+	allocs  atomic.Uint64
+	dropped atomic.Uint64
+
+	mu          sync.Mutex
+	outstanding map[*T]string // first element of each buffer -> stack of its Get
+}
+
+// BufferPoolStats counts pool activity. Allocs is the number of Gets that had
+// to allocate; Dropped counts Puts of buffers that fit no size class.
+type BufferPoolStats struct {
+	Gets    uint64
+	Puts    uint64
+	Allocs  uint64
+	Dropped uint64
+}
+
+func NewBufferPool[T any](debug bool) *BufferPool[T] {
+	p := &BufferPool[T]{debug: debug}
+	if debug {
+		p.outstanding = make(map[*T]string)
+	}
+	return p
+}
+
+// Get returns a buffer of length n and capacity n rounded up to a power of two.
+func (p *BufferPool[T]) Get(n int) []T {
+	p.gets.Add(1)
+	if n <= 0 {
+		return nil
+	}
+	class := bits.Len(uint(n - 1))
+	var buf []T
+	if v := p.classes[class].Get(); v != nil {
+		buf = (*v.(*[]T))[:n]
+	} else {
+		p.allocs.Add(1)
+		buf = make([]T, n, 1<<class)
+	}
+	if p.debug {
+		p.mu.Lock()
+		p.outstanding[&buf[:1][0]] = callers()
+		p.mu.Unlock()
+	}
+	return buf
+}
+
+// Put returns buf to the pool. buf must not be used afterwards.
+func (p *BufferPool[T]) Put(buf []T) {
+	c := cap(buf)
+	if c == 0 {
+		return
+	}
+	if p.debug {
+		key := &buf[:1][0]
+		p.mu.Lock()
+		_, ok := p.outstanding[key]
+		delete(p.outstanding, key)
+		p.mu.Unlock()
+		if !ok {
+			panic("bufferpool: Put of a buffer that is not outstanding (double Put or not from this pool)")
+		}
+	}
+	if c&(c-1) != 0 {
+		// Not one of ours, e.g. grown by append; let the GC have it
+		p.dropped.Add(1)
+		return
+	}
+	p.puts.Add(1)
+	buf = buf[:0]
+	p.classes[bits.Len(uint(c-1))].Put(&buf)
+}
+
+func (p *BufferPool[T]) Stats() BufferPoolStats {
+	return BufferPoolStats{
+		Gets:    p.gets.Load(),
+		Puts:    p.puts.Load(),
+		Allocs:  p.allocs.Load(),
+		Dropped: p.dropped.Load(),
+	}
+}
+
+// Leaks returns, in debug mode, the stack of every Get whose buffer has not
+// been Put back.
+func (p *BufferPool[T]) Leaks() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	result := make([]string, 0, len(p.outstanding))
+	for _, stack := range p.outstanding {
+		result = append(result, stack)
+	}
+	return result
+}
+
+func callers() string {
+	pcs := make([]uintptr, 16)
+	n := runtime.Callers(3, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+	var sb strings.Builder
+	for {
+		f, more := frames.Next()
+		fmt.Fprintf(&sb, "%s\n\t%s:%d\n", f.Function, f.File, f.Line)
+		if !more {
+			return sb.String()
+		}
+	}
+}
+
+func TestBufferPoolSizeClasses(t *testing.T) {
+	pool := NewBufferPool[int](false)
+	for _, tc := range []struct{ n, cap int }{{1, 1}, {3, 4}, {1000, 1024}, {1024, 1024}, {1025, 2048}} {
+		buf := pool.Get(tc.n)
+		if len(buf) != tc.n || cap(buf) != tc.cap {
+			t.Errorf("Get(%d): expected len %d cap %d. Got len %d cap %d.", tc.n, tc.n, tc.cap, len(buf), cap(buf))
+		}
+		pool.Put(buf)
+	}
+	if pool.Get(0) != nil {
+		t.Error("Expected Get(0) to return nil.")
+	}
+}
+
+func TestBufferPoolReuse(t *testing.T) {
+	pool := NewBufferPool[byte](false)
+	for i := 0; i < 100; i++ {
+		buf := pool.Get(500)
+		pool.Put(buf)
+	}
+	pool.Put(make([]byte, 10, 10))
+	stats := pool.Stats()
+	if stats.Gets != 100 || stats.Puts != 100 || stats.Dropped != 1 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+	// sync.Pool may drop items at any GC (and at random under -race), so only
+	// check that most Gets were served from the pool.
+	if stats.Allocs > 50 {
+		t.Error("Expected buffers to be reused. Allocations:", stats.Allocs)
+	}
+}
+
+func TestBufferPoolDebug(t *testing.T) {
+	pool := NewBufferPool[int](true)
+	kept := pool.Get(10)
+	returned := pool.Get(10)
+	pool.Put(returned)
+
+	leaks := pool.Leaks()
+	if len(leaks) != 1 || !strings.Contains(leaks[0], "TestBufferPoolDebug") {
+		t.Error("Expected the kept buffer to be reported with its caller. Got:", leaks)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected a double Put to panic.")
+		}
+	}()
+	pool.Put(kept)
+	pool.Put(kept)
+}
+
+func BenchmarkBufferPool(b *testing.B) {
+	for _, size := range []int{64, 4096, 1 << 16} {
+		pool := NewBufferPool[byte](false)
+		b.Run(fmt.Sprintf("pool-%d", size), func(b *testing.B) {
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					buf := pool.Get(size)
+					buf[0] = 1
+					pool.Put(buf)
+				}
+			})
+		})
+		b.Run(fmt.Sprintf("make-%d", size), func(b *testing.B) {
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					buf := make([]byte, size)
+					buf[0] = 1
+					benchmarkSink.Store(&buf)
+				}
+			})
+		})
+	}
+}
+
+// benchmarkSink keeps the compiler from optimising allocations away.
+var benchmarkSink atomic.Pointer[[]byte]
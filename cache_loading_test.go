@@ -0,0 +1,304 @@
+package learning
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Loader fetches the value for a key that is missing from a LoadingCache.
+type Loader[K comparable, V any] func(ctx context.Context, key K) (V, error)
+
+// LoadingCache fills misses of the wrapped Cache through a Loader. Concurrent
+// misses on the same key share a single loader call and all receive its
+// result or error. Errors are not cached.
+type LoadingCache[K comparable, V any] struct {
+	Cache[K, V]
+	loader Loader[K, V]
+
+	mu    sync.Mutex
+	calls map[K]*loadCall[V]
+}
+
+// loadCall is an in-flight loader call. waiters counts the callers still
+// interested in it; when the last one gives up the loader is cancelled.
+type loadCall[V any] struct {
+	done    chan struct{}
+	value   V
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+func NewLoadingCache[K comparable, V any](cache Cache[K, V], loader Loader[K, V]) *LoadingCache[K, V] {
+	return &LoadingCache[K, V]{
+		Cache:  cache,
+		loader: loader,
+		calls:  make(map[K]*loadCall[V]),
+	}
+}
+
+// Get returns the cached value for key, running the loader on a miss. If ctx
+// ends first Get returns ctx.Err(); the loader keeps running for as long as
+// any other caller is still waiting on it.
+func (lc *LoadingCache[K, V]) Get(ctx context.Context, key K) (V, error) {
+	if v, ok := lc.Lookup(key); ok {
+		return v, nil
+	}
+
+	lc.mu.Lock()
+	// A load may have stored the value and forgotten its call since the
+	// lookup above; both happen under lc.mu, so looking again can't miss both.
+	// The miss is already counted, so this look doesn't count.
+	if v, ok := lc.peek(key); ok {
+		lc.mu.Unlock()
+		return v, nil
+	}
+	call, ok := lc.calls[key]
+	if !ok {
+		// The loader must outlive the caller that happened to start it, so it
+		// only inherits ctx's values, not its cancellation.
+		loadCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		call = &loadCall[V]{done: make(chan struct{}), cancel: cancel}
+		lc.calls[key] = call
+		go lc.load(loadCtx, key, call)
+	}
+	call.waiters++
+	lc.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.value, call.err
+	case <-ctx.Done():
+		lc.mu.Lock()
+		call.waiters--
+		if call.waiters == 0 && lc.calls[key] == call {
+			delete(lc.calls, key)
+			call.cancel()
+		}
+		lc.mu.Unlock()
+		var zero V
+		return zero, ctx.Err()
+	}
+}
+
+// uncountedLookup is implemented by the caches in this package: a lookup that
+// leaves their stats alone.
+type uncountedLookup[K comparable, V any] interface {
+	lookup(key K) (V, bool)
+}
+
+// peek looks key up without counting a hit or miss when the wrapped cache
+// allows it.
+func (lc *LoadingCache[K, V]) peek(key K) (V, bool) {
+	if c, ok := lc.Cache.(uncountedLookup[K, V]); ok {
+		return c.lookup(key)
+	}
+	return lc.Lookup(key)
+}
+
+func (lc *LoadingCache[K, V]) load(ctx context.Context, key K, call *loadCall[V]) {
+	defer call.cancel()
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				call.err = fmt.Errorf("loader panicked for key %v: %v", key, r)
+			}
+		}()
+		call.value, call.err = lc.loader(ctx, key)
+	}()
+
+	lc.mu.Lock()
+	// Store and forget the call together, under lc.mu, where Get looks for
+	// either.
+	if call.err == nil && ctx.Err() == nil {
+		lc.Store(key, call.value)
+	}
+	if lc.calls[key] == call {
+		delete(lc.calls, key)
+	}
+	lc.mu.Unlock()
+	close(call.done)
+}
+
+func TestLoadingCacheCoalescesConcurrentMisses(t *testing.T) {
+	checkGoroutineLeaks(t)
+	var calls int64
+	release := make(chan struct{})
+	lc := NewLoadingCache(newCache[string, int](), func(ctx context.Context, key string) (int, error) {
+		atomic.AddInt64(&calls, 1)
+		<-release
+		return len(key), nil
+	})
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := lc.Get(context.Background(), "hello")
+			if err != nil || v != 5 {
+				t.Errorf("Expected 5. Got %d, %v.", v, err)
+			}
+		}()
+	}
+	// Give the waiters a moment to pile up behind the first loader call
+	time.Sleep(time.Millisecond * 50)
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Error("Expected exactly one loader call. Got:", calls)
+	}
+	if v, ok := lc.Lookup("hello"); !ok || v != 5 {
+		t.Error("Expected the loaded value to be cached.")
+	}
+}
+
+// slowMissCache stalls callers that miss, as if they were preempted right
+// after their lookup.
+type slowMissCache[K comparable, V any] struct {
+	Cache[K, V]
+}
+
+func (c slowMissCache[K, V]) Lookup(key K) (V, bool) {
+	v, ok := c.Cache.Lookup(key)
+	if !ok {
+		time.Sleep(time.Millisecond)
+	}
+	return v, ok
+}
+
+func TestLoadingCacheCountsOneMissPerGet(t *testing.T) {
+	lc := NewLoadingCache(newCache[string, int](), func(ctx context.Context, key string) (int, error) {
+		return len(key), nil
+	})
+	for i := 0; i < 2; i++ {
+		if _, err := lc.Get(context.Background(), "hello"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats := lc.Stats(); stats.Misses != 1 || stats.Hits != 1 {
+		t.Errorf("Expected 1 miss and 1 hit. Got: %d misses and %d hits.", stats.Misses, stats.Hits)
+	}
+}
+
+func TestLoadingCacheLoadsEachKeyOnceUnderContention(t *testing.T) {
+	var calls int64
+	lc := NewLoadingCache[int, int](slowMissCache[int, int]{newCache[int, int]()}, func(ctx context.Context, key int) (int, error) {
+		atomic.AddInt64(&calls, 1)
+		return key, nil
+	})
+
+	// The loader finishes while the other callers are stalled between their
+	// lookup and joining its call, when they would start another.
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if v, err := lc.Get(context.Background(), 7); err != nil || v != 7 {
+				t.Errorf("Expected 7. Got %d, %v.", v, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if calls != 1 {
+		t.Error("Expected exactly one loader call. Got:", calls)
+	}
+}
+
+func TestLoadingCacheSharesErrorsWithoutCachingThem(t *testing.T) {
+	var calls int64
+	release := make(chan struct{})
+	errBoom := errors.New("boom")
+	lc := NewLoadingCache(newCache[int, int](), func(ctx context.Context, key int) (int, error) {
+		if atomic.AddInt64(&calls, 1) == 1 {
+			<-release
+			return 0, errBoom
+		}
+		return key, nil
+	})
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := lc.Get(context.Background(), 7); err != errBoom {
+				t.Error("Expected every waiter to get the loader error. Got:", err)
+			}
+		}()
+	}
+	time.Sleep(time.Millisecond * 50)
+	close(release)
+	wg.Wait()
+
+	v, err := lc.Get(context.Background(), 7)
+	if err != nil || v != 7 {
+		t.Errorf("Expected the failed key to be loaded again. Got %d, %v.", v, err)
+	}
+	if calls != 2 {
+		t.Error("Expected two loader calls. Got:", calls)
+	}
+}
+
+func TestLoadingCacheWaiterCancellation(t *testing.T) {
+	checkGoroutineLeaks(t)
+	release := make(chan struct{})
+	loaderCancelled := make(chan struct{})
+	lc := NewLoadingCache(newCache[int, int](), func(ctx context.Context, key int) (int, error) {
+		if key == 1 {
+			<-release
+			return key, nil
+		}
+		<-ctx.Done()
+		close(loaderCancelled)
+		return 0, ctx.Err()
+	})
+
+	// One waiter gives up while another keeps waiting: the load must survive
+	patient := make(chan error)
+	go func() {
+		_, err := lc.Get(context.Background(), 1)
+		patient <- err
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+	if _, err := lc.Get(ctx, 1); err != context.DeadlineExceeded {
+		t.Error("Expected impatient waiter to time out. Got:", err)
+	}
+	close(release)
+	if err := <-patient; err != nil {
+		t.Error("Expected patient waiter to get the value. Got:", err)
+	}
+
+	// When every waiter gives up the loader itself is cancelled
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(time.Millisecond * 20)
+		cancel()
+	}()
+	if _, err := lc.Get(ctx, 2); err != context.Canceled {
+		t.Error("Expected sole waiter to be cancelled. Got:", err)
+	}
+	select {
+	case <-loaderCancelled:
+	case <-time.After(time.Second):
+		t.Error("Expected the abandoned loader to be cancelled.")
+	}
+}
+
+func TestLoadingCacheRecoversLoaderPanic(t *testing.T) {
+	lc := NewLoadingCache(newCache[int, int](), func(ctx context.Context, key int) (int, error) {
+		panic("no value")
+	})
+	if _, err := lc.Get(context.Background(), 1); err == nil {
+		t.Error("Expected loader panic to surface as an error.")
+	}
+}
@@ -0,0 +1,324 @@
+package learning
+
+import (
+	"fmt"
+	"hash/maphash"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// WithShards makes newCache return a lock-striped cache with n shards, each a
+// plain map behind its own RWMutex. It cannot be combined with WithMaxSize.
+func WithShards[K comparable, V any](n int) CacheOption[K, V] {
+	return func(cfg *cacheConfig[K, V]) {
+		cfg.shards = n
+	}
+}
+
+type shardEntry[V any] struct {
+	value     V
+	expiresAt time.Time
+}
+
+type cacheShard[K comparable, V any] struct {
+	mu    sync.RWMutex
+	store map[K]shardEntry[V]
+}
+
+type shardedCache[K comparable, V any] struct {
+	shards []*cacheShard[K, V]
+	seed   maphash.Seed
+	cfg    cacheConfig[K, V]
+	now    func() time.Time
+	stats  cacheCounters
+}
+
+func newShardedCache[K comparable, V any](cfg cacheConfig[K, V]) *shardedCache[K, V] {
+	result := &shardedCache[K, V]{
+		shards: make([]*cacheShard[K, V], cfg.shards),
+		seed:   maphash.MakeSeed(),
+		cfg:    cfg,
+		now:    time.Now,
+	}
+	for i := range result.shards {
+		result.shards[i] = &cacheShard[K, V]{store: make(map[K]shardEntry[V])}
+	}
+	return result
+}
+
+// shard picks the shard for key. Common key types are hashed directly; anything
+// else goes through its fmt representation, which is slower but still stable.
+func (c *shardedCache[K, V]) shard(key K) *cacheShard[K, V] {
+	var h uint64
+	switch k := any(key).(type) {
+	case int:
+		h = mix64(uint64(k))
+	case int64:
+		h = mix64(uint64(k))
+	case uint64:
+		h = mix64(k)
+	case string:
+		h = maphash.String(c.seed, k)
+	default:
+		h = maphash.String(c.seed, fmt.Sprint(k))
+	}
+	return c.shards[h%uint64(len(c.shards))]
+}
+
+// mix64 is the splitmix64 finaliser; it spreads sequential integer keys
+// evenly across shards.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+func (c *shardedCache[K, V]) Store(key K, value V) {
+	c.StoreWithTTL(key, value, c.cfg.ttl)
+}
+
+func (c *shardedCache[K, V]) StoreWithTTL(key K, value V, ttl time.Duration) {
+	c.stats.stores.Add(1)
+	e := shardEntry[V]{value: value}
+	if ttl > 0 {
+		e.expiresAt = c.now().Add(ttl)
+	}
+	s := c.shard(key)
+	s.mu.Lock()
+	s.store[key] = e
+	s.mu.Unlock()
+}
+
+func (c *shardedCache[K, V]) Retrieve(key K) V {
+	v, _ := c.Lookup(key)
+	return v
+}
+
+func (c *shardedCache[K, V]) Lookup(key K) (V, bool) {
+	v, ok := c.lookup(key)
+	c.stats.lookup(ok)
+	return v, ok
+}
+
+func (c *shardedCache[K, V]) lookup(key K) (V, bool) {
+	var zero V
+	s := c.shard(key)
+	s.mu.RLock()
+	e, ok := s.store[key]
+	s.mu.RUnlock()
+	if !ok {
+		return zero, false
+	}
+	if c.expired(e) {
+		s.mu.Lock()
+		// Only drop the entry if it wasn't refreshed while we were unlocked
+		current, ok := s.store[key]
+		if ok && c.expired(current) {
+			delete(s.store, key)
+		} else {
+			ok = false
+		}
+		s.mu.Unlock()
+		if ok {
+			c.evicted(key, current.value, EvictedExpired)
+		}
+		return zero, false
+	}
+	return e.value, true
+}
+
+func (c *shardedCache[K, V]) Delete(key K) {
+	s := c.shard(key)
+	s.mu.Lock()
+	e, ok := s.store[key]
+	delete(s.store, key)
+	s.mu.Unlock()
+	if ok {
+		c.evicted(key, e.value, EvictedDeleted)
+	}
+}
+
+// Len reports the number of entries held, including expired entries that have
+// not been dropped yet.
+func (c *shardedCache[K, V]) Len() int {
+	size := 0
+	for _, s := range c.shards {
+		s.mu.RLock()
+		size += len(s.store)
+		s.mu.RUnlock()
+	}
+	return size
+}
+
+// PurgeExpired drops every expired entry and returns how many were dropped.
+func (c *shardedCache[K, V]) PurgeExpired() int {
+	purged := 0
+	for _, s := range c.shards {
+		var expired []K
+		var values []V
+		s.mu.Lock()
+		for k, e := range s.store {
+			if c.expired(e) {
+				delete(s.store, k)
+				expired = append(expired, k)
+				values = append(values, e.value)
+			}
+		}
+		s.mu.Unlock()
+		for i, k := range expired {
+			c.evicted(k, values[i], EvictedExpired)
+		}
+		purged += len(expired)
+	}
+	return purged
+}
+
+func (c *shardedCache[K, V]) expired(e shardEntry[V]) bool {
+	return !e.expiresAt.IsZero() && !c.now().Before(e.expiresAt)
+}
+
+func (c *shardedCache[K, V]) Stats() CacheStats {
+	return c.stats.snapshot(c.Len())
+}
+
+func (c *shardedCache[K, V]) evicted(key K, value V, reason EvictionReason) {
+	c.stats.evicted(reason)
+	if c.cfg.onEvict != nil {
+		c.cfg.onEvict(key, value, reason)
+	}
+}
+
+func TestShardedCache(t *testing.T) {
+	var evictions []EvictionReason
+	c := newCache(
+		WithShards[string, int](8),
+		WithEvictionCallback(func(key string, value int, reason EvictionReason) {
+			evictions = append(evictions, reason)
+		}),
+	).(*shardedCache[string, int])
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	for i := 0; i < 100; i++ {
+		c.Store(strconv.Itoa(i), i)
+	}
+	if c.Len() != 100 {
+		t.Fatal("Expected 100 entries. Got:", c.Len())
+	}
+	for i := 0; i < 100; i++ {
+		if v, ok := c.Lookup(strconv.Itoa(i)); !ok || v != i {
+			t.Errorf("Expected %d. Got %d, %v.", i, v, ok)
+		}
+	}
+	used := 0
+	for _, s := range c.shards {
+		if len(s.store) > 0 {
+			used++
+		}
+	}
+	if used != len(c.shards) {
+		t.Errorf("Expected keys to spread over all %d shards. Used %d.", len(c.shards), used)
+	}
+
+	c.StoreWithTTL("short", 1, time.Second)
+	now = now.Add(time.Minute)
+	if _, ok := c.Lookup("short"); ok {
+		t.Error("Expected short to have expired.")
+	}
+	c.Delete("0")
+	if _, ok := c.Lookup("0"); ok {
+		t.Error("Expected 0 to have been deleted.")
+	}
+	if len(evictions) != 2 || evictions[0] != EvictedExpired || evictions[1] != EvictedDeleted {
+		t.Error("Expected an expiry and a delete callback. Got:", evictions)
+	}
+}
+
+func TestShardedCacheRejectsMaxSize(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected combining WithShards and WithMaxSize to panic.")
+		}
+	}()
+	newCache(WithShards[int, int](4), WithMaxSize[int, int](10))
+}
+
+func TestThreadSafeShardedCache(t *testing.T) {
+	cache := newCache(WithShards[int, int](16))
+	wg := sync.WaitGroup{}
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				k := g*1000 + i
+				cache.Store(k, k)
+				if v := cache.Retrieve(k); v != k {
+					t.Errorf("Expected %d. Got %d.", k, v)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	if cache.Len() != 8000 {
+		t.Error("Expected 8000 entries. Got:", cache.Len())
+	}
+}
+
+// The benchmarks below compare the cache backends across workloads. Run with
+//	go test -run XXX -bench CacheBackends -cpu 1,4,16
+// and compare the ns/op of each backend within a workload.
+
+var cacheBackends = []struct {
+	name   string
+	create func() Cache[int, int]
+}{
+	{"syncmap", func() Cache[int, int] { return newCache[int, int]() }},
+	{"sharded16", func() Cache[int, int] { return newCache(WithShards[int, int](16)) }},
+	{"sharded64", func() Cache[int, int] { return newCache(WithShards[int, int](64)) }},
+	{"lru", func() Cache[int, int] { return newCache(WithMaxSize[int, int](1 << 21)) }},
+}
+
+var cacheWorkloads = []struct {
+	name       string
+	writeRatio int // percentage of operations that are stores
+	keys       int
+}{
+	{"read-heavy", 10, 1024},
+	{"write-heavy", 90, 1024},
+	{"mixed", 50, 1024},
+	{"high-cardinality", 50, 1 << 20},
+}
+
+func BenchmarkCacheBackends(b *testing.B) {
+	for _, w := range cacheWorkloads {
+		for _, backend := range cacheBackends {
+			w, backend := w, backend
+			b.Run(w.name+"/"+backend.name, func(b *testing.B) {
+				cache := backend.create()
+				for k := 0; k < w.keys; k++ {
+					cache.Store(k, k)
+				}
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					// Each goroutine walks its own pseudo-random sequence of keys and operations
+					x := uint64(time.Now().UnixNano())
+					for pb.Next() {
+						x = mix64(x + 1)
+						k := int(x % uint64(w.keys))
+						if int(x>>32%100) < w.writeRatio {
+							cache.Store(k, k)
+						} else {
+							cache.Retrieve(k)
+						}
+					}
+				})
+			})
+		}
+	}
+}
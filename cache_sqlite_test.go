@@ -0,0 +1,703 @@
+package learning
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// SQLiteCacheConfig tunes the write-behind and expiry behaviour of a SQLite
+// backed cache. Zero values fall back to the defaults below.
+type SQLiteCacheConfig struct {
+	FlushInterval time.Duration // how long a Store may sit in memory; default 100ms
+	BatchSize     int           // pending writes that trigger an early flush; default 500
+	SweepInterval time.Duration // how often expired rows are deleted; default 1m
+	OnError       func(error)   // background and encoding failures; default log.Printf
+}
+
+// sqlitePending is a write that has been accepted by Store or Delete but not
+// yet committed to the table. key and raw hold the JSON the table will get.
+type sqlitePending[V any] struct {
+	key       string
+	value     V
+	raw       []byte
+	expiresAt time.Time
+	deleted   bool
+}
+
+// sqliteCache is a Cache whose entries live in a SQLite table so that they
+// survive restarts. Keys and values are stored JSON encoded; a store whose
+// key or value can't be encoded is reported to OnError and dropped. Stores and
+// deletes are buffered and written in batches by a background goroutine;
+// lookups see buffered writes straight away. Close must be called to flush
+// the last batch; storing or deleting after Close panics.
+type sqliteCache[K comparable, V any] struct {
+	db    *sql.DB
+	table string
+	cfg   cacheConfig[K, V]
+	sql   SQLiteCacheConfig
+	now   func() time.Time
+	stats cacheCounters
+
+	mu       sync.Mutex
+	pending  map[K]sqlitePending[V]
+	inflight map[K]sqlitePending[V] // batch currently being committed
+	flushMu  sync.Mutex             // keeps batches in order
+	closed   bool
+
+	flushNow  chan struct{}
+	quit      chan struct{}
+	done      sync.WaitGroup
+	closeOnce sync.Once
+}
+
+var sqliteIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func newSQLiteCache[K comparable, V any](db *sql.DB, table string, sqlCfg SQLiteCacheConfig, opts ...CacheOption[K, V]) (*sqliteCache[K, V], error) {
+	if !sqliteIdentifier.MatchString(table) {
+		return nil, fmt.Errorf("invalid cache table name %q", table)
+	}
+	if sqlCfg.FlushInterval <= 0 {
+		sqlCfg.FlushInterval = time.Millisecond * 100
+	}
+	if sqlCfg.BatchSize <= 0 {
+		sqlCfg.BatchSize = 500
+	}
+	if sqlCfg.SweepInterval <= 0 {
+		sqlCfg.SweepInterval = time.Minute
+	}
+	if sqlCfg.OnError == nil {
+		sqlCfg.OnError = func(err error) {
+			log.Printf("sqlite cache %s: %v", table, err)
+		}
+	}
+
+	createSQL := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS "%s" (
+					"key" text NOT NULL PRIMARY KEY,
+					"value" blob NOT NULL,
+					"expires_at" integer NOT NULL)`, table)
+	if _, err := db.Exec(createSQL); err != nil {
+		return nil, fmt.Errorf("could not create cache table %s: %w", table, err)
+	}
+
+	result := &sqliteCache[K, V]{
+		db:       db,
+		table:    table,
+		sql:      sqlCfg,
+		now:      time.Now,
+		pending:  make(map[K]sqlitePending[V]),
+		flushNow: make(chan struct{}, 1),
+		quit:     make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(&result.cfg)
+	}
+	result.done.Add(2)
+	go result.flusher()
+	go result.sweeper()
+	return result, nil
+}
+
+func (c *sqliteCache[K, V]) Store(key K, value V) {
+	c.StoreWithTTL(key, value, c.cfg.ttl)
+}
+
+func (c *sqliteCache[K, V]) StoreWithTTL(key K, value V, ttl time.Duration) {
+	// Encoded now rather than in the batch, where it would fail every flush
+	raw, err := json.Marshal(value)
+	if err != nil {
+		c.sql.OnError(fmt.Errorf("could not store %v: %w", key, err))
+		return
+	}
+	p := sqlitePending[V]{value: value, raw: raw}
+	if ttl > 0 {
+		p.expiresAt = c.now().Add(ttl)
+	}
+	if c.enqueue(key, p) {
+		c.stats.stores.Add(1)
+	}
+}
+
+func (c *sqliteCache[K, V]) Retrieve(key K) V {
+	v, _ := c.Lookup(key)
+	return v
+}
+
+func (c *sqliteCache[K, V]) Lookup(key K) (V, bool) {
+	v, ok := c.lookup(key)
+	c.stats.lookup(ok)
+	return v, ok
+}
+
+func (c *sqliteCache[K, V]) lookup(key K) (V, bool) {
+	var zero V
+	c.mu.Lock()
+	p, ok := c.pending[key]
+	if !ok {
+		p, ok = c.inflight[key]
+	}
+	c.mu.Unlock()
+	if ok {
+		if p.deleted || c.expired(p.expiresAt) {
+			return zero, false
+		}
+		return p.value, true
+	}
+
+	k, err := json.Marshal(key)
+	if err != nil {
+		c.sql.OnError(err)
+		return zero, false
+	}
+	var (
+		raw       []byte
+		expiresAt int64
+	)
+	query := fmt.Sprintf(`SELECT "value", "expires_at" FROM "%s" WHERE "key" = $1`, c.table)
+	err = c.db.QueryRow(query, string(k)).Scan(&raw, &expiresAt)
+	if err == sql.ErrNoRows {
+		return zero, false
+	}
+	if err != nil {
+		c.sql.OnError(err)
+		return zero, false
+	}
+	if c.expired(fromUnixNano(expiresAt)) {
+		// Left for the sweeper, which will report the eviction
+		return zero, false
+	}
+	var v V
+	if err := json.Unmarshal(raw, &v); err != nil {
+		c.sql.OnError(err)
+		return zero, false
+	}
+	return v, true
+}
+
+func (c *sqliteCache[K, V]) Delete(key K) {
+	v, ok := c.lookup(key)
+	c.enqueue(key, sqlitePending[V]{deleted: true})
+	if ok {
+		c.evicted(key, v, EvictedDeleted)
+	}
+}
+
+// Len counts the rows the table will have once pending writes are flushed,
+// including expired rows the sweeper has not removed yet. It doesn't flush.
+func (c *sqliteCache[K, V]) Len() int {
+	c.mu.Lock()
+	writes := make(map[string]bool, len(c.inflight)+len(c.pending))
+	for _, p := range c.inflight {
+		writes[p.key] = !p.deleted
+	}
+	for _, p := range c.pending {
+		writes[p.key] = !p.deleted
+	}
+	c.mu.Unlock()
+
+	count, err := c.count(writes)
+	if err != nil {
+		c.sql.OnError(err)
+	}
+	return count
+}
+
+// count counts the committed rows whose keys writes doesn't touch, plus the
+// keys writes leaves present.
+func (c *sqliteCache[K, V]) count(writes map[string]bool) (int, error) {
+	// One transaction so that both counts see the same rows
+	tx, err := c.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	var count int
+	if err := tx.QueryRow(fmt.Sprintf(`SELECT COUNT(1) FROM "%s"`, c.table)).Scan(&count); err != nil {
+		return 0, err
+	}
+	keys := make([]interface{}, 0, len(writes))
+	for k, present := range writes {
+		keys = append(keys, k)
+		if present {
+			count++
+		}
+	}
+	// In chunks that stay under SQLite's limit on parameters
+	for len(keys) > 0 {
+		n := min(len(keys), 500)
+		query := fmt.Sprintf(`SELECT COUNT(1) FROM "%s" WHERE "key" IN (?%s)`, c.table, strings.Repeat(", ?", n-1))
+		var written int
+		if err := tx.QueryRow(query, keys[:n]...).Scan(&written); err != nil {
+			return 0, err
+		}
+		count -= written
+		keys = keys[n:]
+	}
+	return count, nil
+}
+
+func (c *sqliteCache[K, V]) Stats() CacheStats {
+	return c.stats.snapshot(c.Len())
+}
+
+// Flush commits all pending writes in one transaction.
+func (c *sqliteCache[K, V]) Flush() error {
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
+
+	c.mu.Lock()
+	batch := c.pending
+	if len(batch) == 0 {
+		c.mu.Unlock()
+		return nil
+	}
+	c.pending = make(map[K]sqlitePending[V])
+	c.inflight = batch
+	c.mu.Unlock()
+
+	err := c.write(batch)
+
+	c.mu.Lock()
+	if err != nil {
+		// Put the batch back underneath anything written since, so it is retried
+		for k, p := range batch {
+			if _, ok := c.pending[k]; !ok {
+				c.pending[k] = p
+			}
+		}
+	}
+	c.inflight = nil
+	c.mu.Unlock()
+	return err
+}
+
+// Close stops the background goroutines and flushes the last batch. It does
+// not close the underlying database.
+func (c *sqliteCache[K, V]) Close() error {
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		c.closed = true
+		c.mu.Unlock()
+		close(c.quit)
+	})
+	c.done.Wait()
+	return c.Flush()
+}
+
+// enqueue buffers p for key and reports whether it was accepted.
+func (c *sqliteCache[K, V]) enqueue(key K, p sqlitePending[V]) bool {
+	k, err := json.Marshal(key)
+	if err != nil {
+		c.sql.OnError(fmt.Errorf("could not write %v: %w", key, err))
+		return false
+	}
+	p.key = string(k)
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		// Nothing would ever flush it
+		panic("cache: write to closed sqlite cache")
+	}
+	c.pending[key] = p
+	full := len(c.pending) >= c.sql.BatchSize
+	c.mu.Unlock()
+	if full {
+		select {
+		case c.flushNow <- struct{}{}:
+		default:
+		}
+	}
+	return true
+}
+
+func (c *sqliteCache[K, V]) write(batch map[K]sqlitePending[V]) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	upsert, err := tx.Prepare(fmt.Sprintf(`INSERT OR REPLACE INTO "%s" ("key", "value", "expires_at") VALUES ($1, $2, $3)`, c.table))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer upsert.Close()
+	remove, err := tx.Prepare(fmt.Sprintf(`DELETE FROM "%s" WHERE "key" = $1`, c.table))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer remove.Close()
+
+	for _, p := range batch {
+		if p.deleted {
+			_, err = remove.Exec(p.key)
+		} else {
+			_, err = upsert.Exec(p.key, p.raw, toUnixNano(p.expiresAt))
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (c *sqliteCache[K, V]) flusher() {
+	defer c.done.Done()
+	ticker := time.NewTicker(c.sql.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.flushNow:
+		case <-c.quit:
+			return
+		}
+		if err := c.Flush(); err != nil {
+			c.sql.OnError(err)
+		}
+	}
+}
+
+func (c *sqliteCache[K, V]) sweeper() {
+	defer c.done.Done()
+	ticker := time.NewTicker(c.sql.SweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := c.sweep(); err != nil {
+				c.sql.OnError(err)
+			}
+		case <-c.quit:
+			return
+		}
+	}
+}
+
+// sweep deletes expired rows and returns how many it removed. Rows are read
+// first only when somebody is listening for evictions.
+func (c *sqliteCache[K, V]) sweep() (int, error) {
+	now := c.now().UnixNano()
+	if c.cfg.onEvict == nil {
+		result, err := c.db.Exec(fmt.Sprintf(`DELETE FROM "%s" WHERE "expires_at" > 0 AND "expires_at" <= $1`, c.table), now)
+		if err != nil {
+			return 0, err
+		}
+		n, err := result.RowsAffected()
+		for i := int64(0); i < n; i++ {
+			c.stats.evicted(EvictedExpired)
+		}
+		return int(n), err
+	}
+
+	tx, err := c.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	rows, err := tx.Query(fmt.Sprintf(`SELECT "key", "value" FROM "%s" WHERE "expires_at" > 0 AND "expires_at" <= $1`, c.table), now)
+	if err != nil {
+		return 0, err
+	}
+	var (
+		keys   []K
+		values []V
+	)
+	for rows.Next() {
+		var rawKey, rawValue []byte
+		if err := rows.Scan(&rawKey, &rawValue); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		var (
+			k K
+			v V
+		)
+		if err := json.Unmarshal(rawKey, &k); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if err := json.Unmarshal(rawValue, &v); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		keys = append(keys, k)
+		values = append(values, v)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(fmt.Sprintf(`DELETE FROM "%s" WHERE "expires_at" > 0 AND "expires_at" <= $1`, c.table), now); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	for i, k := range keys {
+		c.evicted(k, values[i], EvictedExpired)
+	}
+	return len(keys), nil
+}
+
+func (c *sqliteCache[K, V]) expired(expiresAt time.Time) bool {
+	return !expiresAt.IsZero() && !c.now().Before(expiresAt)
+}
+
+func (c *sqliteCache[K, V]) evicted(key K, value V, reason EvictionReason) {
+	c.stats.evicted(reason)
+	if c.cfg.onEvict != nil {
+		c.cfg.onEvict(key, value, reason)
+	}
+}
+
+func toUnixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func fromUnixNano(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
+
+func openCacheDB(t *testing.T, path string) *sql.DB {
+	db, err := sql.Open("sqlite3", "file:"+path)
+	if err != nil {
+		t.Fatal("Could not open DB: ", err)
+	}
+	return db
+}
+
+func TestSQLiteCacheSurvivesRestart(t *testing.T) {
+	checkGoroutineLeaks(t)
+	path := filepath.Join(t.TempDir(), "cache.db")
+	type profile struct {
+		Name   string
+		Emails []string
+	}
+
+	db := openCacheDB(t, path)
+	cache, err := newSQLiteCache[string, profile](db, "profiles", SQLiteCacheConfig{FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Store("arun", profile{Name: "Arun", Emails: []string{"arunsworld@gmail.com"}})
+	cache.Store("zero", profile{})
+	cache.Store("gone", profile{Name: "Gone"})
+	cache.Delete("gone")
+
+	// Nothing has been flushed yet but lookups must already see the writes
+	var rows int
+	db.QueryRow(`SELECT COUNT(1) FROM profiles`).Scan(&rows)
+	if rows != 0 {
+		t.Error("Expected writes to be buffered. Found rows:", rows)
+	}
+	if p, ok := cache.Lookup("arun"); !ok || p.Name != "Arun" {
+		t.Error("Expected buffered write to be visible. Got:", p, ok)
+	}
+	if err := cache.Close(); err != nil {
+		t.Fatal("Could not close cache: ", err)
+	}
+	db.Close()
+
+	db = openCacheDB(t, path)
+	defer db.Close()
+	cache, err = newSQLiteCache[string, profile](db, "profiles", SQLiteCacheConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	p, ok := cache.Lookup("arun")
+	if !ok || p.Name != "Arun" || len(p.Emails) != 1 {
+		t.Error("Expected arun to survive the restart. Got:", p, ok)
+	}
+	if _, ok := cache.Lookup("zero"); !ok {
+		t.Error("Expected a stored zero value to be found.")
+	}
+	if _, ok := cache.Lookup("gone"); ok {
+		t.Error("Expected deleted key to stay deleted.")
+	}
+	if cache.Len() != 2 {
+		t.Error("Expected 2 rows. Got:", cache.Len())
+	}
+}
+
+func TestSQLiteCacheWriteAfterClosePanics(t *testing.T) {
+	db := openCacheDB(t, filepath.Join(t.TempDir(), "cache.db"))
+	defer db.Close()
+	cache, err := newSQLiteCache[string, int](db, "numbers", SQLiteCacheConfig{FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Store("one", 1)
+	if err := cache.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := cache.Lookup("one"); !ok || v != 1 {
+		t.Error("Expected the store before Close to be flushed. Got:", v, ok)
+	}
+	for name, write := range map[string]func(){
+		"Store":  func() { cache.Store("two", 2) },
+		"Delete": func() { cache.Delete("one") },
+	} {
+		func() {
+			defer func() {
+				if r := recover(); r == nil {
+					t.Errorf("Expected %s after Close to panic", name)
+				}
+			}()
+			write()
+		}()
+	}
+}
+
+func TestSQLiteCacheBatchesWrites(t *testing.T) {
+	db := openCacheDB(t, filepath.Join(t.TempDir(), "cache.db"))
+	defer db.Close()
+	cache, err := newSQLiteCache[int, int](db, "numbers", SQLiteCacheConfig{FlushInterval: time.Hour, BatchSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	for i := 0; i < 10; i++ {
+		cache.Store(i, i*i)
+	}
+	// Hitting the batch size wakes the flusher without waiting for the interval
+	deadline := time.Now().Add(time.Second * 5)
+	rows := 0
+	for rows != 10 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+		db.QueryRow(`SELECT COUNT(1) FROM numbers`).Scan(&rows)
+	}
+	if rows != 10 {
+		t.Fatal("Expected a full batch to be flushed. Found rows:", rows)
+	}
+	if v := cache.Retrieve(9); v != 81 {
+		t.Error("Expected 81. Got:", v)
+	}
+}
+
+func TestSQLiteCacheDropsUnencodableValues(t *testing.T) {
+	db := openCacheDB(t, filepath.Join(t.TempDir(), "cache.db"))
+	defer db.Close()
+	var errs []error
+	cache, err := newSQLiteCache[string, float64](db, "numbers", SQLiteCacheConfig{
+		FlushInterval: time.Hour,
+		OnError:       func(err error) { errs = append(errs, err) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	cache.Store("nan", math.NaN())
+	cache.Store("pi", math.Pi)
+	if len(errs) != 1 {
+		t.Fatal("Expected the NaN to be reported. Got:", errs)
+	}
+	if _, ok := cache.Lookup("nan"); ok {
+		t.Error("Expected the NaN to be dropped.")
+	}
+	// The bad value must not hold back the writes around it
+	if err := cache.Flush(); err != nil {
+		t.Fatal("Could not flush: ", err)
+	}
+	var rows int
+	db.QueryRow(`SELECT COUNT(1) FROM numbers`).Scan(&rows)
+	if rows != 1 {
+		t.Error("Expected pi to be flushed. Found rows:", rows)
+	}
+	if stats := cache.Stats(); stats.Stores != 1 {
+		t.Error("Expected 1 store. Got:", stats.Stores)
+	}
+}
+
+func TestSQLiteCacheStatsDoNotFlush(t *testing.T) {
+	db := openCacheDB(t, filepath.Join(t.TempDir(), "cache.db"))
+	defer db.Close()
+	cache, err := newSQLiteCache[int, int](db, "numbers", SQLiteCacheConfig{FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	cache.Store(1, 1)
+	cache.Store(2, 4)
+	if err := cache.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	cache.Store(2, 8)
+	cache.Store(3, 9)
+	cache.Delete(1)
+
+	if stats := cache.Stats(); stats.Size != 2 {
+		t.Error("Expected a size of 2. Got:", stats.Size)
+	}
+	var rows int
+	db.QueryRow(`SELECT COUNT(1) FROM numbers WHERE "key" = '1'`).Scan(&rows)
+	if rows != 1 {
+		t.Error("Expected Stats to leave the pending writes alone. Found rows for 1:", rows)
+	}
+}
+
+func TestSQLiteCacheExpirySweeper(t *testing.T) {
+	db := openCacheDB(t, filepath.Join(t.TempDir(), "cache.db"))
+	defer db.Close()
+	var expired []string
+	cache, err := newSQLiteCache(db, "sessions", SQLiteCacheConfig{SweepInterval: time.Hour},
+		WithEvictionCallback(func(key string, value int, reason EvictionReason) {
+			if reason == EvictedExpired {
+				expired = append(expired, key)
+			}
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	cache.StoreWithTTL("short", 1, time.Minute)
+	cache.StoreWithTTL("long", 2, time.Hour)
+	cache.Store("forever", 3)
+	if err := cache.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	now = now.Add(time.Minute * 2)
+	if _, ok := cache.Lookup("short"); ok {
+		t.Error("Expected short to have expired.")
+	}
+	swept, err := cache.sweep()
+	if err != nil {
+		t.Fatal("Could not sweep: ", err)
+	}
+	if swept != 1 || len(expired) != 1 || expired[0] != "short" {
+		t.Error("Expected the sweeper to remove short only. Got:", expired)
+	}
+	if cache.Len() != 2 {
+		t.Error("Expected 2 rows after sweeping. Got:", cache.Len())
+	}
+	if stats := cache.Stats(); stats.Evictions != 1 {
+		t.Error("Expected 1 eviction. Got:", stats.Evictions)
+	}
+}
@@ -0,0 +1,160 @@
+package learning
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync/atomic"
+	"testing"
+)
+
+// CacheStats is a point-in-time snapshot of a cache's counters. Evictions
+// counts entries dropped for capacity or expiry; explicit deletes are not
+// evictions.
+type CacheStats struct {
+	Hits      uint64  `json:"hits"`
+	Misses    uint64  `json:"misses"`
+	Stores    uint64  `json:"stores"`
+	Evictions uint64  `json:"evictions"`
+	Size      int     `json:"size"`
+	HitRatio  float64 `json:"hit_ratio"`
+}
+
+// CacheStatsReporter is implemented by every Cache, whatever its key and
+// value types, so that caches can be reported on side by side.
+type CacheStatsReporter interface {
+	Stats() CacheStats
+}
+
+type cacheCounters struct {
+	hits      atomic.Uint64
+	misses    atomic.Uint64
+	stores    atomic.Uint64
+	evictions atomic.Uint64
+}
+
+func (c *cacheCounters) lookup(hit bool) {
+	if hit {
+		c.hits.Add(1)
+	} else {
+		c.misses.Add(1)
+	}
+}
+
+func (c *cacheCounters) evicted(reason EvictionReason) {
+	if reason != EvictedDeleted {
+		c.evictions.Add(1)
+	}
+}
+
+func (c *cacheCounters) snapshot(size int) CacheStats {
+	result := CacheStats{
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Stores:    c.stores.Load(),
+		Evictions: c.evictions.Load(),
+		Size:      size,
+	}
+	if lookups := result.Hits + result.Misses; lookups > 0 {
+		result.HitRatio = float64(result.Hits) / float64(lookups)
+	}
+	return result
+}
+
+// ExpvarCacheStats adapts a cache for expvar so that its stats show up on
+// /debug/vars, e.g. expvar.Publish("users_cache", ExpvarCacheStats(c)).
+func ExpvarCacheStats(c CacheStatsReporter) expvar.Func {
+	return func() interface{} {
+		return c.Stats()
+	}
+}
+
+// CacheStatsHandler serves the stats of the named caches as one JSON object,
+// in the same shape as expvar's /debug/vars, for services that don't want to
+// expose the rest of expvar.
+func CacheStatsHandler(caches map[string]CacheStatsReporter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		result := make(map[string]CacheStats, len(caches))
+		for name, c := range caches {
+			result[name] = c.Stats()
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(result)
+	})
+}
+
+func TestCacheStats(t *testing.T) {
+	backends := map[string]Cache[int, int]{
+		"syncmap": newCache[int, int](),
+		"sharded": newCache(WithShards[int, int](4)),
+	}
+	for name, cache := range backends {
+		cache.Store(1, 1)
+		cache.Store(2, 2)
+		cache.Retrieve(1)
+		cache.Retrieve(1)
+		cache.Retrieve(3)
+		cache.Delete(2)
+
+		stats := cache.Stats()
+		expected := CacheStats{Hits: 2, Misses: 1, Stores: 2, Size: 1, HitRatio: 2.0 / 3}
+		if stats != expected {
+			t.Errorf("%s: expected %+v. Got %+v.", name, expected, stats)
+		}
+	}
+}
+
+func TestCacheStatsCountsEvictions(t *testing.T) {
+	cache := newCache(WithMaxSize[int, int](2))
+	for i := 0; i < 5; i++ {
+		cache.Store(i, i)
+	}
+	stats := cache.Stats()
+	if stats.Evictions != 3 || stats.Size != 2 || stats.Stores != 5 {
+		t.Errorf("Expected 3 evictions, size 2 and 5 stores. Got %+v.", stats)
+	}
+}
+
+func TestCacheStatsHandler(t *testing.T) {
+	users := newCache[string, int]()
+	users.Store("arun", 1)
+	users.Retrieve("arun")
+	sessions := newCache(WithShards[int, string](4))
+	sessions.Retrieve(42)
+
+	srv := httptest.NewServer(CacheStatsHandler(map[string]CacheStatsReporter{
+		"users":    users,
+		"sessions": sessions,
+	}))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	result := map[string]CacheStats{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal("Could not decode stats: ", err)
+	}
+	names := []string{}
+	for name := range result {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if len(names) != 2 || names[0] != "sessions" || names[1] != "users" {
+		t.Fatal("Expected stats for sessions and users. Got:", names)
+	}
+	if result["users"].Hits != 1 || result["users"].Size != 1 {
+		t.Errorf("Unexpected users stats: %+v", result["users"])
+	}
+	if result["sessions"].Misses != 1 {
+		t.Errorf("Unexpected sessions stats: %+v", result["sessions"])
+	}
+
+	if v := ExpvarCacheStats(users).String(); v == "" || v[0] != '{' {
+		t.Error("Expected expvar to render stats as a JSON object. Got:", v)
+	}
+}
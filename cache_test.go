@@ -0,0 +1,446 @@
+package learning
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Cache is a thread-safe key/value store. Retrieve returns the zero value for
+// a missing key; use Lookup when a stored zero has to be told apart from a miss.
+type Cache[K comparable, V any] interface {
+	Store(key K, value V)
+	StoreWithTTL(key K, value V, ttl time.Duration)
+	Retrieve(key K) V
+	Lookup(key K) (V, bool)
+	Delete(key K)
+	Len() int
+	Stats() CacheStats
+}
+
+// EvictionReason tells an eviction callback why an entry left the cache.
+type EvictionReason int
+
+const (
+	EvictedCapacity EvictionReason = iota
+	EvictedExpired
+	EvictedDeleted
+)
+
+func (r EvictionReason) String() string {
+	switch r {
+	case EvictedCapacity:
+		return "capacity"
+	case EvictedExpired:
+		return "expired"
+	case EvictedDeleted:
+		return "deleted"
+	}
+	return "unknown"
+}
+
+type cacheConfig[K comparable, V any] struct {
+	maxSize int
+	shards  int
+	ttl     time.Duration
+	onEvict func(key K, value V, reason EvictionReason)
+}
+
+// CacheOption configures a cache built by newCache.
+type CacheOption[K comparable, V any] func(*cacheConfig[K, V])
+
+// WithMaxSize bounds the cache to n entries, evicting the least recently used
+// entry once the bound is exceeded. n <= 0 means unbounded.
+func WithMaxSize[K comparable, V any](n int) CacheOption[K, V] {
+	return func(cfg *cacheConfig[K, V]) {
+		cfg.maxSize = n
+	}
+}
+
+// WithTTL sets the expiry applied by Store. StoreWithTTL overrides it per entry.
+func WithTTL[K comparable, V any](ttl time.Duration) CacheOption[K, V] {
+	return func(cfg *cacheConfig[K, V]) {
+		cfg.ttl = ttl
+	}
+}
+
+// WithEvictionCallback registers fn to be called whenever an entry is evicted,
+// expires or is deleted. fn is never called with the cache lock held.
+func WithEvictionCallback[K comparable, V any](fn func(key K, value V, reason EvictionReason)) CacheOption[K, V] {
+	return func(cfg *cacheConfig[K, V]) {
+		cfg.onEvict = fn
+	}
+}
+
+/*
+Below implementation of cache does not work because map is not thread-safe.
+	type cache struct {
+		store map[int]int
+	}
+
+	func (c *cache) Store(key int, value int) {
+		c.store[key] = value
+	}
+
+	func (c *cache) Retrieve(key int) int {
+		return c.store[key]
+	}
+*/
+
+type cacheEntry[K comparable, V any] struct {
+	key       K
+	value     V
+	expiresAt time.Time     // zero means the entry never expires
+	element   *list.Element // position in the LRU list; bounded caches only
+}
+
+// cache keeps its entries in a sync.Map so that reads of an unbounded cache
+// stay lock-free. A bounded cache additionally tracks recency in lru, and then
+// every operation goes through mu so the map and the list agree.
+// Expired entries are dropped lazily when they are looked up, pushed out by
+// capacity or swept by PurgeExpired.
+type cache[K comparable, V any] struct {
+	store sync.Map // K -> *cacheEntry[K, V]
+	size  int64    // number of entries in store; unbounded caches only
+	cfg   cacheConfig[K, V]
+	now   func() time.Time
+	stats cacheCounters
+
+	mu  sync.Mutex
+	lru *list.List
+}
+
+func (c *cache[K, V]) Store(key K, value V) {
+	c.StoreWithTTL(key, value, c.cfg.ttl)
+}
+
+func (c *cache[K, V]) StoreWithTTL(key K, value V, ttl time.Duration) {
+	c.stats.stores.Add(1)
+	e := &cacheEntry[K, V]{key: key, value: value}
+	if ttl > 0 {
+		e.expiresAt = c.now().Add(ttl)
+	}
+	if c.lru == nil {
+		if _, loaded := c.store.Swap(key, e); !loaded {
+			atomic.AddInt64(&c.size, 1)
+		}
+		return
+	}
+
+	c.mu.Lock()
+	if old, ok := c.store.Load(key); ok {
+		c.lru.Remove(old.(*cacheEntry[K, V]).element)
+	}
+	e.element = c.lru.PushFront(e)
+	c.store.Store(key, e)
+	var evicted []*cacheEntry[K, V]
+	for c.lru.Len() > c.cfg.maxSize {
+		oldest := c.lru.Back().Value.(*cacheEntry[K, V])
+		c.removeLocked(oldest)
+		evicted = append(evicted, oldest)
+	}
+	c.mu.Unlock()
+
+	for _, e := range evicted {
+		c.evicted(e, EvictedCapacity)
+	}
+}
+
+func (c *cache[K, V]) Retrieve(key K) V {
+	v, _ := c.Lookup(key)
+	return v
+}
+
+func (c *cache[K, V]) Lookup(key K) (V, bool) {
+	v, ok := c.lookup(key)
+	c.stats.lookup(ok)
+	return v, ok
+}
+
+func (c *cache[K, V]) lookup(key K) (V, bool) {
+	var zero V
+	if c.lru == nil {
+		v, ok := c.store.Load(key)
+		if !ok {
+			return zero, false
+		}
+		e := v.(*cacheEntry[K, V])
+		if c.expired(e) {
+			if c.remove(e) {
+				c.evicted(e, EvictedExpired)
+			}
+			return zero, false
+		}
+		return e.value, true
+	}
+
+	c.mu.Lock()
+	v, ok := c.store.Load(key)
+	if !ok {
+		c.mu.Unlock()
+		return zero, false
+	}
+	e := v.(*cacheEntry[K, V])
+	if c.expired(e) {
+		c.removeLocked(e)
+		c.mu.Unlock()
+		c.evicted(e, EvictedExpired)
+		return zero, false
+	}
+	c.lru.MoveToFront(e.element)
+	c.mu.Unlock()
+	return e.value, true
+}
+
+func (c *cache[K, V]) Delete(key K) {
+	v, ok := c.store.Load(key)
+	if !ok {
+		return
+	}
+	e := v.(*cacheEntry[K, V])
+	if c.remove(e) {
+		c.evicted(e, EvictedDeleted)
+	}
+}
+
+// Len reports the number of entries held, including expired entries that have
+// not been dropped yet.
+func (c *cache[K, V]) Len() int {
+	if c.lru == nil {
+		return int(atomic.LoadInt64(&c.size))
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// PurgeExpired drops every expired entry and returns how many were dropped.
+func (c *cache[K, V]) PurgeExpired() int {
+	purged := 0
+	c.store.Range(func(_, v interface{}) bool {
+		e := v.(*cacheEntry[K, V])
+		if c.expired(e) && c.remove(e) {
+			c.evicted(e, EvictedExpired)
+			purged++
+		}
+		return true
+	})
+	return purged
+}
+
+func (c *cache[K, V]) expired(e *cacheEntry[K, V]) bool {
+	return !e.expiresAt.IsZero() && !c.now().Before(e.expiresAt)
+}
+
+// remove drops e if it is still the current entry for its key. It returns
+// false when another goroutine replaced or removed it first.
+func (c *cache[K, V]) remove(e *cacheEntry[K, V]) bool {
+	if c.lru == nil {
+		if !c.store.CompareAndDelete(e.key, e) {
+			return false
+		}
+		atomic.AddInt64(&c.size, -1)
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.removeLocked(e)
+}
+
+func (c *cache[K, V]) removeLocked(e *cacheEntry[K, V]) bool {
+	if !c.store.CompareAndDelete(e.key, e) {
+		return false
+	}
+	c.lru.Remove(e.element)
+	return true
+}
+
+func (c *cache[K, V]) Stats() CacheStats {
+	return c.stats.snapshot(c.Len())
+}
+
+func (c *cache[K, V]) evicted(e *cacheEntry[K, V], reason EvictionReason) {
+	c.stats.evicted(reason)
+	if c.cfg.onEvict != nil {
+		c.cfg.onEvict(e.key, e.value, reason)
+	}
+}
+
+func newCache[K comparable, V any](opts ...CacheOption[K, V]) Cache[K, V] {
+	var cfg cacheConfig[K, V]
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.shards > 0 {
+		if cfg.maxSize > 0 {
+			panic("cache: WithShards cannot be combined with WithMaxSize")
+		}
+		return newShardedCache(cfg)
+	}
+	result := &cache[K, V]{cfg: cfg, now: time.Now}
+	if cfg.maxSize > 0 {
+		result.lru = list.New()
+	}
+	return result
+}
+
+func createCache() Cache[int, int] {
+	return newCache[int, int]()
+}
+
+func TestThreadSafeMapCache(t *testing.T) {
+	var cache Cache[int, int]
+	cache = createCache()
+	// Now store 10 values in parallel
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(v int) {
+			cache.Store(v, v)
+			wg.Done()
+		}(i)
+	}
+	wg.Wait()
+	// Now retreive the values in parallel and ensure we're good
+	wg = sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(v int) {
+			newV := cache.Retrieve(v)
+			if v != newV {
+				t.Errorf("Expected to get: %d. Got %d instead.", v, newV)
+			}
+			wg.Done()
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestCacheLookupTellsZeroFromMissing(t *testing.T) {
+	cache := newCache[string, int]()
+	cache.Store("zero", 0)
+	if v, ok := cache.Lookup("zero"); !ok || v != 0 {
+		t.Errorf("Expected stored zero to be found. Got %d, %v.", v, ok)
+	}
+	if _, ok := cache.Lookup("missing"); ok {
+		t.Error("Expected missing key to not be found.")
+	}
+	cache.Delete("zero")
+	if _, ok := cache.Lookup("zero"); ok {
+		t.Error("Expected deleted key to not be found.")
+	}
+	if cache.Len() != 0 {
+		t.Error("Expected empty cache after delete. Got:", cache.Len())
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	var evictions []EvictionReason
+	c := newCache(
+		WithTTL[string, int](time.Minute),
+		WithEvictionCallback(func(key string, value int, reason EvictionReason) {
+			evictions = append(evictions, reason)
+		}),
+	).(*cache[string, int])
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	c.Store("a", 1)
+	c.StoreWithTTL("b", 2, time.Hour)
+	c.StoreWithTTL("c", 3, 0)
+	now = now.Add(2 * time.Minute)
+
+	if _, ok := c.Lookup("a"); ok {
+		t.Error("Expected a to have expired with the default TTL.")
+	}
+	if v, ok := c.Lookup("b"); !ok || v != 2 {
+		t.Error("Expected b to outlive the default TTL.")
+	}
+	now = now.Add(2 * time.Hour)
+	if purged := c.PurgeExpired(); purged != 1 {
+		t.Error("Expected PurgeExpired to drop b. Dropped:", purged)
+	}
+	if v, ok := c.Lookup("c"); !ok || v != 3 {
+		t.Error("Expected c to never expire.")
+	}
+	if c.Len() != 1 {
+		t.Error("Expected only c to remain. Len:", c.Len())
+	}
+	if len(evictions) != 2 || evictions[0] != EvictedExpired || evictions[1] != EvictedExpired {
+		t.Error("Expected two expiry callbacks. Got:", evictions)
+	}
+}
+
+func TestCacheLRUEviction(t *testing.T) {
+	evicted := map[int]EvictionReason{}
+	cache := newCache(
+		WithMaxSize[int, int](3),
+		WithEvictionCallback(func(key int, value int, reason EvictionReason) {
+			evicted[key] = reason
+		}),
+	)
+	for i := 1; i <= 3; i++ {
+		cache.Store(i, i)
+	}
+	// Touch 1 so that 2 becomes the least recently used
+	cache.Retrieve(1)
+	cache.Store(4, 4)
+
+	if _, ok := cache.Lookup(2); ok {
+		t.Error("Expected 2 to have been evicted.")
+	}
+	for _, k := range []int{1, 3, 4} {
+		if _, ok := cache.Lookup(k); !ok {
+			t.Errorf("Expected %d to still be cached.", k)
+		}
+	}
+	if cache.Len() != 3 {
+		t.Error("Expected cache to be held at 3 entries. Got:", cache.Len())
+	}
+	if len(evicted) != 1 || evicted[2] != EvictedCapacity {
+		t.Error("Expected a single capacity eviction of 2. Got:", evicted)
+	}
+}
+
+func TestBoundedCacheUnderConcurrency(t *testing.T) {
+	var evictions int64
+	cache := newCache(
+		WithMaxSize[int, int](50),
+		WithEvictionCallback(func(key int, value int, reason EvictionReason) {
+			atomic.AddInt64(&evictions, 1)
+		}),
+	)
+	wg := sync.WaitGroup{}
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				k := g*1000 + i
+				cache.Store(k, k)
+				if v, ok := cache.Lookup(k); ok && v != k {
+					t.Errorf("Expected %d. Got %d.", k, v)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	if cache.Len() != 50 {
+		t.Error("Expected cache to be full at 50 entries. Got:", cache.Len())
+	}
+	if atomic.LoadInt64(&evictions) != 8000-50 {
+		t.Error("Expected every overflowing store to evict. Got:", evictions)
+	}
+}
+
+func BenchmarkThreadSafeMapCache(b *testing.B) {
+	cache := createCache()
+	for n := 0; n < b.N; n++ {
+		cache.Store(5, 5)
+	}
+	for n := 0; n < b.N; n++ {
+		cache.Retrieve(5)
+	}
+}
@@ -0,0 +1,214 @@
+package learning
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// ChunkedStreamConfig tunes a ChunkedStream. Zero values fall back to a chunk
+// size of 1000, 16 buffered chunks and a pool of the stream's own.
+type ChunkedStreamConfig[T any] struct {
+	ChunkSize   int
+	MaxBuffered int // chunks the producer may get ahead by before it blocks
+	Pool        *BufferPool[T]
+}
+
+// ChunkedStream is the producer/consumer pattern of testSyncPool made
+// reusable: a producer goroutine emits values one at a time, and the consumer
+// reads them back a chunk at a time with Next, much like io.Reader. Chunks come
+// from a BufferPool and are recycled, so streaming a large result costs a few
+// chunks of memory rather than the whole result.
+type ChunkedStream[T any] struct {
+	chunks  chan []T
+	pool    *BufferPool[T]
+	ctx     context.Context
+	cancel  context.CancelFunc
+	err     error // set by the producer before it closes chunks
+	current []T
+}
+
+// NewChunkedStream starts produce in its own goroutine. produce should stop
+// as soon as emit returns an error, which happens when the stream is closed
+// or ctx ends.
+func NewChunkedStream[T any](ctx context.Context, cfg ChunkedStreamConfig[T], produce func(ctx context.Context, emit func(T) error) error) *ChunkedStream[T] {
+	if cfg.ChunkSize <= 0 {
+		cfg.ChunkSize = 1000
+	}
+	if cfg.MaxBuffered <= 0 {
+		cfg.MaxBuffered = 16
+	}
+	if cfg.Pool == nil {
+		cfg.Pool = NewBufferPool[T](false)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	s := &ChunkedStream[T]{
+		chunks: make(chan []T, cfg.MaxBuffered),
+		pool:   cfg.Pool,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	go s.run(cfg.ChunkSize, produce)
+	return s
+}
+
+func (s *ChunkedStream[T]) run(size int, produce func(ctx context.Context, emit func(T) error) error) {
+	var buffer []T
+	send := func() error {
+		select {
+		case s.chunks <- buffer:
+			buffer = nil
+			return nil
+		case <-s.ctx.Done():
+			return s.ctx.Err()
+		}
+	}
+	err := produce(s.ctx, func(v T) error {
+		if buffer == nil {
+			buffer = s.pool.Get(size)[:0]
+		}
+		buffer = append(buffer, v)
+		if len(buffer) == size {
+			return send()
+		}
+		return nil
+	})
+	if err == nil && len(buffer) > 0 {
+		err = send()
+	}
+	if buffer != nil {
+		s.pool.Put(buffer)
+	}
+	s.err = err
+	close(s.chunks)
+}
+
+// Next returns the next chunk of values. The chunk is only valid until the
+// following call to Next or Close, when its buffer goes back to the pool.
+// At the end of the stream Next returns io.EOF, or the producer's error if it
+// failed, or the context's error if the stream was cancelled or closed.
+func (s *ChunkedStream[T]) Next() ([]T, error) {
+	s.recycle()
+	if err := s.ctx.Err(); err != nil {
+		return nil, err
+	}
+	chunk, ok := <-s.chunks
+	if ok {
+		s.current = chunk
+		return chunk, nil
+	}
+	if s.err != nil {
+		return nil, s.err
+	}
+	return nil, io.EOF
+}
+
+// Close stops the producer and releases every buffered chunk.
+func (s *ChunkedStream[T]) Close() {
+	s.cancel()
+	s.recycle()
+	for chunk := range s.chunks {
+		s.pool.Put(chunk)
+	}
+}
+
+func (s *ChunkedStream[T]) recycle() {
+	if s.current != nil {
+		s.pool.Put(s.current)
+		s.current = nil
+	}
+}
+
+func countingProducer(n int, emitted *int64) func(ctx context.Context, emit func(int) error) error {
+	return func(ctx context.Context, emit func(int) error) error {
+		for i := 0; i < n; i++ {
+			if err := emit(i); err != nil {
+				return err
+			}
+			if emitted != nil {
+				atomic.AddInt64(emitted, 1)
+			}
+		}
+		return nil
+	}
+}
+
+func TestChunkedStream(t *testing.T) {
+	checkGoroutineLeaks(t)
+	pool := NewBufferPool[int](true)
+	stream := NewChunkedStream(context.Background(), ChunkedStreamConfig[int]{ChunkSize: 100, Pool: pool}, countingProducer(1050, nil))
+	expected := 0
+	chunks := 0
+	for {
+		chunk, err := stream.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, v := range chunk {
+			if v != expected {
+				t.Fatalf("Expected %d got %d", expected, v)
+			}
+			expected++
+		}
+		chunks++
+	}
+	if expected != 1050 || chunks != 11 {
+		t.Errorf("Expected 1050 values in 11 chunks. Got %d in %d.", expected, chunks)
+	}
+	if leaks := pool.Leaks(); len(leaks) != 0 {
+		t.Error("Expected every chunk to be back in the pool. Outstanding:", len(leaks))
+	}
+}
+
+func TestChunkedStreamBackpressure(t *testing.T) {
+	checkGoroutineLeaks(t)
+	var emitted int64
+	stream := NewChunkedStream(context.Background(), ChunkedStreamConfig[int]{ChunkSize: 10, MaxBuffered: 2}, countingProducer(1000000, &emitted))
+	defer stream.Close()
+
+	stream.Next()
+	time.Sleep(time.Millisecond * 20)
+	// One chunk handed out, two buffered and one being filled by the blocked producer
+	if n := atomic.LoadInt64(&emitted); n > 40 {
+		t.Error("Expected the producer to be held back by the consumer. Emitted:", n)
+	}
+}
+
+func TestChunkedStreamCancellation(t *testing.T) {
+	checkGoroutineLeaks(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	stream := NewChunkedStream(ctx, ChunkedStreamConfig[int]{ChunkSize: 10}, countingProducer(1000000, nil))
+	defer stream.Close()
+	if _, err := stream.Next(); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if _, err := stream.Next(); err != context.Canceled {
+		t.Error("Expected the stream to end with the context. Got:", err)
+	}
+}
+
+func TestChunkedStreamProducerError(t *testing.T) {
+	errQuery := errors.New("query failed")
+	stream := NewChunkedStream(context.Background(), ChunkedStreamConfig[string]{ChunkSize: 2}, func(ctx context.Context, emit func(string) error) error {
+		for _, v := range []string{"a", "b", "c"} {
+			if err := emit(v); err != nil {
+				return err
+			}
+		}
+		return errQuery
+	})
+	defer stream.Close()
+	if chunk, err := stream.Next(); err != nil || len(chunk) != 2 {
+		t.Fatal("Expected the full chunk before the error. Got:", chunk, err)
+	}
+	if _, err := stream.Next(); err != errQuery {
+		t.Error("Expected the producer error. Got:", err)
+	}
+}
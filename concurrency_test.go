@@ -1,7 +1,6 @@
 package learning
 
 import (
-	"context"
 	"sync"
 	"testing"
 	"time"
@@ -37,86 +36,6 @@ func TestRunningConcurrentJobsAndWaitingForThemToComplete(t *testing.T) {
 	wg.Wait()
 }
 
-type Cache interface {
-	Store(key int, value int)
-	Retrieve(key int) int
-}
-
-func TestThreadSafeMapCache(t *testing.T) {
-	var cache Cache
-	cache = createCache()
-	// Now store 10 values in parallel
-	wg := sync.WaitGroup{}
-	for i := 0; i < 10; i++ {
-		wg.Add(1)
-		go func(v int) {
-			cache.Store(v, v)
-			wg.Done()
-		}(i)
-	}
-	wg.Wait()
-	// Now retreive the values in parallel and ensure we're good
-	wg = sync.WaitGroup{}
-	for i := 0; i < 10; i++ {
-		wg.Add(1)
-		go func(v int) {
-			newV := cache.Retrieve(v)
-			if v != newV {
-				t.Errorf("Expected to get: %d. Got %d instead.", v, newV)
-			}
-			wg.Done()
-		}(i)
-	}
-	wg.Wait()
-}
-
-/*
-Below implementation of cache does not work because map is not thread-safe.
-	type cache struct {
-		store map[int]int
-	}
-
-	func (c *cache) Store(key int, value int) {
-		c.store[key] = value
-	}
-
-	func (c *cache) Retrieve(key int) int {
-		return c.store[key]
-	}
-*/
-
-type cache struct {
-	store sync.Map
-}
-
-func (c *cache) Store(key int, value int) {
-	c.store.Store(key, value)
-}
-
-func (c *cache) Retrieve(key int) int {
-	v, ok := c.store.Load(key)
-	if !ok {
-		return 0
-	}
-	return v.(int)
-}
-
-func createCache() Cache {
-	result := &cache{}
-	result.store = sync.Map{}
-	return result
-}
-
-func BenchmarkThreadSafeMapCache(b *testing.B) {
-	cache := createCache()
-	for n := 0; n < b.N; n++ {
-		cache.Store(5, 5)
-	}
-	for n := 0; n < b.N; n++ {
-		cache.Retrieve(5)
-	}
-}
-
 func TestPublishToMultipleListeners(t *testing.T) {
 	listenerCh1 := make(chan int)
 	listenerCh2 := make(chan int)
@@ -268,19 +187,25 @@ func TestCheckWhileReadingFromClosedChannel(t *testing.T) {
 }
 
 func TestChoosingBetweenChannelsToWrite(t *testing.T) {
+	checkGoroutineLeaks(t)
 	chA := make(chan int)
 	chB := make(chan int)
 	readIntoChannel := ""
+	done := make(chan struct{})
 	// Only open up Channel A for reading
 	go func() {
 		<-chA
 		readIntoChannel = "A"
+		close(done)
 	}()
 	// Write to A or B channel - whichever is open
 	select {
 	case chA <- 1:
 	case chB <- 1:
+	case <-time.After(time.Second):
+		t.Fatal("Neither channel was open for writing...")
 	}
+	<-done
 	if readIntoChannel != "A" {
 		t.Fatal("Expected channel A to have received a value...")
 	}
@@ -312,49 +237,3 @@ func TestCountElementsInChannel(t *testing.T) {
 		t.Error("Expected 1 element1 in channel but did not get.")
 	}
 }
-
-func TestContextCancellation(t *testing.T) {
-	ctx := context.WithValue(context.Background(), paymentContextKey("confirmed"), make(chan struct{}))
-	ctx, cancel := context.WithCancel(ctx)
-	go func() {
-		time.Sleep(time.Millisecond * 100)
-		cancel()
-	}()
-	status := ProcessPayment(ctx)
-	if status != "CANCELLED" {
-		t.Fatal("Expected a CANCELLED status.")
-	}
-}
-
-func TestContextConfirmation(t *testing.T) {
-	confirmationCh := make(chan struct{})
-	ctx := context.WithValue(context.Background(), paymentContextKey("confirmed"), confirmationCh)
-	go func() {
-		time.Sleep(time.Millisecond * 100)
-		confirmationCh <- struct{}{}
-	}()
-	status := ProcessPayment(ctx)
-	if status != "CONFIRMED" {
-		t.Fatal("Expected a CONFIRMED status.")
-	}
-}
-
-type paymentContextKey string
-
-// Refer http://blog.ralch.com/tutorial/golang-concurrency-patterns-context/
-func ProcessPayment(ctx context.Context) string {
-	confirmed := ctx.Value(paymentContextKey("confirmed")).(chan struct{})
-
-	for {
-		select {
-		case <-confirmed:
-			return "CONFIRMED"
-		case <-ctx.Done():
-			if ctx.Err() == context.Canceled {
-				return "CANCELLED"
-			}
-		default:
-			time.Sleep(time.Millisecond * 50)
-		}
-	}
-}
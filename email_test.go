@@ -4,8 +4,10 @@ import (
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"net"
 	"net/smtp"
 	"os"
+	"strconv"
 	"testing"
 
 	"github.com/bradfitz/go-smtpd/smtpd"
@@ -34,19 +36,35 @@ func (e *emailReceiver) Close() error {
 	return nil
 }
 
-func runSMTPServer(t *testing.T) {
+// runSMTPServer starts a server on a free local port and returns its address.
+// The server is shut down when the test ends.
+func runSMTPServer(t *testing.T) string {
 	srv := smtpd.Server{
 		OnNewMail: func(c smtpd.Connection, from smtpd.MailAddress) (smtpd.Envelope, error) {
 			return &emailReceiver{}, nil
 		},
 	}
-	srv.ListenAndServe()
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopped := make(chan struct{})
+	go func() {
+		srv.Serve(ln)
+		close(stopped)
+	}()
+	t.Cleanup(func() {
+		ln.Close()
+		<-stopped
+	})
+	return ln.Addr().String()
 }
 
 func TestSMTPClient(t *testing.T) {
-	go runSMTPServer(t)
+	checkGoroutineLeaks(t)
+	addr := runSMTPServer(t)
 
-	c, err := smtp.Dial("localhost:25")
+	c, err := smtp.Dial(addr)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -180,7 +198,11 @@ func TestSendingViaOutlookUsingGOMAIL(t *testing.T) {
 }
 
 func TestLocalGOMAIL(t *testing.T) {
-	go runSMTPServer(t)
+	checkGoroutineLeaks(t)
+	host, port, err := net.SplitHostPort(runSMTPServer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	m := gomail.NewMessage()
 	m.SetHeader("From", "arun.barua@e2open.com")
@@ -190,7 +212,8 @@ func TestLocalGOMAIL(t *testing.T) {
 
 	m.Attach("email_test.go", gomail.Rename("abc.txt"))
 
-	d := gomail.NewDialer("localhost", 25, "", "")
+	portNumber, _ := strconv.Atoi(port)
+	d := gomail.NewDialer(host, portNumber, "", "")
 
 	if err := d.DialAndSend(m); err != nil {
 		t.Fatal(err)
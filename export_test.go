@@ -0,0 +1,731 @@
+package learning
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+type ExportFormat string
+
+const (
+	ExportCSV       ExportFormat = "csv"
+	ExportJSONLines ExportFormat = "jsonl"
+	ExportColumnar  ExportFormat = "columnar"
+)
+
+// columnarGroupRows is how many rows ExportRows buffers per columnar row group.
+const columnarGroupRows = 4096
+
+// Kinds of value found in a column. They are the types database/sql drivers
+// return, plus null for columns that only held NULLs and mixed for columns
+// with values of more than one kind, which SQLite allows.
+const (
+	KindNull    = "null"
+	KindInt64   = "int64"
+	KindFloat64 = "float64"
+	KindBool    = "bool"
+	KindString  = "string"
+	KindBytes   = "bytes"
+	KindTime    = "time"
+	KindMixed   = "mixed"
+)
+
+// ExportColumn describes an exported column: what the database says about
+// it, and the kind of values that were actually in it.
+type ExportColumn struct {
+	Name         string `json:"name"`
+	DatabaseType string `json:"databaseType,omitempty"`
+	Nullable     *bool  `json:"nullable,omitempty"`
+	Kind         string `json:"kind"`
+	Encoding     string `json:"encoding,omitempty"` // how a text format wrote the values, e.g. base64
+}
+
+type ExportSummary struct {
+	Columns []ExportColumn `json:"columns"`
+	Rows    int            `json:"rows"`
+}
+
+type rowExporter interface {
+	WriteRow(cols []ExportColumn, vals []interface{}) error
+	Close(cols []ExportColumn) error
+}
+
+// ExportRows streams rows to w in format, one row at a time. The summary
+// carries the column metadata, which CSV and JSON Lines have no place for.
+// NULL is an empty field in CSV and null in the other formats. Both text
+// formats write every value of a bytes column as base64, which the summary
+// notes as the column's Encoding.
+func ExportRows(w io.Writer, rows *sql.Rows, format ExportFormat) (ExportSummary, error) {
+	defer rows.Close()
+	var exp rowExporter
+	switch format {
+	case ExportCSV:
+		exp = &csvExporter{w: csv.NewWriter(w)}
+	case ExportJSONLines:
+		exp = &jsonLinesExporter{w: bufio.NewWriter(w)}
+	case ExportColumnar:
+		exp = newColumnarWriter(w, columnarGroupRows)
+	default:
+		return ExportSummary{}, fmt.Errorf("unknown export format %q", format)
+	}
+	summary, err := exportRows(exp, rows)
+	if format != ExportColumnar {
+		for i, col := range summary.Columns {
+			if col.Kind == KindBytes {
+				summary.Columns[i].Encoding = "base64"
+			}
+		}
+	}
+	return summary, err
+}
+
+func exportRows(exp rowExporter, rows *sql.Rows) (ExportSummary, error) {
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		return ExportSummary{}, err
+	}
+	summary := ExportSummary{Columns: make([]ExportColumn, len(types))}
+	for i, ct := range types {
+		col := ExportColumn{Name: ct.Name(), DatabaseType: ct.DatabaseTypeName(), Kind: KindNull}
+		if nullable, ok := ct.Nullable(); ok {
+			col.Nullable = &nullable
+		}
+		summary.Columns[i] = col
+	}
+
+	vals := make([]interface{}, len(types))
+	dest := make([]interface{}, len(types))
+	for i := range vals {
+		dest[i] = &vals[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return summary, err
+		}
+		for i, v := range vals {
+			col := &summary.Columns[i]
+			switch kind := valueKind(v); {
+			case kind == KindNull || kind == col.Kind:
+			case col.Kind == KindNull:
+				col.Kind = kind
+			default:
+				col.Kind = KindMixed
+			}
+		}
+		if err := exp.WriteRow(summary.Columns, vals); err != nil {
+			return summary, err
+		}
+		summary.Rows++
+	}
+	if err := rows.Err(); err != nil {
+		return summary, err
+	}
+	return summary, exp.Close(summary.Columns)
+}
+
+func valueKind(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return KindNull
+	case int64:
+		return KindInt64
+	case float64:
+		return KindFloat64
+	case bool:
+		return KindBool
+	case string:
+		return KindString
+	case []byte:
+		return KindBytes
+	case time.Time:
+		return KindTime
+	}
+	return KindMixed
+}
+
+type csvExporter struct {
+	w      *csv.Writer
+	header bool
+	record []string
+}
+
+func (e *csvExporter) WriteRow(cols []ExportColumn, vals []interface{}) error {
+	if !e.header {
+		e.header = true
+		for _, col := range cols {
+			e.record = append(e.record, col.Name)
+		}
+		if err := e.w.Write(e.record); err != nil {
+			return err
+		}
+	}
+	for i, v := range vals {
+		if b, ok := v.([]byte); ok {
+			// Text or not, so that a bytes column decodes one way
+			e.record[i] = base64.StdEncoding.EncodeToString(b)
+			continue
+		}
+		e.record[i] = formatCSVValue(v)
+	}
+	return e.w.Write(e.record)
+}
+
+func (e *csvExporter) Close(cols []ExportColumn) error {
+	if !e.header {
+		e.header = true
+		names := make([]string, len(cols))
+		for i, col := range cols {
+			names[i] = col.Name
+		}
+		e.w.Write(names)
+	}
+	e.w.Flush()
+	return e.w.Error()
+}
+
+// formatCSVValue formats a single value as text, bytes that aren't valid
+// UTF-8 as base64. The CSV exporter base64s all bytes itself.
+func formatCSVValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	case string:
+		return v
+	case []byte:
+		if utf8.Valid(v) {
+			return string(v)
+		}
+		return base64.StdEncoding.EncodeToString(v)
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	}
+	return fmt.Sprint(v)
+}
+
+// jsonLinesExporter writes one object per row with keys in column order.
+type jsonLinesExporter struct {
+	w   *bufio.Writer
+	buf bytes.Buffer
+}
+
+func (e *jsonLinesExporter) WriteRow(cols []ExportColumn, vals []interface{}) error {
+	e.buf.Reset()
+	e.buf.WriteByte('{')
+	for i, v := range vals {
+		if i > 0 {
+			e.buf.WriteByte(',')
+		}
+		name, _ := json.Marshal(cols[i].Name)
+		value, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Errorf("column %q: %w", cols[i].Name, err)
+		}
+		e.buf.Write(name)
+		e.buf.WriteByte(':')
+		e.buf.Write(value)
+	}
+	e.buf.WriteString("}\n")
+	_, err := e.w.Write(e.buf.Bytes())
+	return err
+}
+
+func (e *jsonLinesExporter) Close([]ExportColumn) error {
+	return e.w.Flush()
+}
+
+// The columnar format stores rows in groups, and within a group every column
+// as one contiguous chunk, so a reader can load a single column without
+// decoding the others:
+//
+//	"SQLCOL1\n"
+//	row group: chunk for column 0, chunk for column 1, ...
+//	...
+//	footer: JSON columnarFooter
+//	uint32 footer length, "SQLCOL1\n"
+//
+// A chunk is a null bitmap, one bit per row, followed by the non-null values:
+// varints for int64 and time (as Unix nanoseconds), 8 bytes for float64, a
+// byte for bool and a length-prefixed run of bytes for string and bytes.
+const columnarMagic = "SQLCOL1\n"
+
+var ErrNotColumnar = errors.New("not a columnar export")
+
+type columnarFooter struct {
+	Columns   []ExportColumn     `json:"columns"`
+	RowGroups []columnarRowGroup `json:"rowGroups"`
+}
+
+type columnarRowGroup struct {
+	Rows   int             `json:"rows"`
+	Chunks []columnarChunk `json:"chunks"`
+}
+
+type columnarChunk struct {
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+}
+
+type columnarWriter struct {
+	w         io.Writer
+	offset    int64
+	groupSize int
+	values    [][]interface{}
+	rows      int
+	footer    columnarFooter
+	err       error
+}
+
+func newColumnarWriter(w io.Writer, groupSize int) *columnarWriter {
+	cw := &columnarWriter{w: w, groupSize: groupSize}
+	cw.write([]byte(columnarMagic))
+	return cw
+}
+
+func (cw *columnarWriter) write(b []byte) {
+	if cw.err != nil {
+		return
+	}
+	var n int
+	n, cw.err = cw.w.Write(b)
+	cw.offset += int64(n)
+}
+
+func (cw *columnarWriter) WriteRow(cols []ExportColumn, vals []interface{}) error {
+	if cw.values == nil {
+		cw.values = make([][]interface{}, len(cols))
+	}
+	for i, v := range vals {
+		if cols[i].Kind == KindMixed {
+			return fmt.Errorf("column %q mixes kinds of values, which the columnar format cannot store", cols[i].Name)
+		}
+		cw.values[i] = append(cw.values[i], v)
+	}
+	cw.rows++
+	if cw.rows == cw.groupSize {
+		cw.flush(cols)
+	}
+	return cw.err
+}
+
+// flush writes the buffered rows as a row group.
+func (cw *columnarWriter) flush(cols []ExportColumn) {
+	if cw.rows == 0 {
+		return
+	}
+	group := columnarRowGroup{Rows: cw.rows}
+	chunk := []byte{}
+	for i, values := range cw.values {
+		chunk = encodeColumnChunk(chunk[:0], cols[i].Kind, values)
+		group.Chunks = append(group.Chunks, columnarChunk{Offset: cw.offset, Length: int64(len(chunk))})
+		cw.write(chunk)
+		cw.values[i] = values[:0]
+	}
+	cw.footer.RowGroups = append(cw.footer.RowGroups, group)
+	cw.rows = 0
+}
+
+func (cw *columnarWriter) Close(cols []ExportColumn) error {
+	cw.flush(cols)
+	cw.footer.Columns = cols
+	footer, err := json.Marshal(cw.footer)
+	if err != nil {
+		return err
+	}
+	cw.write(footer)
+	cw.write(binary.LittleEndian.AppendUint32(nil, uint32(len(footer))))
+	cw.write([]byte(columnarMagic))
+	return cw.err
+}
+
+func encodeColumnChunk(b []byte, kind string, values []interface{}) []byte {
+	nulls := make([]byte, (len(values)+7)/8)
+	for i, v := range values {
+		if v == nil {
+			nulls[i/8] |= 1 << (i % 8)
+		}
+	}
+	b = append(b, nulls...)
+	for _, v := range values {
+		switch v := v.(type) {
+		case int64:
+			b = binary.AppendVarint(b, v)
+		case time.Time:
+			b = binary.AppendVarint(b, v.UnixNano())
+		case float64:
+			b = binary.LittleEndian.AppendUint64(b, math.Float64bits(v))
+		case bool:
+			if v {
+				b = append(b, 1)
+			} else {
+				b = append(b, 0)
+			}
+		case string:
+			b = binary.AppendUvarint(b, uint64(len(v)))
+			b = append(b, v...)
+		case []byte:
+			b = binary.AppendUvarint(b, uint64(len(v)))
+			b = append(b, v...)
+		}
+	}
+	return b
+}
+
+// ColumnarFile reads a columnar export.
+type ColumnarFile struct {
+	r      io.ReaderAt
+	footer columnarFooter
+}
+
+func OpenColumnar(r io.ReaderAt, size int64) (*ColumnarFile, error) {
+	tail := make([]byte, 4+len(columnarMagic))
+	if size < int64(len(columnarMagic)+len(tail)) {
+		return nil, ErrNotColumnar
+	}
+	if _, err := r.ReadAt(tail, size-int64(len(tail))); err != nil {
+		return nil, err
+	}
+	if string(tail[4:]) != columnarMagic {
+		return nil, ErrNotColumnar
+	}
+	// Checked before allocating, as a corrupt length could ask for 4 GiB
+	footerLen := int64(binary.LittleEndian.Uint32(tail))
+	dataEnd := size - int64(len(tail)) - footerLen
+	if dataEnd < int64(len(columnarMagic)) {
+		return nil, fmt.Errorf("%w: corrupt footer length", ErrNotColumnar)
+	}
+	footer := make([]byte, footerLen)
+	if _, err := r.ReadAt(footer, dataEnd); err != nil {
+		return nil, err
+	}
+	f := &ColumnarFile{r: r}
+	if err := json.Unmarshal(footer, &f.footer); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNotColumnar, err)
+	}
+	for _, g := range f.footer.RowGroups {
+		if g.Rows < 0 || len(g.Chunks) != len(f.footer.Columns) {
+			return nil, fmt.Errorf("%w: corrupt row group", ErrNotColumnar)
+		}
+		for _, c := range g.Chunks {
+			// Every chunk holds at least its null bitmap, within the data
+			if c.Length < 0 || c.Offset < int64(len(columnarMagic)) || c.Offset > dataEnd-c.Length || int64(g.Rows) > c.Length*8 {
+				return nil, fmt.Errorf("%w: corrupt row group", ErrNotColumnar)
+			}
+		}
+	}
+	return f, nil
+}
+
+func (f *ColumnarFile) Columns() []ExportColumn {
+	return f.footer.Columns
+}
+
+func (f *ColumnarFile) Rows() int {
+	rows := 0
+	for _, g := range f.footer.RowGroups {
+		rows += g.Rows
+	}
+	return rows
+}
+
+// Column reads every value of one column, NULLs as nil.
+func (f *ColumnarFile) Column(name string) ([]interface{}, error) {
+	index := -1
+	for i, col := range f.footer.Columns {
+		if col.Name == name {
+			index = i
+		}
+	}
+	if index < 0 {
+		return nil, fmt.Errorf("no column %q", name)
+	}
+	kind := f.footer.Columns[index].Kind
+	values := make([]interface{}, 0, f.Rows())
+	for _, g := range f.footer.RowGroups {
+		c := g.Chunks[index]
+		chunk := make([]byte, c.Length)
+		if _, err := f.r.ReadAt(chunk, c.Offset); err != nil {
+			return nil, err
+		}
+		var err error
+		if values, err = decodeColumnChunk(values, chunk, kind, g.Rows); err != nil {
+			return nil, fmt.Errorf("column %q: %w", name, err)
+		}
+	}
+	return values, nil
+}
+
+func decodeColumnChunk(values []interface{}, chunk []byte, kind string, rows int) ([]interface{}, error) {
+	corrupt := fmt.Errorf("%w: corrupt chunk", ErrNotColumnar)
+	if rows < 0 || len(chunk) < (rows+7)/8 {
+		return nil, corrupt
+	}
+	nulls, b := chunk[:(rows+7)/8], chunk[(rows+7)/8:]
+	for i := 0; i < rows; i++ {
+		if nulls[i/8]&(1<<(i%8)) != 0 {
+			values = append(values, nil)
+			continue
+		}
+		switch kind {
+		case KindInt64, KindTime:
+			v, n := binary.Varint(b)
+			if n <= 0 {
+				return nil, corrupt
+			}
+			b = b[n:]
+			if kind == KindTime {
+				values = append(values, time.Unix(0, v).UTC())
+			} else {
+				values = append(values, v)
+			}
+		case KindFloat64:
+			if len(b) < 8 {
+				return nil, corrupt
+			}
+			values = append(values, math.Float64frombits(binary.LittleEndian.Uint64(b)))
+			b = b[8:]
+		case KindBool:
+			if len(b) < 1 {
+				return nil, corrupt
+			}
+			values = append(values, b[0] == 1)
+			b = b[1:]
+		case KindString, KindBytes:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return nil, corrupt
+			}
+			v := b[n : n+int(l)]
+			b = b[n+int(l):]
+			if kind == KindString {
+				values = append(values, string(v))
+			} else {
+				values = append(values, append([]byte(nil), v...))
+			}
+		default:
+			return nil, corrupt
+		}
+	}
+	return values, nil
+}
+
+// TestExportCommand dumps a query to a file for offline analysis, e.g.
+//
+//	make export DRIVER=sqlite3 DSN=file:/tmp/test.db QUERY='select * from USERS' FORMAT=csv OUT=/tmp/users.csv
+//
+// and prints the column metadata.
+func TestExportCommand(t *testing.T) {
+	if os.Getenv("EXPORT_QUERY") == "" {
+		t.Skip("Set EXPORT_DRIVER, EXPORT_DSN, EXPORT_QUERY, EXPORT_FORMAT and EXPORT_OUT to export a query.")
+	}
+	db, err := sql.Open(os.Getenv("EXPORT_DRIVER"), os.Getenv("EXPORT_DSN"))
+	if err != nil {
+		t.Fatal("Could not open DB: ", err)
+	}
+	defer db.Close()
+	out, err := os.Create(os.Getenv("EXPORT_OUT"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	rows, err := db.Query(os.Getenv("EXPORT_QUERY"))
+	if err != nil {
+		t.Fatal("Error creating query: ", err)
+	}
+	summary, err := ExportRows(out, rows, ExportFormat(os.Getenv("EXPORT_FORMAT")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata, _ := json.MarshalIndent(summary, "", "  ")
+	fmt.Println(string(metadata))
+}
+
+func queryExportRows(t *testing.T, db *sql.DB) *sql.Rows {
+	rows, err := db.Query(`SELECT "id", "email", NULLIF("last_name", '') AS "last_name", "id" * 1.5 AS "score", x'00ff' AS "raw" FROM "USERS" ORDER BY "id"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
+
+func TestExportCSV(t *testing.T) {
+	out := bytes.Buffer{}
+	summary, err := ExportRows(&out, queryExportRows(t, openScannerDB(t)), ExportCSV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "id,email,last_name,score,raw\n" +
+		"1,arunsworld@gmail.com,Barua,1.5,AP8=\n" +
+		"2,arun@e2open.com,,3,AP8=\n"
+	if out.String() != expected {
+		t.Errorf("Expected:\n%s\nGot:\n%s", expected, out.String())
+	}
+	if summary.Rows != 2 || summary.Columns[0].Kind != KindInt64 || summary.Columns[1].DatabaseType != "varchar(75)" {
+		t.Errorf("Unexpected summary: %+v", summary)
+	}
+	if summary.Columns[4].Encoding != "base64" || summary.Columns[1].Encoding != "" {
+		t.Errorf("Expected only the bytes column to be base64. Got: %+v", summary.Columns)
+	}
+
+	// Bytes that happen to be text are base64 too
+	rows, err := openScannerDB(t).Query(`SELECT CAST('abc' AS BLOB) AS "raw"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if _, err := ExportRows(&out, rows, ExportCSV); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "raw\nYWJj\n" {
+		t.Errorf("Expected a base64 value. Got:\n%s", out.String())
+	}
+}
+
+func TestExportJSONLines(t *testing.T) {
+	out := bytes.Buffer{}
+	if _, err := ExportRows(&out, queryExportRows(t, openScannerDB(t)), ExportJSONLines); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	expected := `{"id":2,"email":"arun@e2open.com","last_name":null,"score":3,"raw":"AP8="}`
+	if len(lines) != 2 || lines[1] != expected {
+		t.Errorf("Expected the second line to be:\n%s\nGot:\n%s", expected, out.String())
+	}
+}
+
+func TestExportColumnar(t *testing.T) {
+	db := openUsersDB(t)
+	for i := 1; i <= 10; i++ {
+		var lastName interface{}
+		if i%3 != 0 {
+			lastName = fmt.Sprint("Name", i)
+		}
+		_, err := db.Exec(`INSERT INTO "USERS" ("email", "password", "first_name", "last_name", "is_active") VALUES ($1, '', 'Arun', COALESCE($2, ''), $3)`,
+			fmt.Sprintf("user%d@example.com", i), lastName, i%2 == 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	rows := queryExportRows(t, db)
+	out := bytes.Buffer{}
+	// Small row groups so the export spans several
+	summary, err := exportRows(newColumnarWriter(&out, 4), rows)
+	rows.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := OpenColumnar(bytes.NewReader(out.Bytes()), int64(out.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Rows() != 10 || len(f.footer.RowGroups) != 3 {
+		t.Errorf("Expected 10 rows in 3 row groups. Got %d in %d.", f.Rows(), len(f.footer.RowGroups))
+	}
+	if cols := f.Columns(); len(cols) != 5 || cols[3].Kind != KindFloat64 || cols[4].Kind != KindBytes || cols[2].Kind != summary.Columns[2].Kind {
+		t.Errorf("Unexpected columns: %+v", cols)
+	}
+	ids, _ := f.Column("id")
+	scores, _ := f.Column("score")
+	lastNames, err := f.Column("last_name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if ids[i] != int64(i+1) || scores[i] != float64(i+1)*1.5 {
+			t.Errorf("Row %d: unexpected id %v or score %v.", i, ids[i], scores[i])
+		}
+		if (i+1)%3 == 0 && lastNames[i] != nil || (i+1)%3 != 0 && lastNames[i] != fmt.Sprint("Name", i+1) {
+			t.Errorf("Row %d: unexpected last_name %#v.", i, lastNames[i])
+		}
+	}
+	if _, err := OpenColumnar(strings.NewReader("id,email\n"), 9); err != ErrNotColumnar {
+		t.Error("Expected ErrNotColumnar for a CSV file. Got:", err)
+	}
+}
+
+func TestOpenColumnarRejectsCorruptFiles(t *testing.T) {
+	out := bytes.Buffer{}
+	if _, err := ExportRows(&out, queryExportRows(t, openScannerDB(t)), ExportColumnar); err != nil {
+		t.Fatal(err)
+	}
+	f, err := OpenColumnar(bytes.NewReader(out.Bytes()), int64(out.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tail := 4 + len(columnarMagic)
+	footerLen := int(binary.LittleEndian.Uint32(out.Bytes()[out.Len()-tail:]))
+	data := out.Bytes()[:out.Len()-tail-footerLen]
+	withFooter := func(change func(footer *columnarFooter)) []byte {
+		footer := f.footer
+		footer.RowGroups = []columnarRowGroup{f.footer.RowGroups[0]}
+		footer.RowGroups[0].Chunks = append([]columnarChunk(nil), f.footer.RowGroups[0].Chunks...)
+		change(&footer)
+		b, _ := json.Marshal(footer)
+		file := append(append([]byte(nil), data...), b...)
+		file = binary.LittleEndian.AppendUint32(file, uint32(len(b)))
+		return append(file, columnarMagic...)
+	}
+	hugeFooter := append([]byte(nil), out.Bytes()...)
+	binary.LittleEndian.PutUint32(hugeFooter[len(hugeFooter)-tail:], math.MaxUint32)
+
+	for name, file := range map[string][]byte{
+		"footer length": hugeFooter,
+		"chunk count": withFooter(func(footer *columnarFooter) {
+			footer.RowGroups[0].Chunks = footer.RowGroups[0].Chunks[:1]
+		}),
+		"chunk past the end": withFooter(func(footer *columnarFooter) {
+			footer.RowGroups[0].Chunks[0].Offset = int64(len(data))
+		}),
+		"short null bitmap": withFooter(func(footer *columnarFooter) {
+			footer.RowGroups[0].Rows = 1000
+		}),
+	} {
+		if _, err := OpenColumnar(bytes.NewReader(file), int64(len(file))); !errors.Is(err, ErrNotColumnar) {
+			t.Errorf("Expected ErrNotColumnar for a corrupt %s. Got: %v", name, err)
+		}
+	}
+
+	// A chunk that is long enough for its bitmap but not its values
+	file := withFooter(func(footer *columnarFooter) {
+		footer.RowGroups[0].Chunks[1].Length = 1
+	})
+	corrupt, err := OpenColumnar(bytes.NewReader(file), int64(len(file)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := corrupt.Column("email"); !errors.Is(err, ErrNotColumnar) {
+		t.Error("Expected ErrNotColumnar for a truncated chunk. Got:", err)
+	}
+}
+
+func TestExportColumnarRejectsMixedKinds(t *testing.T) {
+	rows, err := openScannerDB(t).Query(`SELECT CASE WHEN "id" = 1 THEN 'one' ELSE "id" END AS "mixed" FROM "USERS" ORDER BY "id"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ExportRows(io.Discard, rows, ExportColumnar); err == nil || !strings.Contains(err.Error(), "mixes") {
+		t.Error("Expected mixed kinds to be rejected. Got:", err)
+	}
+}
@@ -1,7 +1,7 @@
 package learning
 
 import (
-	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/jinzhu/gorm"
@@ -10,31 +10,17 @@ import (
 )
 
 func TestGormQuickStart(t *testing.T) {
-	type User struct {
-		ID        uint   `gorm:"primary_key"`
-		Email     string `gorm:"unique;not null"`
-		Password  string
-		FirstName string
-		LastName  string
-		IsActive  bool
-	}
-
-	db, err := gorm.Open("sqlite3", "/tmp/test.db")
+	db, err := gorm.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
 	if err != nil {
-		t.Error("Could not open DB:", err)
+		t.Fatal("Could not open DB:", err)
 	}
 	defer db.Close()
 	db.LogMode(false)
 
-	defer func() {
-		err = os.Remove("/tmp/test.db")
-		if err != nil {
-			t.Error("Could not delete the database: ", err)
-			return
-		}
-	}()
-
-	db.AutoMigrate(&User{})
+	// The schema comes from the migrations rather than gorm's AutoMigrate
+	if err := migrateSchema(db.DB()); err != nil {
+		t.Fatal("Could not migrate the schema:", err)
+	}
 
 	// Test User Creation
 	u := User{Email: "arunsworld@gmail.com", FirstName: "Arun", IsActive: true}
@@ -0,0 +1,110 @@
+package learning
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// leakGracePeriod is how long checkGoroutineLeaks gives goroutines to wind
+// down once a test is over.
+var leakGracePeriod = time.Second
+
+// checkGoroutineLeaks fails t if goroutines started during the test are
+// still running once it is over, reporting their stacks. Call it first thing
+// in a test; it compares against a snapshot taken at that point, so it can't
+// be used with t.Parallel.
+func checkGoroutineLeaks(t testing.TB) {
+	t.Helper()
+	before := map[string]bool{}
+	for _, g := range goroutineStacks() {
+		before[goroutineID(g)] = true
+	}
+	t.Cleanup(func() {
+		deadline := time.Now().Add(leakGracePeriod)
+		for {
+			var leaked []string
+			for _, g := range goroutineStacks() {
+				if !before[goroutineID(g)] {
+					leaked = append(leaked, g)
+				}
+			}
+			if len(leaked) == 0 {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Errorf("%d goroutine(s) still running %s after the test:\n\n%s",
+					len(leaked), leakGracePeriod, strings.Join(leaked, "\n\n"))
+				return
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+	})
+}
+
+// goroutineStacks returns the stack trace of every goroutine, one per entry.
+func goroutineStacks() []string {
+	buf := make([]byte, 64*1024)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return strings.Split(strings.TrimSpace(string(buf[:n])), "\n\n")
+		}
+		buf = make([]byte, len(buf)*2)
+	}
+}
+
+// goroutineID extracts "17" from a stack starting "goroutine 17 [running]:".
+func goroutineID(stack string) string {
+	stack = strings.TrimPrefix(stack, "goroutine ")
+	if i := strings.IndexByte(stack, ' '); i >= 0 {
+		return stack[:i]
+	}
+	return stack
+}
+
+// leakRecorder stands in for a test so that the leak check itself can be tested.
+type leakRecorder struct {
+	testing.TB
+	cleanups []func()
+	errors   []string
+}
+
+func (r *leakRecorder) Helper() {}
+
+func (r *leakRecorder) Cleanup(f func()) {
+	r.cleanups = append(r.cleanups, f)
+}
+
+func (r *leakRecorder) Errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, format)
+}
+
+func TestCheckGoroutineLeaks(t *testing.T) {
+	defer func(grace time.Duration) { leakGracePeriod = grace }(leakGracePeriod)
+	leakGracePeriod = time.Millisecond * 50
+
+	stop := make(chan struct{})
+	leaky := &leakRecorder{TB: t}
+	checkGoroutineLeaks(leaky)
+	go func() {
+		<-stop
+	}()
+	leaky.cleanups[0]()
+	if len(leaky.errors) != 1 {
+		t.Error("Expected a blocked goroutine to be reported.")
+	}
+
+	// A goroutine that finishes within the grace period is fine
+	clean := &leakRecorder{TB: t}
+	checkGoroutineLeaks(clean)
+	close(stop)
+	go func() {
+		time.Sleep(time.Millisecond * 10)
+	}()
+	clean.cleanups[0]()
+	if len(clean.errors) != 0 {
+		t.Error("Expected no leak to be reported. Got:", clean.errors)
+	}
+}
@@ -0,0 +1,585 @@
+package learning
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"text/tabwriter"
+	"time"
+)
+
+//go:embed migrations/*.sql
+var embeddedMigrations embed.FS
+
+// Migration is one numbered schema change. Files are named
+// NNNN_description.up.sql and NNNN_description.down.sql.
+type Migration struct {
+	Version  int
+	Name     string
+	Up       string
+	Down     string
+	Checksum string // of Up, to spot scripts edited after they were applied
+}
+
+// MigrationStatus is a migration as known to the files and the database.
+// Drifted means the applied script no longer matches the file, Missing that an
+// applied version has no file at all.
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	Applied   bool
+	AppliedAt time.Time
+	Drifted   bool
+	Missing   bool
+}
+
+var ErrMigrationDrift = errors.New("applied migrations differ from the migration files")
+
+var migrationFile = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+
+// loadMigrations reads the migrations in the root of fsys, e.g. os.DirFS(dir).
+func loadMigrations(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := map[int]*Migration{}
+	for _, e := range entries {
+		m := migrationFile.FindStringSubmatch(e.Name())
+		if e.IsDir() || m == nil {
+			continue
+		}
+		version, _ := strconv.Atoi(m[1])
+		script, err := fs.ReadFile(fsys, e.Name())
+		if err != nil {
+			return nil, err
+		}
+		mig, ok := byVersion[version]
+		if !ok {
+			mig = &Migration{Version: version, Name: m[2]}
+			byVersion[version] = mig
+		} else if mig.Name != m[2] {
+			return nil, fmt.Errorf("migration %d has two names: %s and %s", version, mig.Name, m[2])
+		}
+		if m[3] == "up" {
+			mig.Up = string(script)
+		} else {
+			mig.Down = string(script)
+		}
+	}
+	result := make([]Migration, 0, len(byVersion))
+	for _, mig := range byVersion {
+		if mig.Up == "" {
+			return nil, fmt.Errorf("migration %04d_%s has no up script", mig.Version, mig.Name)
+		}
+		sum := sha256.Sum256([]byte(mig.Up))
+		mig.Checksum = hex.EncodeToString(sum[:])
+		result = append(result, *mig)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Version < result[j].Version })
+	return result, nil
+}
+
+// schemaMigrations returns the migrations embedded from the migrations directory.
+func schemaMigrations() ([]Migration, error) {
+	sub, err := fs.Sub(embeddedMigrations, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	return loadMigrations(sub)
+}
+
+// Migrator applies and rolls back migrations, recording each applied one in
+// the schema_migrations table. Every migration runs in its own transaction
+// together with its bookkeeping, so a failed script leaves no trace.
+type Migrator struct {
+	db         *sql.DB
+	migrations []Migration
+}
+
+func NewMigrator(db *sql.DB, migrations []Migration) (*Migrator, error) {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS "schema_migrations" (
+					"version" integer NOT NULL PRIMARY KEY,
+					"name" text NOT NULL,
+					"checksum" text NOT NULL,
+					"applied_at" integer NOT NULL)`)
+	if err != nil {
+		return nil, fmt.Errorf("could not create schema_migrations: %w", err)
+	}
+	return &Migrator{db: db, migrations: migrations}, nil
+}
+
+// Status lists every migration, known from the files or the database, in
+// version order.
+func (m *Migrator) Status() ([]MigrationStatus, error) {
+	rows, err := m.db.Query(`SELECT "version", "name", "checksum", "applied_at" FROM "schema_migrations"`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	type applied struct {
+		name, checksum string
+		at             int64
+	}
+	db := map[int]applied{}
+	for rows.Next() {
+		var (
+			version int
+			a       applied
+		)
+		if err := rows.Scan(&version, &a.name, &a.checksum, &a.at); err != nil {
+			return nil, err
+		}
+		db[version] = a
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	result := []MigrationStatus{}
+	for _, mig := range m.migrations {
+		s := MigrationStatus{Version: mig.Version, Name: mig.Name}
+		if a, ok := db[mig.Version]; ok {
+			s.Applied = true
+			s.AppliedAt = time.Unix(0, a.at)
+			s.Drifted = a.checksum != mig.Checksum
+			delete(db, mig.Version)
+		}
+		result = append(result, s)
+	}
+	for version, a := range db {
+		result = append(result, MigrationStatus{Version: version, Name: a.name, Applied: true, AppliedAt: time.Unix(0, a.at), Missing: true})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Version < result[j].Version })
+	return result, nil
+}
+
+// Version returns the highest applied version, 0 if none.
+func (m *Migrator) Version() (int, error) {
+	var version sql.NullInt64
+	err := m.db.QueryRow(`SELECT MAX("version") FROM "schema_migrations"`).Scan(&version)
+	return int(version.Int64), err
+}
+
+// Up applies every pending migration.
+func (m *Migrator) Up() error {
+	if len(m.migrations) == 0 {
+		return nil
+	}
+	return m.To(m.migrations[len(m.migrations)-1].Version)
+}
+
+// Down rolls back the latest applied migration.
+func (m *Migrator) Down() error {
+	statuses, err := m.Status()
+	if err != nil {
+		return err
+	}
+	applied := []int{0}
+	for _, s := range statuses {
+		if s.Applied {
+			applied = append(applied, s.Version)
+		}
+	}
+	if len(applied) == 1 {
+		return nil
+	}
+	return m.To(applied[len(applied)-2])
+}
+
+// To migrates up or down until version is the latest applied migration. It
+// refuses to run while applied migrations have drifted from their files.
+func (m *Migrator) To(version int) error {
+	statuses, err := m.Status()
+	if err != nil {
+		return err
+	}
+	var drifted []string
+	for _, s := range statuses {
+		if s.Drifted || s.Missing {
+			drifted = append(drifted, fmt.Sprintf("%04d_%s", s.Version, s.Name))
+		}
+	}
+	if len(drifted) > 0 {
+		return fmt.Errorf("%w: %s", ErrMigrationDrift, strings.Join(drifted, ", "))
+	}
+
+	applied := map[int]bool{}
+	for _, s := range statuses {
+		applied[s.Version] = s.Applied
+	}
+	for _, mig := range m.migrations {
+		if mig.Version <= version && !applied[mig.Version] {
+			if err := m.apply(mig); err != nil {
+				return err
+			}
+		}
+	}
+	for i := len(m.migrations) - 1; i >= 0; i-- {
+		mig := m.migrations[i]
+		if mig.Version > version && applied[mig.Version] {
+			if err := m.rollback(mig); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Baseline records the migrations up to version as applied without running
+// them, for a database whose schema was created before it had migrations. It
+// refuses once any migration has been applied.
+func (m *Migrator) Baseline(version int) error {
+	current, err := m.Version()
+	if err != nil {
+		return err
+	}
+	if current != 0 {
+		return fmt.Errorf("cannot baseline a database already at version %d", current)
+	}
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, mig := range m.migrations {
+		if mig.Version > version {
+			break
+		}
+		_, err = tx.Exec(`INSERT INTO "schema_migrations" ("version", "name", "checksum", "applied_at") VALUES ($1, $2, $3, $4)`,
+			mig.Version, mig.Name, mig.Checksum, time.Now().UnixNano())
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (m *Migrator) apply(mig Migration) error {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(mig.Up); err != nil {
+		return fmt.Errorf("migration %04d_%s up: %w", mig.Version, mig.Name, err)
+	}
+	_, err = tx.Exec(`INSERT INTO "schema_migrations" ("version", "name", "checksum", "applied_at") VALUES ($1, $2, $3, $4)`,
+		mig.Version, mig.Name, mig.Checksum, time.Now().UnixNano())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (m *Migrator) rollback(mig Migration) error {
+	if mig.Down == "" {
+		return fmt.Errorf("migration %04d_%s has no down script", mig.Version, mig.Name)
+	}
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(mig.Down); err != nil {
+		return fmt.Errorf("migration %04d_%s down: %w", mig.Version, mig.Name, err)
+	}
+	if _, err := tx.Exec(`DELETE FROM "schema_migrations" WHERE "version" = $1`, mig.Version); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// migrateSchema brings db up to date with the embedded migrations. A database
+// that has USERS but no migrations predates them: its USERS is taken to be
+// migration 1.
+func migrateSchema(db *sql.DB) error {
+	migrations, err := schemaMigrations()
+	if err != nil {
+		return err
+	}
+	m, err := NewMigrator(db, migrations)
+	if err != nil {
+		return err
+	}
+	version, err := m.Version()
+	if err != nil {
+		return err
+	}
+	if version == 0 {
+		var users int
+		err := db.QueryRow(`SELECT COUNT(1) FROM sqlite_master WHERE type = 'table' AND name = 'USERS'`).Scan(&users)
+		if err != nil {
+			return err
+		}
+		if users == 1 {
+			if err := m.Baseline(1); err != nil {
+				return err
+			}
+		}
+	}
+	return m.Up()
+}
+
+// runMigrateCommand implements `migrate status|up|down|to N|baseline N`.
+func runMigrateCommand(m *Migrator, args []string, w io.Writer) error {
+	if len(args) == 0 {
+		args = []string{"status"}
+	}
+	switch {
+	case args[0] == "up" && len(args) == 1:
+		if err := m.Up(); err != nil {
+			return err
+		}
+	case args[0] == "down" && len(args) == 1:
+		if err := m.Down(); err != nil {
+			return err
+		}
+	case args[0] == "to" && len(args) == 2:
+		version, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("invalid version %q", args[1])
+		}
+		if err := m.To(version); err != nil {
+			return err
+		}
+	case args[0] == "baseline" && len(args) == 2:
+		version, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("invalid version %q", args[1])
+		}
+		if err := m.Baseline(version); err != nil {
+			return err
+		}
+	case args[0] != "status" || len(args) != 1:
+		return fmt.Errorf("usage: migrate status|up|down|to N|baseline N")
+	}
+
+	statuses, err := m.Status()
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "VERSION\tNAME\tSTATUS\tAPPLIED AT")
+	for _, s := range statuses {
+		status, at := "pending", ""
+		if s.Applied {
+			status, at = "applied", s.AppliedAt.Format(time.RFC3339)
+		}
+		if s.Drifted {
+			status = "DRIFTED"
+		}
+		if s.Missing {
+			status = "MISSING"
+		}
+		fmt.Fprintf(tw, "%04d\t%s\t%s\t%s\n", s.Version, s.Name, status, at)
+	}
+	return tw.Flush()
+}
+
+// TestMigrateCommand is the migrate command line, e.g.
+//
+//	make migrate DB=/tmp/test.db CMD="to 1"
+//
+// Migrations are read from MIGRATE_DIR if set, otherwise the embedded ones are used.
+func TestMigrateCommand(t *testing.T) {
+	if os.Getenv("MIGRATE_DB") == "" {
+		t.Skip("Set MIGRATE_DB (and MIGRATE to status|up|down|to N|baseline N) to run migrations.")
+	}
+	db, err := sql.Open("sqlite3", "file:"+os.Getenv("MIGRATE_DB"))
+	if err != nil {
+		t.Fatal("Could not open DB: ", err)
+	}
+	defer db.Close()
+
+	migrations, err := schemaMigrations()
+	if dir := os.Getenv("MIGRATE_DIR"); dir != "" {
+		migrations, err = loadMigrations(os.DirFS(dir))
+	}
+	if err != nil {
+		t.Fatal("Could not load migrations: ", err)
+	}
+	m, err := NewMigrator(db, migrations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := runMigrateCommand(m, strings.Fields(os.Getenv("MIGRATE")), os.Stdout); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func openMigrationsDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", "file:"+filepath.Join(t.TempDir(), "migrate.db"))
+	if err != nil {
+		t.Fatal("Could not open DB: ", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func tableExists(t *testing.T, db *sql.DB, kind, name string) bool {
+	var count int
+	err := db.QueryRow(`SELECT COUNT(1) FROM sqlite_master WHERE type = $1 AND name = $2`, kind, name).Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return count == 1
+}
+
+func TestEmbeddedMigrations(t *testing.T) {
+	migrations, err := schemaMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) != 2 || migrations[0].Name != "create_users" || migrations[0].Down == "" {
+		t.Fatalf("Unexpected embedded migrations: %+v", migrations)
+	}
+
+	db := openMigrationsDB(t)
+	m, err := NewMigrator(db, migrations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if !tableExists(t, db, "table", "USERS") || !tableExists(t, db, "index", "USERS_NAME_IDX") {
+		t.Error("Expected USERS and its index after migrating up.")
+	}
+	if v, _ := m.Version(); v != 2 {
+		t.Error("Expected version 2. Got:", v)
+	}
+	// Up is a no-op once everything is applied
+	if err := m.Up(); err != nil {
+		t.Error(err)
+	}
+
+	if err := m.Down(); err != nil {
+		t.Fatal(err)
+	}
+	if tableExists(t, db, "index", "USERS_NAME_IDX") || !tableExists(t, db, "table", "USERS") {
+		t.Error("Expected down to drop the index only.")
+	}
+	if err := m.To(0); err != nil {
+		t.Fatal(err)
+	}
+	if tableExists(t, db, "table", "USERS") {
+		t.Error("Expected to 0 to drop USERS.")
+	}
+	if v, _ := m.Version(); v != 0 {
+		t.Error("Expected version 0. Got:", v)
+	}
+}
+
+func TestMigrateSchemaAdoptsExistingUsers(t *testing.T) {
+	db := openMigrationsDB(t)
+	// USERS as it was created before there were migrations
+	_, err := db.Exec(`CREATE TABLE "USERS" (
+		"id" integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+		"email" varchar(75) NOT NULL UNIQUE,
+		"password" varchar(128) NOT NULL,
+		"first_name" varchar(30) NOT NULL,
+		"last_name" varchar(30) NOT NULL,
+		"is_active" bool NOT NULL)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateSchema(db); err != nil {
+		t.Fatal("Expected the existing USERS to be taken as migration 1. Got:", err)
+	}
+	if !tableExists(t, db, "index", "USERS_NAME_IDX") {
+		t.Error("Expected the later migrations to be applied.")
+	}
+
+	migrations, _ := schemaMigrations()
+	m, _ := NewMigrator(db, migrations)
+	if v, _ := m.Version(); v != 2 {
+		t.Error("Expected version 2. Got:", v)
+	}
+	if err := m.Baseline(1); err == nil {
+		t.Error("Expected baseline to refuse a migrated database.")
+	}
+}
+
+func TestMigrationFailureRollsBack(t *testing.T) {
+	migrations, err := loadMigrations(fstest.MapFS{
+		"0001_things.up.sql":   {Data: []byte(`CREATE TABLE "THINGS" ("id" integer);`)},
+		"0001_things.down.sql": {Data: []byte(`DROP TABLE "THINGS";`)},
+		"0002_broken.up.sql":   {Data: []byte(`CREATE TABLE "OTHER" ("id" integer); CREATE TABLE "THINGS" ("id" integer);`)},
+		"README.md":            {Data: []byte(`not a migration`)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := openMigrationsDB(t)
+	m, _ := NewMigrator(db, migrations)
+	if err := m.Up(); err == nil || !strings.Contains(err.Error(), "0002_broken") {
+		t.Fatal("Expected migration 2 to fail. Got:", err)
+	}
+	if v, _ := m.Version(); v != 1 {
+		t.Error("Expected to stay at version 1. Got:", v)
+	}
+	if tableExists(t, db, "table", "OTHER") {
+		t.Error("Expected the failed migration to be rolled back entirely.")
+	}
+}
+
+func TestMigrationDriftDetection(t *testing.T) {
+	files := fstest.MapFS{
+		"0001_things.up.sql":   {Data: []byte(`CREATE TABLE "THINGS" ("id" integer);`)},
+		"0001_things.down.sql": {Data: []byte(`DROP TABLE "THINGS";`)},
+	}
+	migrations, _ := loadMigrations(files)
+	db := openMigrationsDB(t)
+	m, _ := NewMigrator(db, migrations)
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Somebody edits an applied migration instead of adding a new one
+	files["0001_things.up.sql"] = &fstest.MapFile{Data: []byte(`CREATE TABLE "THINGS" ("id" integer, "name" text);`)}
+	files["0002_more.up.sql"] = &fstest.MapFile{Data: []byte(`CREATE TABLE "MORE" ("id" integer);`)}
+	migrations, _ = loadMigrations(files)
+	m, _ = NewMigrator(db, migrations)
+	if err := m.Up(); !errors.Is(err, ErrMigrationDrift) {
+		t.Error("Expected drift to block migrating. Got:", err)
+	}
+
+	out := bytes.Buffer{}
+	if err := runMigrateCommand(m, []string{"status"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "DRIFTED") || !regexp.MustCompile(`0002\s+more\s+pending`).MatchString(out.String()) {
+		t.Error("Expected status to show the drift and the pending migration. Got:\n", out.String())
+	}
+}
+
+func TestMigrateCommandArgs(t *testing.T) {
+	migrations, _ := schemaMigrations()
+	m, _ := NewMigrator(openMigrationsDB(t), migrations)
+	out := bytes.Buffer{}
+	if err := runMigrateCommand(m, []string{"to", "1"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 || !strings.Contains(lines[1], "applied") || !strings.Contains(lines[2], "pending") {
+		t.Error("Expected migration 1 applied and 2 pending. Got:\n", out.String())
+	}
+	if err := runMigrateCommand(m, []string{"sideways"}, &out); err == nil {
+		t.Error("Expected an unknown command to fail.")
+	}
+}
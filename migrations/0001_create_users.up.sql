@@ -0,0 +1,8 @@
+CREATE TABLE "USERS" (
+	"id" integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+	"email" varchar(75) NOT NULL UNIQUE,
+	"password" varchar(128) NOT NULL,
+	"first_name" varchar(30) NOT NULL,
+	"last_name" varchar(30) NOT NULL,
+	"is_active" bool NOT NULL
+);
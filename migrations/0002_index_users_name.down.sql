@@ -0,0 +1 @@
+DROP INDEX "USERS_NAME_IDX";
@@ -0,0 +1 @@
+CREATE INDEX "USERS_NAME_IDX" ON "USERS" ("last_name", "first_name");
@@ -0,0 +1,395 @@
+package learning
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrPasswordMismatch   = errors.New("password does not match")
+	ErrUnknownHashFormat  = errors.New("unknown password hash format")
+	ErrInvalidCredentials = errors.New("invalid email or password")
+)
+
+type PasswordAlgorithm string
+
+const (
+	Argon2id PasswordAlgorithm = "argon2id"
+	Bcrypt   PasswordAlgorithm = "bcrypt"
+)
+
+// PasswordHasher hashes passwords into self-describing strings: argon2id in
+// the PHC format $argon2id$v=19$m=65536,t=3,p=4$<salt>$<key>, bcrypt in its
+// own $2a$10$... format. Everything needed to verify a password, including the
+// parameters it was hashed with, travels with the hash.
+type PasswordHasher struct {
+	Algorithm PasswordAlgorithm
+
+	// argon2id parameters
+	Time    uint32
+	Memory  uint32 // KiB
+	Threads uint8
+	KeyLen  uint32
+	SaltLen int
+
+	// bcrypt parameters
+	Cost int
+}
+
+// DefaultPasswordHasher uses the argon2id parameters recommended by RFC 9106
+// for memory constrained environments.
+func DefaultPasswordHasher() *PasswordHasher {
+	return &PasswordHasher{
+		Algorithm: Argon2id,
+		Time:      3,
+		Memory:    64 * 1024,
+		Threads:   4,
+		KeyLen:    32,
+		SaltLen:   16,
+		Cost:      bcrypt.DefaultCost,
+	}
+}
+
+func (h *PasswordHasher) Hash(password string) (string, error) {
+	switch h.Algorithm {
+	case Argon2id:
+		salt := make([]byte, h.SaltLen)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		key := argon2.IDKey([]byte(password), salt, h.Time, h.Memory, h.Threads, h.KeyLen)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, h.Memory, h.Time, h.Threads,
+			base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+	case Bcrypt:
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), h.Cost)
+		return string(hash), err
+	}
+	return "", fmt.Errorf("unsupported password algorithm %q", h.Algorithm)
+}
+
+// Verify checks password against hash, whichever algorithm hashed it. It
+// returns ErrPasswordMismatch for a wrong password.
+func (h *PasswordHasher) Verify(password, hash string) error {
+	if isBcryptHash(hash) {
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return ErrPasswordMismatch
+		}
+		return err
+	}
+	params, salt, key, err := parseArgon2id(hash)
+	if err != nil {
+		return err
+	}
+	other := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, uint32(len(key)))
+	if subtle.ConstantTimeCompare(key, other) != 1 {
+		return ErrPasswordMismatch
+	}
+	return nil
+}
+
+// NeedsRehash tells whether hash was made with another algorithm or other
+// parameters than h would use now. Unparsable hashes need rehashing too.
+func (h *PasswordHasher) NeedsRehash(hash string) bool {
+	switch h.Algorithm {
+	case Argon2id:
+		params, _, key, err := parseArgon2id(hash)
+		return err != nil || params.Time != h.Time || params.Memory != h.Memory ||
+			params.Threads != h.Threads || uint32(len(key)) != h.KeyLen
+	case Bcrypt:
+		cost, err := bcrypt.Cost([]byte(hash))
+		return err != nil || cost != h.Cost
+	}
+	return true
+}
+
+// isPasswordHash tells whether s is in one of the hash formats Verify reads.
+func isPasswordHash(s string) bool {
+	return isBcryptHash(s) || strings.HasPrefix(s, "$argon2id$")
+}
+
+func isBcryptHash(s string) bool {
+	return strings.HasPrefix(s, "$2a$") || strings.HasPrefix(s, "$2b$") || strings.HasPrefix(s, "$2y$")
+}
+
+// maxArgon2Memory caps the memory, in KiB, a stored hash can make Verify
+// allocate.
+const maxArgon2Memory = 1 << 20
+
+func parseArgon2id(hash string) (params PasswordHasher, salt, key []byte, err error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return params, nil, nil, ErrUnknownHashFormat
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, ErrUnknownHashFormat
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads); err != nil ||
+		params.Time < 1 || params.Threads < 1 || params.Memory > maxArgon2Memory {
+		return params, nil, nil, ErrUnknownHashFormat
+	}
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil || len(salt) == 0 {
+		return params, nil, nil, ErrUnknownHashFormat
+	}
+	if key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(key) == 0 {
+		return params, nil, nil, ErrUnknownHashFormat
+	}
+	return params, salt, key, nil
+}
+
+// hashingUserRepository keeps passwords hashed in any UserRepository. Create
+// and Update always hash the password they are given; CreateHashed and
+// UpdateHashed store one that already is a hash, such as a row migrated from
+// another system or a user read back with GetByID.
+type hashingUserRepository struct {
+	UserRepository
+	hasher *PasswordHasher
+}
+
+func newHashingUserRepository(repo UserRepository, hasher *PasswordHasher) *hashingUserRepository {
+	return &hashingUserRepository{UserRepository: repo, hasher: hasher}
+}
+
+func (r *hashingUserRepository) hash(u *User) error {
+	hash, err := r.hasher.Hash(u.Password)
+	if err != nil {
+		return err
+	}
+	u.Password = hash
+	return nil
+}
+
+// Create stores u with its password hashed and leaves the hash in u.Password.
+func (r *hashingUserRepository) Create(u *User) error {
+	if err := r.hash(u); err != nil {
+		return err
+	}
+	return r.UserRepository.Create(u)
+}
+
+func (r *hashingUserRepository) Update(u User) error {
+	if err := r.hash(&u); err != nil {
+		return err
+	}
+	return r.UserRepository.Update(u)
+}
+
+// CreateHashed stores u whose password is already a bcrypt or argon2id hash.
+// Anything else gives ErrUnknownHashFormat.
+func (r *hashingUserRepository) CreateHashed(u *User) error {
+	if !isPasswordHash(u.Password) {
+		return ErrUnknownHashFormat
+	}
+	return r.UserRepository.Create(u)
+}
+
+// UpdateHashed is Update for a user whose password is already a hash.
+func (r *hashingUserRepository) UpdateHashed(u User) error {
+	if !isPasswordHash(u.Password) {
+		return ErrUnknownHashFormat
+	}
+	return r.UserRepository.Update(u)
+}
+
+// Authenticate returns the user with email if password is right, and rehashes
+// the password when the hasher's settings have changed since it was stored.
+// Unknown emails and wrong passwords both give ErrInvalidCredentials.
+func (r *hashingUserRepository) Authenticate(email, password string) (User, error) {
+	u, err := r.GetByEmail(email)
+	if err == ErrNotFound {
+		// Hash anyway so unknown emails take as long as wrong passwords
+		r.hasher.Hash(password)
+		return User{}, ErrInvalidCredentials
+	}
+	if err != nil {
+		return User{}, err
+	}
+	switch err := r.hasher.Verify(password, u.Password); err {
+	case nil:
+	case ErrPasswordMismatch:
+		return User{}, ErrInvalidCredentials
+	default:
+		return User{}, err
+	}
+	if r.hasher.NeedsRehash(u.Password) {
+		hash, err := r.hasher.Hash(password)
+		if err != nil {
+			return User{}, err
+		}
+		u.Password = hash
+		if err := r.UserRepository.Update(u); err != nil {
+			return User{}, err
+		}
+	}
+	return u, nil
+}
+
+// testPasswordHasher keeps argon2id cheap enough for tests.
+func testPasswordHasher() *PasswordHasher {
+	h := DefaultPasswordHasher()
+	h.Time, h.Memory, h.Threads = 1, 64, 1
+	h.Cost = bcrypt.MinCost
+	return h
+}
+
+func TestPasswordHashing(t *testing.T) {
+	for _, algorithm := range []PasswordAlgorithm{Argon2id, Bcrypt} {
+		t.Run(string(algorithm), func(t *testing.T) {
+			h := testPasswordHasher()
+			h.Algorithm = algorithm
+			hash, err := h.Hash("password")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !isPasswordHash(hash) || strings.Contains(hash, "password") {
+				t.Fatal("Expected a self-describing hash. Got:", hash)
+			}
+			if other, _ := h.Hash("password"); other == hash {
+				t.Error("Expected every hash to be salted differently.")
+			}
+			if err := h.Verify("password", hash); err != nil {
+				t.Error("Expected the password to verify. Got:", err)
+			}
+			if err := h.Verify("Password", hash); err != ErrPasswordMismatch {
+				t.Error("Expected ErrPasswordMismatch. Got:", err)
+			}
+			if h.NeedsRehash(hash) {
+				t.Error("Expected a fresh hash not to need rehashing.")
+			}
+		})
+	}
+}
+
+func TestPasswordArgon2idFormat(t *testing.T) {
+	h := testPasswordHasher()
+	hash, _ := h.Hash("password")
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=64,t=1,p=1$") {
+		t.Error("Expected the PHC string format. Got:", hash)
+	}
+	// A hasher with other settings still verifies, but wants to rehash
+	stronger := testPasswordHasher()
+	stronger.Time = 2
+	if err := stronger.Verify("password", hash); err != nil {
+		t.Error(err)
+	}
+	if !stronger.NeedsRehash(hash) {
+		t.Error("Expected a change of parameters to need rehashing.")
+	}
+	stronger.Algorithm = Bcrypt
+	if !stronger.NeedsRehash(hash) {
+		t.Error("Expected a change of algorithm to need rehashing.")
+	}
+	for _, bad := range []string{
+		"password",
+		"$argon2id$v=19$m=64,t=1,p=1$c2FsdA",
+		"$argon2id$v=18$m=64,t=1,p=1$c2FsdA$a2V5",
+		"$argon2i$v=19$m=64,t=1,p=1$c2FsdA$a2V5",
+		// Parameters argon2 can't run with, or that would take all the memory
+		"$argon2id$v=19$m=64,t=0,p=1$c2FsdA$a2V5",
+		"$argon2id$v=19$m=64,t=1,p=0$c2FsdA$a2V5",
+		"$argon2id$v=19$m=4294967295,t=1,p=1$c2FsdA$a2V5",
+		"$argon2id$v=19$m=64,t=1,p=1$$a2V5",
+		"$argon2id$v=19$m=64,t=1,p=1$c2FsdA$",
+	} {
+		if err := h.Verify("password", bad); err != ErrUnknownHashFormat {
+			t.Errorf("Expected ErrUnknownHashFormat for %q. Got: %v", bad, err)
+		}
+	}
+}
+
+func TestHashingUserRepository(t *testing.T) {
+	repo := newHashingUserRepository(newSQLUserRepository(openUsersDB(t)), testPasswordHasher())
+	u := User{Email: "arunsworld@gmail.com", Password: "password", FirstName: "Arun", LastName: "Barua", IsActive: true}
+	if err := repo.Create(&u); err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := repo.GetByID(u.ID)
+	if stored.Password == "password" || stored.Password != u.Password {
+		t.Fatal("Expected the hash to be stored and handed back. Got:", stored.Password)
+	}
+
+	// Writing back a user that was read must not hash the hash
+	stored.LastName = "B"
+	if err := repo.UpdateHashed(stored); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.Authenticate("arunsworld@gmail.com", "password"); err != nil {
+		t.Error("Expected to log in after an update. Got:", err)
+	}
+
+	if _, err := repo.Authenticate("arunsworld@gmail.com", "wrong"); err != ErrInvalidCredentials {
+		t.Error("Expected ErrInvalidCredentials for a wrong password. Got:", err)
+	}
+	if _, err := repo.Authenticate("nobody@example.com", "password"); err != ErrInvalidCredentials {
+		t.Error("Expected ErrInvalidCredentials for an unknown email. Got:", err)
+	}
+
+	stored.Password = "new password"
+	if err := repo.Update(stored); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.Authenticate("arunsworld@gmail.com", "new password"); err != nil {
+		t.Error("Expected the changed password to work. Got:", err)
+	}
+
+	// A password that happens to look like a hash is still hashed
+	stored.Password = "$2a$10$" + strings.Repeat("x", 53)
+	if err := repo.Update(stored); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.Authenticate("arunsworld@gmail.com", stored.Password); err != nil {
+		t.Error("Expected the hash-like password to work. Got:", err)
+	}
+	if err := repo.UpdateHashed(User{ID: u.ID, Password: "plain text"}); err != ErrUnknownHashFormat {
+		t.Error("Expected UpdateHashed to refuse plain text. Got:", err)
+	}
+}
+
+func TestHashingUserRepositoryMigratesHashes(t *testing.T) {
+	repo := newHashingUserRepository(newSQLUserRepository(openUsersDB(t)), testPasswordHasher())
+	// Rows from the old system arrive with bcrypt hashes
+	hash, _ := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	u := User{Email: "arunsworld@gmail.com", Password: string(hash), FirstName: "Arun", IsActive: true}
+	if err := repo.CreateHashed(&u); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.Authenticate("arunsworld@gmail.com", "password"); err != nil {
+		t.Error("Expected to log in with the migrated hash. Got:", err)
+	}
+	plain := User{Email: "arun@e2open.com", Password: "password", FirstName: "Arun", IsActive: true}
+	if err := repo.CreateHashed(&plain); err != ErrUnknownHashFormat {
+		t.Error("Expected CreateHashed to refuse plain text. Got:", err)
+	}
+}
+
+func TestPasswordRehashOnLogin(t *testing.T) {
+	db := openUsersDB(t)
+	old := testPasswordHasher()
+	old.Algorithm = Bcrypt
+	u := User{Email: "arunsworld@gmail.com", Password: "password", FirstName: "Arun", IsActive: true}
+	if err := newHashingUserRepository(newSQLUserRepository(db), old).Create(&u); err != nil {
+		t.Fatal(err)
+	}
+
+	// The site moves from bcrypt to argon2id; users move over as they log in
+	repo := newHashingUserRepository(newSQLUserRepository(db), testPasswordHasher())
+	if _, err := repo.Authenticate("arunsworld@gmail.com", "password"); err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := repo.GetByID(u.ID)
+	if !strings.HasPrefix(stored.Password, "$argon2id$") {
+		t.Error("Expected the password to be rehashed with argon2id. Got:", stored.Password)
+	}
+	if _, err := repo.Authenticate("arunsworld@gmail.com", "password"); err != nil {
+		t.Error("Expected to log in with the rehashed password. Got:", err)
+	}
+}
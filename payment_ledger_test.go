@@ -0,0 +1,366 @@
+package learning
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+var (
+	ErrPaymentNotFound     = errors.New("payment not found")
+	ErrIdempotencyConflict = errors.New("idempotency key reused with a different request")
+)
+
+type PaymentRequest struct {
+	IdempotencyKey string
+	Amount         int64 // in minor units, e.g. cents
+	Currency       string
+}
+
+// PaymentRecord is a payment as stored in the ledger.
+type PaymentRecord struct {
+	ID             string
+	IdempotencyKey string
+	Amount         int64
+	Currency       string
+	Status         PaymentStatus
+	History        []PaymentTransition
+}
+
+// PaymentService runs payments through ProcessPayment and keeps a ledger of
+// every payment and status transition in SQLite. Requests are idempotent on
+// their IdempotencyKey, and payments left PENDING by a crash can be resumed.
+type PaymentService struct {
+	db     *sql.DB
+	source ConfirmationSource
+}
+
+func NewPaymentService(db *sql.DB, source ConfirmationSource) (*PaymentService, error) {
+	createSQL := []string{
+		`CREATE TABLE IF NOT EXISTS "PAYMENTS" (
+					"id" varchar(32) NOT NULL PRIMARY KEY,
+					"idempotency_key" varchar(128) NOT NULL UNIQUE,
+					"amount" integer NOT NULL,
+					"currency" varchar(3) NOT NULL,
+					"status" varchar(16) NOT NULL)`,
+		`CREATE TABLE IF NOT EXISTS "PAYMENT_TRANSITIONS" (
+					"id" integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+					"payment_id" varchar(32) NOT NULL REFERENCES "PAYMENTS" ("id"),
+					"from_status" varchar(16) NOT NULL,
+					"to_status" varchar(16) NOT NULL,
+					"reason" text NOT NULL,
+					"at" integer NOT NULL)`,
+	}
+	for _, s := range createSQL {
+		if _, err := db.Exec(s); err != nil {
+			return nil, fmt.Errorf("could not create payment ledger: %w", err)
+		}
+	}
+	return &PaymentService{db: db, source: source}, nil
+}
+
+// Submit records a new payment and waits for it to settle. A request whose
+// IdempotencyKey has been seen before is not processed again; the stored
+// payment is returned as it stands, even if it is still PENDING.
+func (s *PaymentService) Submit(ctx context.Context, req PaymentRequest) (PaymentRecord, error) {
+	payment := NewPayment(newPaymentID())
+	err := s.insert(payment, req)
+	if isUniqueViolation(err) {
+		existing, err := s.GetByIdempotencyKey(req.IdempotencyKey)
+		if err != nil {
+			return PaymentRecord{}, err
+		}
+		if existing.Amount != req.Amount || existing.Currency != req.Currency {
+			return existing, ErrIdempotencyConflict
+		}
+		return existing, nil
+	}
+	if err != nil {
+		return PaymentRecord{}, err
+	}
+	return s.settle(ctx, payment)
+}
+
+// ResumePending picks up every payment left PENDING, e.g. by a restart, waits
+// for them to settle under ctx and returns their final records.
+func (s *PaymentService) ResumePending(ctx context.Context) ([]PaymentRecord, error) {
+	rows, err := s.db.Query(`SELECT "id" FROM "PAYMENTS" WHERE "status" = $1 ORDER BY "id"`, string(PaymentPending))
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	results := make([]PaymentRecord, len(ids))
+	errs := make([]error, len(ids))
+	wg := sync.WaitGroup{}
+	for i, id := range ids {
+		wg.Add(1)
+		go func(i int, id string) {
+			defer wg.Done()
+			results[i], errs[i] = s.settle(ctx, NewPayment(id))
+		}(i, id)
+	}
+	wg.Wait()
+	return results, errors.Join(errs...)
+}
+
+func (s *PaymentService) Get(id string) (PaymentRecord, error) {
+	return s.get(`"id" = $1`, id)
+}
+
+func (s *PaymentService) GetByIdempotencyKey(key string) (PaymentRecord, error) {
+	return s.get(`"idempotency_key" = $1`, key)
+}
+
+// settle processes payment and records its terminal transition. If another
+// process settled the payment first, the ledger wins.
+func (s *PaymentService) settle(ctx context.Context, payment *Payment) (PaymentRecord, error) {
+	ProcessPayment(ctx, payment, s.source)
+	history := payment.History()
+	last := history[len(history)-1]
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return PaymentRecord{}, err
+	}
+	defer tx.Rollback()
+	result, err := tx.Exec(`UPDATE "PAYMENTS" SET "status" = $1 WHERE "id" = $2 AND "status" = $3`,
+		string(last.To), payment.ID, string(PaymentPending))
+	if err != nil {
+		return PaymentRecord{}, err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return PaymentRecord{}, err
+	} else if n == 1 {
+		if err := insertTransition(tx, payment.ID, last); err != nil {
+			return PaymentRecord{}, err
+		}
+		if err := tx.Commit(); err != nil {
+			return PaymentRecord{}, err
+		}
+	}
+	return s.Get(payment.ID)
+}
+
+func (s *PaymentService) insert(payment *Payment, req PaymentRequest) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`INSERT INTO "PAYMENTS" ("id", "idempotency_key", "amount", "currency", "status")
+	VALUES ($1, $2, $3, $4, $5)`, payment.ID, req.IdempotencyKey, req.Amount, req.Currency, string(payment.Status()))
+	if err != nil {
+		return err
+	}
+	if err := insertTransition(tx, payment.ID, payment.History()[0]); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *PaymentService) get(where string, arg string) (PaymentRecord, error) {
+	var (
+		r      PaymentRecord
+		status string
+	)
+	err := s.db.QueryRow(`SELECT "id", "idempotency_key", "amount", "currency", "status" FROM "PAYMENTS" WHERE `+where, arg).
+		Scan(&r.ID, &r.IdempotencyKey, &r.Amount, &r.Currency, &status)
+	if err == sql.ErrNoRows {
+		return r, ErrPaymentNotFound
+	}
+	if err != nil {
+		return r, err
+	}
+	r.Status = PaymentStatus(status)
+
+	rows, err := s.db.Query(`SELECT "from_status", "to_status", "reason", "at" FROM "PAYMENT_TRANSITIONS"
+	WHERE "payment_id" = $1 ORDER BY "id"`, r.ID)
+	if err != nil {
+		return r, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			tr       PaymentTransition
+			from, to string
+			at       int64
+		)
+		if err := rows.Scan(&from, &to, &tr.Reason, &at); err != nil {
+			return r, err
+		}
+		tr.From, tr.To, tr.At = PaymentStatus(from), PaymentStatus(to), time.Unix(0, at)
+		r.History = append(r.History, tr)
+	}
+	return r, rows.Err()
+}
+
+func insertTransition(tx *sql.Tx, paymentID string, tr PaymentTransition) error {
+	_, err := tx.Exec(`INSERT INTO "PAYMENT_TRANSITIONS" ("payment_id", "from_status", "to_status", "reason", "at")
+	VALUES ($1, $2, $3, $4, $5)`, paymentID, string(tr.From), string(tr.To), tr.Reason, tr.At.UnixNano())
+	return err
+}
+
+func newPaymentID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// confirmations is a ConfirmationSource whose verdicts are sent by the test.
+type confirmations struct {
+	mu       sync.Mutex
+	channels map[string]chan error
+}
+
+func (c *confirmations) Await(paymentID string) <-chan error {
+	return c.channel(paymentID)
+}
+
+func (c *confirmations) channel(paymentID string) chan error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.channels == nil {
+		c.channels = make(map[string]chan error)
+	}
+	ch, ok := c.channels[paymentID]
+	if !ok {
+		ch = make(chan error, 1)
+		c.channels[paymentID] = ch
+	}
+	return ch
+}
+
+func openLedger(t *testing.T, path string, source ConfirmationSource) (*sql.DB, *PaymentService) {
+	db, err := sql.Open("sqlite3", "file:"+path)
+	if err != nil {
+		t.Fatal("Could not open DB: ", err)
+	}
+	svc, err := NewPaymentService(db, source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db, svc
+}
+
+func TestPaymentServiceIsIdempotent(t *testing.T) {
+	source := &confirmations{}
+	db, svc := openLedger(t, filepath.Join(t.TempDir(), "ledger.db"), source)
+	defer db.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	req := PaymentRequest{IdempotencyKey: "order-1", Amount: 1999, Currency: "GBP"}
+	first, err := svc.Submit(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Status != PaymentTimedOut {
+		t.Fatal("Expected an unconfirmed payment to time out. Got:", first.Status)
+	}
+
+	// The retry returns the stored outcome and never reaches the provider
+	second, err := svc.Submit(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.ID != first.ID || second.Status != PaymentTimedOut {
+		t.Errorf("Expected the stored payment back. Got %+v.", second)
+	}
+	if len(second.History) != 2 || second.History[1].From != PaymentPending || second.History[1].To != PaymentTimedOut {
+		t.Error("Expected PENDING -> TIMED_OUT to be recorded. Got:", second.History)
+	}
+
+	req.Amount = 2999
+	if _, err := svc.Submit(context.Background(), req); err != ErrIdempotencyConflict {
+		t.Error("Expected a conflict for a different amount. Got:", err)
+	}
+
+	var count int
+	db.QueryRow(`SELECT COUNT(1) FROM PAYMENTS`).Scan(&count)
+	if count != 1 {
+		t.Error("Expected a single payment in the ledger. Got:", count)
+	}
+}
+
+func TestPaymentServiceRecordsConfirmation(t *testing.T) {
+	source := &confirmations{}
+	db, svc := openLedger(t, filepath.Join(t.TempDir(), "ledger.db"), source)
+	defer db.Close()
+
+	go func() {
+		// Confirm whichever payment shows up
+		for {
+			time.Sleep(time.Millisecond * 5)
+			record, err := svc.GetByIdempotencyKey("order-2")
+			if err == nil {
+				source.channel(record.ID) <- nil
+				return
+			}
+		}
+	}()
+	record, err := svc.Submit(context.Background(), PaymentRequest{IdempotencyKey: "order-2", Amount: 500, Currency: "USD"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Status != PaymentConfirmed {
+		t.Error("Expected CONFIRMED. Got:", record.Status)
+	}
+	if _, err := svc.Get("nope"); err != ErrPaymentNotFound {
+		t.Error("Expected ErrPaymentNotFound. Got:", err)
+	}
+}
+
+func TestPaymentServiceResumesPendingPayments(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ledger.db")
+
+	// Simulate a crash: the payment is recorded but never settled
+	db, svc := openLedger(t, path, &confirmations{})
+	payment := NewPayment(newPaymentID())
+	if err := svc.insert(payment, PaymentRequest{IdempotencyKey: "order-3", Amount: 100, Currency: "EUR"}); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	source := &confirmations{}
+	source.channel(payment.ID) <- errors.New("card expired")
+	db, svc = openLedger(t, path, source)
+	defer db.Close()
+
+	resumed, err := svc.ResumePending(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resumed) != 1 || resumed[0].ID != payment.ID || resumed[0].Status != PaymentFailed {
+		t.Fatal("Expected the pending payment to be resumed and fail. Got:", resumed)
+	}
+	if resumed[0].History[1].Reason != "card expired" {
+		t.Error("Expected the decline reason in the ledger. Got:", resumed[0].History[1].Reason)
+	}
+	if resumed, _ := svc.ResumePending(context.Background()); len(resumed) != 0 {
+		t.Error("Expected nothing left to resume. Got:", resumed)
+	}
+}
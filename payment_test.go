@@ -0,0 +1,259 @@
+package learning
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+type PaymentStatus string
+
+const (
+	PaymentPending   PaymentStatus = "PENDING"
+	PaymentConfirmed PaymentStatus = "CONFIRMED"
+	PaymentCancelled PaymentStatus = "CANCELLED"
+	PaymentTimedOut  PaymentStatus = "TIMED_OUT"
+	PaymentFailed    PaymentStatus = "FAILED"
+)
+
+// Terminal reports whether no further transitions are possible from s.
+// Unknown statuses are not terminal, so nothing can transition to them.
+func (s PaymentStatus) Terminal() bool {
+	switch s {
+	case PaymentConfirmed, PaymentCancelled, PaymentTimedOut, PaymentFailed:
+		return true
+	}
+	return false
+}
+
+// PaymentTransition records one step of a payment's life.
+type PaymentTransition struct {
+	From   PaymentStatus
+	To     PaymentStatus
+	At     time.Time
+	Reason string
+}
+
+var ErrInvalidTransition = errors.New("invalid payment transition")
+
+// Payment is a state machine that starts PENDING and ends in exactly one of
+// CONFIRMED, CANCELLED, TIMED_OUT or FAILED.
+type Payment struct {
+	ID string
+
+	mu      sync.Mutex
+	status  PaymentStatus
+	history []PaymentTransition
+	done    chan struct{} // closed on reaching a terminal status
+}
+
+func NewPayment(id string) *Payment {
+	return &Payment{
+		ID:      id,
+		status:  PaymentPending,
+		history: []PaymentTransition{{To: PaymentPending, At: time.Now(), Reason: "created"}},
+		done:    make(chan struct{}),
+	}
+}
+
+func (p *Payment) Status() PaymentStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.status
+}
+
+// History returns a copy of the transitions so far, oldest first.
+func (p *Payment) History() []PaymentTransition {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]PaymentTransition(nil), p.history...)
+}
+
+// Done is closed once the payment reaches a terminal status.
+func (p *Payment) Done() <-chan struct{} {
+	return p.done
+}
+
+// Transition moves the payment to status. Only PENDING payments can move, and
+// only to a terminal status.
+func (p *Payment) Transition(to PaymentStatus, reason string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.status.Terminal() || !to.Terminal() {
+		return fmt.Errorf("%w: %s -> %s", ErrInvalidTransition, p.status, to)
+	}
+	p.history = append(p.history, PaymentTransition{From: p.status, To: to, At: time.Now(), Reason: reason})
+	p.status = to
+	close(p.done)
+	return nil
+}
+
+// ConfirmationSource reports the payment provider's verdict. Await returns a
+// channel that receives nil once the payment is confirmed, or the reason it
+// was declined.
+type ConfirmationSource interface {
+	Await(paymentID string) <-chan error
+}
+
+// ConfirmationChan adapts a single channel to a ConfirmationSource.
+type ConfirmationChan <-chan error
+
+func (c ConfirmationChan) Await(string) <-chan error {
+	return c
+}
+
+// ProcessPayment waits for the provider's verdict on payment, for ctx to end
+// or for someone else to settle the payment, and returns the status the
+// payment settled in. It blocks on channels
+// rather than polling, so it reacts as soon as either side is ready.
+// Refer http://blog.ralch.com/tutorial/golang-concurrency-patterns-context/
+func ProcessPayment(ctx context.Context, payment *Payment, source ConfirmationSource) PaymentStatus {
+	to, reason := awaitConfirmation(ctx, payment, source.Await(payment.ID))
+	if to != "" {
+		// Lose gracefully to anyone who settled the payment first
+		payment.Transition(to, reason)
+	}
+	return payment.Status()
+}
+
+// awaitConfirmation returns the status to settle payment in, or "" if it has
+// been settled already.
+func awaitConfirmation(ctx context.Context, payment *Payment, confirmed <-chan error) (PaymentStatus, string) {
+	select {
+	case <-payment.Done():
+		return "", ""
+	case err, ok := <-confirmed:
+		if !ok {
+			return PaymentFailed, "confirmation source closed"
+		}
+		if err != nil {
+			return PaymentFailed, err.Error()
+		}
+		return PaymentConfirmed, "confirmed by provider"
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			return PaymentTimedOut, ctx.Err().Error()
+		}
+		return PaymentCancelled, ctx.Err().Error()
+	}
+}
+
+func TestContextCancellation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(time.Millisecond * 100)
+		cancel()
+	}()
+	status := ProcessPayment(ctx, NewPayment("p1"), ConfirmationChan(make(chan error)))
+	if status != PaymentCancelled {
+		t.Fatal("Expected a CANCELLED status. Got:", status)
+	}
+}
+
+func TestContextConfirmation(t *testing.T) {
+	confirmationCh := make(chan error)
+	go func() {
+		time.Sleep(time.Millisecond * 100)
+		confirmationCh <- nil
+	}()
+	status := ProcessPayment(context.Background(), NewPayment("p1"), ConfirmationChan(confirmationCh))
+	if status != PaymentConfirmed {
+		t.Fatal("Expected a CONFIRMED status. Got:", status)
+	}
+}
+
+func TestContextDeadline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+	status := ProcessPayment(ctx, NewPayment("p1"), ConfirmationChan(make(chan error)))
+	if status != PaymentTimedOut {
+		t.Fatal("Expected a TIMED_OUT status. Got:", status)
+	}
+}
+
+func TestPaymentDeclined(t *testing.T) {
+	confirmationCh := make(chan error, 1)
+	confirmationCh <- errors.New("insufficient funds")
+	payment := NewPayment("p1")
+	status := ProcessPayment(context.Background(), payment, ConfirmationChan(confirmationCh))
+	if status != PaymentFailed {
+		t.Fatal("Expected a FAILED status. Got:", status)
+	}
+
+	history := payment.History()
+	if len(history) != 2 {
+		t.Fatal("Expected 2 transitions. Got:", history)
+	}
+	if history[0].To != PaymentPending || history[1].From != PaymentPending || history[1].To != PaymentFailed {
+		t.Error("Expected PENDING -> FAILED. Got:", history)
+	}
+	if history[1].Reason != "insufficient funds" {
+		t.Error("Expected the decline reason to be recorded. Got:", history[1].Reason)
+	}
+	select {
+	case <-payment.Done():
+	default:
+		t.Error("Expected Done to be closed for a settled payment.")
+	}
+}
+
+func TestProcessPaymentSettledElsewhere(t *testing.T) {
+	payment := NewPayment("p1")
+	go func() {
+		time.Sleep(time.Millisecond * 20)
+		payment.Transition(PaymentCancelled, "cancelled by customer")
+	}()
+	returned := make(chan PaymentStatus)
+	go func() {
+		// The provider never answers and the context never ends
+		returned <- ProcessPayment(context.Background(), payment, ConfirmationChan(make(chan error)))
+	}()
+	select {
+	case status := <-returned:
+		if status != PaymentCancelled {
+			t.Error("Expected the CANCELLED status set elsewhere. Got:", status)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected ProcessPayment to return once the payment was settled")
+	}
+	if history := payment.History(); len(history) != 2 {
+		t.Error("Expected only the one transition. Got:", history)
+	}
+}
+
+func TestPaymentStatusTerminal(t *testing.T) {
+	for status, terminal := range map[PaymentStatus]bool{
+		PaymentPending: false, PaymentConfirmed: true, PaymentCancelled: true,
+		PaymentTimedOut: true, PaymentFailed: true, "REFUNDED": false,
+	} {
+		if status.Terminal() != terminal {
+			t.Errorf("Expected %s terminal to be %v", status, terminal)
+		}
+	}
+	if err := NewPayment("p1").Transition("REFUNDED", "unknown"); !errors.Is(err, ErrInvalidTransition) {
+		t.Error("Expected a transition to an unknown status to be rejected. Got:", err)
+	}
+}
+
+func TestPaymentTransitionsOnlyOnce(t *testing.T) {
+	payment := NewPayment("p1")
+	if err := payment.Transition(PaymentPending, "again"); !errors.Is(err, ErrInvalidTransition) {
+		t.Error("Expected PENDING -> PENDING to be rejected. Got:", err)
+	}
+	if err := payment.Transition(PaymentConfirmed, "ok"); err != nil {
+		t.Fatal(err)
+	}
+	if err := payment.Transition(PaymentCancelled, "too late"); !errors.Is(err, ErrInvalidTransition) {
+		t.Error("Expected a settled payment to reject transitions. Got:", err)
+	}
+
+	// A payment settled elsewhere keeps its status when processing ends
+	confirmationCh := make(chan error, 1)
+	confirmationCh <- errors.New("declined")
+	if status := ProcessPayment(context.Background(), payment, ConfirmationChan(confirmationCh)); status != PaymentConfirmed {
+		t.Error("Expected the earlier CONFIRMED to stand. Got:", status)
+	}
+}
@@ -0,0 +1,809 @@
+package learning
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/apache/calcite-avatica-go/v4/message"
+	"github.com/golang/protobuf/proto"
+)
+
+const (
+	avaticaRequestPrefix  = "org.apache.calcite.avatica.proto.Requests$"
+	avaticaResponsePrefix = "org.apache.calcite.avatica.proto.Responses$"
+	// The avatica driver turns this exception into driver.ErrBadConn so
+	// database/sql retries on a fresh connection.
+	avaticaNoSuchConnection = "org.apache.calcite.avatica.NoSuchConnectionException"
+)
+
+// fakeAvaticaServer stands in for the Phoenix Query Server in tests. It speaks
+// the Avatica protobuf protocol, which is what the Go avatica driver uses, and
+// runs statements on SQLite: enough for sql.Open("avatica", url) to connect,
+// ping, query with and without parameters, fetch results in frames, and run
+// transactions. Phoenix's UPSERT INTO runs as SQLite's INSERT OR REPLACE INTO.
+type fakeAvaticaServer struct {
+	db *sql.DB
+	// onConnect, if set, prepares each connection, e.g. to ATTACH databases
+	onConnect func(ctx context.Context, conn *sql.Conn) error
+	// frameSize is the number of rows sent per frame
+	frameSize int
+
+	// mu guards only the bookkeeping below. Statements run under their
+	// connection's lock, so connections work in parallel as with Phoenix.
+	mu            sync.Mutex
+	connections   map[string]*fakeAvaticaConn
+	nextStatement uint32
+}
+
+// fakeAvaticaConn is an Avatica connection, pinned to one SQLite connection
+// so that transactions and per connection state behave. mu serialises the
+// requests on it.
+type fakeAvaticaConn struct {
+	mu         sync.Mutex
+	closed     bool
+	conn       *sql.Conn
+	tx         *sql.Tx
+	autoCommit bool
+	statements map[uint32]*fakeAvaticaStatement
+}
+
+type fakeAvaticaStatement struct {
+	sql     string
+	columns []*message.ColumnMetaData
+	rows    []*message.Row
+	// cursor is where the next fetch continues. The driver always asks for the
+	// first frame's offset, relying on the server to keep its place.
+	cursor int
+}
+
+func newFakeAvaticaServer(db *sql.DB) *fakeAvaticaServer {
+	return &fakeAvaticaServer{db: db, frameSize: 100, connections: map[string]*fakeAvaticaConn{}}
+}
+
+func (s *fakeAvaticaServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	wire := &message.WireMessage{}
+	if err := proto.Unmarshal(body, wire); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	response, err := s.handle(r.Context(), strings.TrimPrefix(wire.Name, avaticaRequestPrefix), wire.WrappedMessage)
+	name := fmt.Sprintf("%T", response)
+	if err != nil {
+		response, name = avaticaErrorResponse(err), "*message.ErrorResponse"
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	wrapped, _ := proto.Marshal(response)
+	out, _ := proto.Marshal(&message.WireMessage{
+		Name:           avaticaResponsePrefix + strings.TrimPrefix(name, "*message."),
+		WrappedMessage: wrapped,
+	})
+	w.Write(out)
+}
+
+var errNoSuchConnection = errors.New(avaticaNoSuchConnection)
+
+func avaticaErrorResponse(err error) *message.ErrorResponse {
+	response := &message.ErrorResponse{
+		ErrorMessage: err.Error(),
+		Severity:     message.Severity_ERROR_SEVERITY,
+		Metadata:     &message.RpcMetadata{ServerAddress: "fake-avatica"},
+	}
+	if errors.Is(err, errNoSuchConnection) {
+		response.Exceptions, response.HasExceptions = []string{avaticaNoSuchConnection}, true
+	}
+	return response
+}
+
+func (s *fakeAvaticaServer) handle(ctx context.Context, name string, wrapped []byte) (proto.Message, error) {
+	switch name {
+	case "OpenConnectionRequest":
+		req := &message.OpenConnectionRequest{}
+		if err := proto.Unmarshal(wrapped, req); err != nil {
+			return nil, err
+		}
+		conn, err := s.db.Conn(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if s.onConnect != nil {
+			if err := s.onConnect(ctx, conn); err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+		s.mu.Lock()
+		_, exists := s.connections[req.ConnectionId]
+		if !exists {
+			s.connections[req.ConnectionId] = &fakeAvaticaConn{conn: conn, autoCommit: true, statements: map[uint32]*fakeAvaticaStatement{}}
+		}
+		s.mu.Unlock()
+		if exists {
+			// As Avatica does, rather than lose the open one and its transaction
+			conn.Close()
+			return nil, fmt.Errorf("connection already exists: %s", req.ConnectionId)
+		}
+		return &message.OpenConnectionResponse{}, nil
+
+	case "DatabasePropertyRequest":
+		// The driver picks its Phoenix adapter by this driver name
+		return &message.DatabasePropertyResponse{Props: []*message.DatabasePropertyElement{{
+			Key:   &message.DatabaseProperty{Name: "GET_DRIVER_NAME"},
+			Value: &message.TypedValue{Type: message.Rep_STRING, StringValue: "PhoenixEmbeddedDriver"},
+		}}}, nil
+
+	case "CloseConnectionRequest":
+		req := &message.CloseConnectionRequest{}
+		if err := proto.Unmarshal(wrapped, req); err != nil {
+			return nil, err
+		}
+		c, err := s.lockConnection(req.ConnectionId)
+		if err != nil {
+			return nil, err
+		}
+		defer c.mu.Unlock()
+		if c.tx != nil {
+			c.tx.Rollback()
+		}
+		c.closed = true
+		s.mu.Lock()
+		delete(s.connections, req.ConnectionId)
+		s.mu.Unlock()
+		return &message.CloseConnectionResponse{}, c.conn.Close()
+
+	case "ConnectionSyncRequest":
+		req := &message.ConnectionSyncRequest{}
+		if err := proto.Unmarshal(wrapped, req); err != nil {
+			return nil, err
+		}
+		c, err := s.lockConnection(req.ConnectionId)
+		if err != nil {
+			return nil, err
+		}
+		defer c.mu.Unlock()
+		if req.ConnProps != nil && req.ConnProps.HasAutoCommit {
+			// Turning auto commit back on commits, as JDBC does
+			if req.ConnProps.AutoCommit && c.tx != nil {
+				err = c.tx.Commit()
+				c.tx = nil
+			}
+			c.autoCommit = req.ConnProps.AutoCommit
+		}
+		return &message.ConnectionSyncResponse{ConnProps: req.ConnProps}, err
+
+	case "CommitRequest", "RollbackRequest":
+		req := &message.CommitRequest{}
+		if err := proto.Unmarshal(wrapped, req); err != nil {
+			return nil, err
+		}
+		c, err := s.lockConnection(req.ConnectionId)
+		if err != nil {
+			return nil, err
+		}
+		defer c.mu.Unlock()
+		if c.tx == nil {
+			return responseFor(name), nil
+		}
+		if name == "CommitRequest" {
+			err = c.tx.Commit()
+		} else {
+			err = c.tx.Rollback()
+		}
+		c.tx = nil
+		return responseFor(name), err
+
+	case "CreateStatementRequest":
+		req := &message.CreateStatementRequest{}
+		if err := proto.Unmarshal(wrapped, req); err != nil {
+			return nil, err
+		}
+		c, err := s.lockConnection(req.ConnectionId)
+		if err != nil {
+			return nil, err
+		}
+		defer c.mu.Unlock()
+		id := s.newStatement(c, "")
+		return &message.CreateStatementResponse{ConnectionId: req.ConnectionId, StatementId: id}, nil
+
+	case "PrepareRequest":
+		req := &message.PrepareRequest{}
+		if err := proto.Unmarshal(wrapped, req); err != nil {
+			return nil, err
+		}
+		c, err := s.lockConnection(req.ConnectionId)
+		if err != nil {
+			return nil, err
+		}
+		defer c.mu.Unlock()
+		id := s.newStatement(c, req.Sql)
+		// Without parsing the statement the parameter types are unknown.
+		// TIMESTAMP makes the driver send times as timestamps; every other
+		// value carries its own type.
+		params := make([]*message.AvaticaParameter, countPlaceholders(req.Sql))
+		for i := range params {
+			params[i] = &message.AvaticaParameter{TypeName: "TIMESTAMP", Name: fmt.Sprint("p", i+1)}
+		}
+		return &message.PrepareResponse{Statement: &message.StatementHandle{
+			ConnectionId: req.ConnectionId,
+			Id:           id,
+			Signature:    &message.Signature{Sql: req.Sql, Parameters: params},
+		}}, nil
+
+	case "PrepareAndExecuteRequest":
+		req := &message.PrepareAndExecuteRequest{}
+		if err := proto.Unmarshal(wrapped, req); err != nil {
+			return nil, err
+		}
+		c, err := s.lockConnection(req.ConnectionId)
+		if err != nil {
+			return nil, err
+		}
+		defer c.mu.Unlock()
+		st, ok := c.statements[req.StatementId]
+		if !ok {
+			return &message.ExecuteResponse{MissingStatement: true}, nil
+		}
+		st.sql = req.Sql
+		return s.execute(ctx, c, req.ConnectionId, req.StatementId, st, nil, req.FirstFrameMaxSize)
+
+	case "ExecuteRequest":
+		req := &message.ExecuteRequest{}
+		if err := proto.Unmarshal(wrapped, req); err != nil {
+			return nil, err
+		}
+		c, err := s.lockConnection(req.StatementHandle.ConnectionId)
+		if err != nil {
+			return nil, err
+		}
+		defer c.mu.Unlock()
+		st, ok := c.statements[req.StatementHandle.Id]
+		if !ok {
+			return &message.ExecuteResponse{MissingStatement: true}, nil
+		}
+		args := make([]interface{}, len(req.ParameterValues))
+		for i, v := range req.ParameterValues {
+			args[i] = typedValueToSQLite(v)
+		}
+		return s.execute(ctx, c, req.StatementHandle.ConnectionId, req.StatementHandle.Id, st, args, req.FirstFrameMaxSize)
+
+	case "FetchRequest":
+		req := &message.FetchRequest{}
+		if err := proto.Unmarshal(wrapped, req); err != nil {
+			return nil, err
+		}
+		c, err := s.lockConnection(req.ConnectionId)
+		if err != nil {
+			return nil, err
+		}
+		defer c.mu.Unlock()
+		st, ok := c.statements[req.StatementId]
+		if !ok {
+			return &message.FetchResponse{MissingStatement: true}, nil
+		}
+		return &message.FetchResponse{Frame: s.nextFrame(st, req.FrameMaxSize)}, nil
+
+	case "CloseStatementRequest":
+		req := &message.CloseStatementRequest{}
+		if err := proto.Unmarshal(wrapped, req); err != nil {
+			return nil, err
+		}
+		c, err := s.lockConnection(req.ConnectionId)
+		if err != nil {
+			return nil, err
+		}
+		defer c.mu.Unlock()
+		delete(c.statements, req.StatementId)
+		return &message.CloseStatementResponse{}, nil
+	}
+	return nil, fmt.Errorf("fake avatica server does not implement %s", name)
+}
+
+func responseFor(request string) proto.Message {
+	if request == "CommitRequest" {
+		return &message.CommitResponse{}
+	}
+	return &message.RollbackResponse{}
+}
+
+// lockConnection returns the connection with id locked.
+func (s *fakeAvaticaServer) lockConnection(id string) (*fakeAvaticaConn, error) {
+	s.mu.Lock()
+	c, ok := s.connections[id]
+	s.mu.Unlock()
+	if ok {
+		c.mu.Lock()
+		if !c.closed {
+			return c, nil
+		}
+		c.mu.Unlock()
+	}
+	return nil, fmt.Errorf("%w: %s", errNoSuchConnection, id)
+}
+
+func (s *fakeAvaticaServer) newStatement(c *fakeAvaticaConn, sql string) uint32 {
+	s.mu.Lock()
+	s.nextStatement++
+	id := s.nextStatement
+	s.mu.Unlock()
+	c.statements[id] = &fakeAvaticaStatement{sql: sql}
+	return id
+}
+
+var upsertInto = regexp.MustCompile(`(?i)^\s*UPSERT\s+INTO\b`)
+
+func (s *fakeAvaticaServer) execute(ctx context.Context, c *fakeAvaticaConn, connID string, id uint32, st *fakeAvaticaStatement, args []interface{}, frameSize int32) (*message.ExecuteResponse, error) {
+	type querier interface {
+		QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+		QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	}
+	var db querier = c.conn
+	if !c.autoCommit {
+		if c.tx == nil {
+			// The transaction outlives this request, so not its context
+			tx, err := c.conn.BeginTx(context.Background(), nil)
+			if err != nil {
+				return nil, err
+			}
+			c.tx = tx
+		}
+		db = c.tx
+	}
+	query := upsertInto.ReplaceAllString(st.sql, "INSERT OR REPLACE INTO")
+	result := &message.ResultSetResponse{ConnectionId: connID, StatementId: id, OwnStatement: true}
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	cols, err := rows.Columns()
+	if err != nil {
+		rows.Close()
+		return nil, err
+	}
+	if len(cols) == 0 {
+		// Like Phoenix, answer statements without a result set with just the
+		// update count. SQLite runs them on the first Next.
+		for rows.Next() {
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		var n int64
+		if err := db.QueryRowContext(ctx, `SELECT changes()`).Scan(&n); err != nil {
+			return nil, err
+		}
+		result.UpdateCount = uint64(n)
+		return &message.ExecuteResponse{Results: []*message.ResultSetResponse{result}}, nil
+	}
+	st.columns, st.rows, err = avaticaRows(rows)
+	if err != nil {
+		return nil, err
+	}
+	st.cursor = 0
+	result.Signature = &message.Signature{Columns: st.columns, Sql: st.sql}
+	result.FirstFrame = s.nextFrame(st, frameSize)
+	return &message.ExecuteResponse{Results: []*message.ResultSetResponse{result}}, nil
+}
+
+func (s *fakeAvaticaServer) nextFrame(st *fakeAvaticaStatement, frameSize int32) *message.Frame {
+	size := s.frameSize
+	if frameSize > 0 && int(frameSize) < size {
+		size = int(frameSize)
+	}
+	end := st.cursor + size
+	if end > len(st.rows) {
+		end = len(st.rows)
+	}
+	frame := &message.Frame{Offset: uint64(st.cursor), Rows: st.rows[st.cursor:end], Done: end == len(st.rows)}
+	st.cursor = end
+	return frame
+}
+
+// phoenixTypes are the Phoenix types results are reported as, by kind of
+// value SQLite returned.
+var phoenixTypes = map[string]*message.AvaticaType{
+	KindInt64:   {Id: 4294967291, Name: "BIGINT", Rep: message.Rep_LONG}, // java.sql.Types -5 as uint32
+	KindFloat64: {Id: 8, Name: "DOUBLE", Rep: message.Rep_DOUBLE},
+	KindDecimal: {Id: 3, Name: "DECIMAL", Rep: message.Rep_BIG_DECIMAL},
+	KindBool:    {Id: 16, Name: "BOOLEAN", Rep: message.Rep_BOOLEAN},
+	KindString:  {Id: 12, Name: "VARCHAR", Rep: message.Rep_STRING},
+	KindBytes:   {Id: 4294967293, Name: "VARBINARY", Rep: message.Rep_BYTE_STRING},
+	KindTime:    {Id: 93, Name: "TIMESTAMP", Rep: message.Rep_JAVA_SQL_TIMESTAMP},
+}
+
+// avaticaRows reads all of rows, typing each column by its declared type, or
+// for expressions by its first non NULL value.
+func avaticaRows(rows *sql.Rows) ([]*message.ColumnMetaData, []*message.Row, error) {
+	defer rows.Close()
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, nil, err
+	}
+	kinds := make([]string, len(types))
+	for i, ct := range types {
+		kinds[i] = databaseTypeKind(ct.DatabaseTypeName())
+	}
+	vals := make([]interface{}, len(types))
+	dest := make([]interface{}, len(types))
+	for i := range vals {
+		dest[i] = &vals[i]
+	}
+	table := [][]interface{}{}
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return nil, nil, err
+		}
+		for i, v := range vals {
+			if kinds[i] == KindNull && v != nil {
+				kinds[i] = valueKind(v)
+			}
+		}
+		table = append(table, append([]interface{}(nil), vals...))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	columns := make([]*message.ColumnMetaData, len(types))
+	for i, ct := range types {
+		typ, ok := phoenixTypes[kinds[i]]
+		if !ok {
+			typ = phoenixTypes[KindString]
+		}
+		columns[i] = &message.ColumnMetaData{Ordinal: uint32(i), ColumnName: ct.Name(), Label: ct.Name(), Nullable: 1, Type: typ}
+	}
+	result := make([]*message.Row, len(table))
+	for r, vals := range table {
+		row := &message.Row{Value: make([]*message.ColumnValue, len(vals))}
+		for i, v := range vals {
+			row.Value[i] = &message.ColumnValue{ScalarValue: sqliteToTypedValue(v, columns[i].Type.Rep)}
+		}
+		result[r] = row
+	}
+	return columns, result, nil
+}
+
+func sqliteToTypedValue(v interface{}, rep message.Rep) *message.TypedValue {
+	if v == nil {
+		return &message.TypedValue{Type: message.Rep_NULL, Null: true}
+	}
+	tv := &message.TypedValue{Type: rep}
+	switch rep {
+	case message.Rep_LONG:
+		switch v := v.(type) {
+		case int64:
+			tv.NumberValue = v
+		case float64:
+			tv.NumberValue = int64(v)
+		}
+	case message.Rep_DOUBLE:
+		switch v := v.(type) {
+		case float64:
+			tv.DoubleValue = v
+		case int64:
+			tv.DoubleValue = float64(v)
+		}
+	case message.Rep_BOOLEAN:
+		switch v := v.(type) {
+		case bool:
+			tv.BoolValue = v
+		case int64:
+			tv.BoolValue = v != 0
+		}
+	case message.Rep_BYTE_STRING:
+		tv.BytesValue, _ = v.([]byte)
+	case message.Rep_JAVA_SQL_TIMESTAMP:
+		if t, ok := v.(time.Time); ok {
+			tv.NumberValue = t.UnixMilli()
+		}
+	case message.Rep_BIG_DECIMAL:
+		tv.StringValue, _ = copyValue(v, KindDecimal).(string)
+	default:
+		tv.StringValue = formatCSVValue(v)
+	}
+	return tv
+}
+
+func typedValueToSQLite(v *message.TypedValue) interface{} {
+	switch v.Type {
+	case message.Rep_NULL:
+		return nil
+	case message.Rep_BOOLEAN, message.Rep_PRIMITIVE_BOOLEAN:
+		return v.BoolValue
+	case message.Rep_DOUBLE, message.Rep_PRIMITIVE_DOUBLE, message.Rep_FLOAT, message.Rep_PRIMITIVE_FLOAT:
+		return v.DoubleValue
+	case message.Rep_STRING, message.Rep_BIG_DECIMAL, message.Rep_CHARACTER:
+		return v.StringValue
+	case message.Rep_BYTE_STRING:
+		return v.BytesValue
+	case message.Rep_JAVA_SQL_TIMESTAMP:
+		return time.UnixMilli(v.NumberValue).UTC()
+	}
+	return v.NumberValue
+}
+
+// countPlaceholders counts the ? parameters outside quotes.
+func countPlaceholders(query string) int {
+	n := 0
+	var quote rune
+	for _, r := range query {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case r == '?':
+			n++
+		}
+	}
+	return n
+}
+
+// startFakePhoenix serves the USERS database, with a fake SYSTEM.CATALOG
+// attached, over Avatica and returns its URL and the database behind it.
+func startFakePhoenix(t *testing.T) (string, *sql.DB) {
+	fake, db := newFakePhoenix(t)
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	return server.URL, db
+}
+
+// newFakePhoenix is startFakePhoenix's server before it is started.
+func newFakePhoenix(t *testing.T) (*fakeAvaticaServer, *sql.DB) {
+	db := openUsersDB(t)
+	system := filepath.Join(t.TempDir(), "system.db")
+	attach := func(ctx context.Context, conn *sql.Conn) error {
+		var attached int
+		err := conn.QueryRowContext(ctx, `SELECT COUNT(1) FROM pragma_database_list WHERE name = 'SYSTEM'`).Scan(&attached)
+		if err == nil && attached == 0 {
+			_, err = conn.ExecContext(ctx, `ATTACH DATABASE $1 AS SYSTEM`, system)
+		}
+		return err
+	}
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := attach(context.Background(), conn); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.ExecContext(context.Background(), fakePhoenixCatalogSQL); err != nil {
+		t.Fatal("Could not create SYSTEM.CATALOG: ", err)
+	}
+	conn.Close()
+
+	fake := newFakeAvaticaServer(db)
+	fake.onConnect = attach
+	return fake, db
+}
+
+// flakyAvaticaHandler drops the connection instead of passing on requests, as
+// a proxy or a restarting server might: failures[name] of the named request,
+// e.g. "CommitRequest", then those after. The driver sees an EOF. With
+// unavailable set it answers them with a proxy's 503 page instead.
+type flakyAvaticaHandler struct {
+	next        http.Handler
+	unavailable bool
+
+	mu       sync.Mutex
+	failures map[string]int
+	dropped  map[string]int
+}
+
+func (h *flakyAvaticaHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	wire := &message.WireMessage{}
+	proto.Unmarshal(body, wire)
+	name := strings.TrimPrefix(wire.Name, avaticaRequestPrefix)
+
+	h.mu.Lock()
+	drop := h.failures[name] > 0
+	if drop {
+		h.failures[name]--
+		if h.dropped == nil {
+			h.dropped = map[string]int{}
+		}
+		h.dropped[name]++
+	}
+	h.mu.Unlock()
+	if drop && h.unavailable {
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		io.WriteString(w, "<html><body><h1>503 Service Unavailable</h1>No server is available to handle this request.</body></html>")
+		return
+	}
+	if drop {
+		panic(http.ErrAbortHandler)
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	h.next.ServeHTTP(w, r)
+}
+
+// openFakePhoenix opens the avatica driver on a fake Phoenix.
+func openFakePhoenix(t *testing.T) *sql.DB {
+	url, _ := startFakePhoenix(t)
+	db, err := sql.Open("avatica", url)
+	if err != nil {
+		t.Fatal("Could not open DB: ", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestFakeAvaticaServer(t *testing.T) {
+	url, backing := startFakePhoenix(t)
+	db, err := sql.Open("avatica", url+"?frameMaxSize=2")
+	if err != nil {
+		t.Fatal("Could not open DB: ", err)
+	}
+	defer db.Close()
+	if err := db.Ping(); err != nil {
+		t.Fatal("Could not ping DB: ", err)
+	}
+
+	// Without parameters statements go through prepareAndExecute, with
+	// parameters through prepare and execute
+	result, err := db.Exec(`INSERT INTO USERS (email, password, first_name, last_name, is_active) VALUES ('arunsworld@gmail.com', 'x', 'Arun', 'Barua', 1)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := result.RowsAffected(); n != 1 {
+		t.Error("Expected 1 row affected. Got:", n)
+	}
+	for i := 1; i <= 4; i++ {
+		_, err := db.Exec(`INSERT INTO USERS (email, password, first_name, last_name, is_active) VALUES (?, ?, ?, ?, ?)`,
+			fmt.Sprintf("user%d@example.com", i), []byte("x"), "User", "", i%2 == 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 5 rows in frames of 2 need two fetches
+	rows, err := db.Query(`SELECT id, email, is_active, NULLIF(last_name, '') AS last_name, id / 2.0 AS half FROM USERS ORDER BY id`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ScanMaps(rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 5 {
+		t.Fatal("Expected 5 rows. Got:", len(data))
+	}
+	first, last := data[0], data[4]
+	if first["id"] != int64(1) || first["email"] != "arunsworld@gmail.com" || first["is_active"] != true || first["last_name"] != "Barua" {
+		t.Errorf("Unexpected first row: %#v", first)
+	}
+	if last["is_active"] != true || last["last_name"] != nil || last["half"] != 2.5 {
+		t.Errorf("Unexpected last row: %#v", last)
+	}
+
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(1) FROM USERS WHERE first_name = ? AND is_active = ?`, "User", false).Scan(&count); err != nil || count != 2 {
+		t.Errorf("Expected 2 inactive users. Got %d, %v", count, err)
+	}
+
+	// Phoenix's UPSERT replaces the row with the same key
+	if _, err := db.Exec(`UPSERT INTO USERS (id, email, password, first_name, last_name, is_active) VALUES (1, 'arun@e2open.com', 'x', 'Arun', 'Barua', 0)`); err != nil {
+		t.Fatal(err)
+	}
+	var email string
+	backing.QueryRow(`SELECT email FROM USERS WHERE id = 1`).Scan(&email)
+	if email != "arun@e2open.com" {
+		t.Error("Expected the upsert to replace the row. Got:", email)
+	}
+
+	if _, err := db.Exec(`SELECT nonsense FROM USERS`); err == nil || !strings.Contains(err.Error(), "no such column: nonsense") {
+		t.Error("Expected the SQLite error to come through. Got:", err)
+	}
+}
+
+func TestFakeAvaticaTransactions(t *testing.T) {
+	url, backing := startFakePhoenix(t)
+	db, err := sql.Open("avatica", url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	count := func() int {
+		var n int
+		backing.QueryRow(`SELECT COUNT(1) FROM USERS`).Scan(&n)
+		return n
+	}
+	insert := func(tx *sql.Tx, email string) {
+		_, err := tx.Exec(`UPSERT INTO USERS (email, password, first_name, last_name, is_active) VALUES (?, 'x', 'Arun', 'Barua', true)`, email)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	insert(tx, "rolled@back.com")
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(); n != 0 {
+		t.Error("Expected the rollback to discard the insert. Users:", n)
+	}
+
+	tx, _ = db.Begin()
+	insert(tx, "one@example.com")
+	insert(tx, "two@example.com")
+	if n := count(); n != 0 {
+		t.Error("Expected nothing visible before commit. Users:", n)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(); n != 2 {
+		t.Error("Expected 2 users after commit. Got:", n)
+	}
+}
+
+func TestFakeAvaticaRunsPhoenixHelpers(t *testing.T) {
+	db := openFakePhoenix(t)
+	cols := getColumnsFromTable(t, db, "SYSTEM.CATALOG")
+	if strings.Join(cols, ",") != "TENANT_ID,TABLE_SCHEM,TABLE_NAME,COLUMN_NAME,COLUMN_FAMILY" {
+		t.Error("Unexpected SYSTEM.CATALOG columns:", cols)
+	}
+	users, err := newPhoenixInspector(db).Table("USERS")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users.Columns) != 3 || users.Attributes["SALT_BUCKETS"] != "8" || fmt.Sprint(users.Indexes) != "[{USERS_EMAIL_IDX false [EMAIL ID]}]" {
+		t.Errorf("Unexpected USERS over avatica: %+v", users)
+	}
+	result := genericQuery(t, db, `select TABLE_SCHEM, TABLE_NAME, SALT_BUCKETS, DISABLE_WAL from SYSTEM.CATALOG where COLUMN_NAME is null and TABLE_TYPE = 'u'`)
+	if fmt.Sprint(result) != "[[TABLE_SCHEM TABLE_NAME SALT_BUCKETS DISABLE_WAL] [ USERS 8 true]]" {
+		t.Error("Unexpected generic query result:", result)
+	}
+}
+
+func TestFakeAvaticaRejectsDuplicateConnections(t *testing.T) {
+	fake, backing := newFakePhoenix(t)
+	open := func() error {
+		req, _ := proto.Marshal(&message.OpenConnectionRequest{ConnectionId: "one"})
+		_, err := fake.handle(context.Background(), "OpenConnectionRequest", req)
+		return err
+	}
+	if err := open(); err != nil {
+		t.Fatal(err)
+	}
+	if err := open(); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Error("Expected a second connection with the same id to be rejected. Got:", err)
+	}
+	if inUse := backing.Stats().InUse; inUse != 1 {
+		t.Error("Expected only the first connection to be held. In use:", inUse)
+	}
+	req, _ := proto.Marshal(&message.CloseConnectionRequest{ConnectionId: "one"})
+	if _, err := fake.handle(context.Background(), "CloseConnectionRequest", req); err != nil {
+		t.Error(err)
+	}
+}
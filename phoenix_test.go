@@ -11,11 +11,14 @@ import (
 
 func TestOpenAndPingAWSDB(t *testing.T) {
 
+	// Without HDP Lab the test runs against a fake Phoenix on SQLite.
+	// Set the PHOENIX_AVAILABLE flag to run it when HDP Lab is accessible.
+	url := "http://172.16.3.196:8765"
 	if os.Getenv("PHOENIX_AVAILABLE") == "" {
-		t.Skip("Set the PHOENIX_AVAILABLE flag to run this test when HDP Lab is accessible.")
+		url, _ = startFakePhoenix(t)
 	}
 
-	db, err := sql.Open("avatica", "http://172.16.3.196:8765")
+	db, err := sql.Open("avatica", url)
 	if err != nil {
 		t.Error("Could not open DB: ", err)
 		return
@@ -28,6 +31,10 @@ func TestOpenAndPingAWSDB(t *testing.T) {
 		return
 	}
 
+	if cols := getColumnsFromTable(t, db, "SYSTEM.CATALOG"); len(cols) == 0 {
+		t.Error("Expected SYSTEM.CATALOG to have columns")
+	}
+
 	// queryAndPrintSingleValueResults(t, db, `select DISTINCT("TABLE_NAME") from SYSTEM.CATALOG`)
 	// queryAndPrintSingleValueResults(t, db, `select COUNT(1) from POS_TRANSACTION_ZYMECUSTOMER`)
 	// cols := getColumnsFromTable(t, db, "SYSTEM.CATALOG")
@@ -57,43 +64,48 @@ func queryAndPrintSingleValueResults(t *testing.T, db *sql.DB, query string) {
 	}
 }
 
+// getColumnsFromTable lists the columns of table, named SCHEMA.TABLE, from SYSTEM.CATALOG.
 func getColumnsFromTable(t *testing.T, db *sql.DB, table string) []string {
-	rows, err := db.Query(fmt.Sprintf(`select * from %s LIMIT 1`, table))
+	info, err := newPhoenixInspector(db).Table(table)
 	if err != nil {
-		t.Fatal("Error creating query: ", err)
+		t.Fatal("Error describing table: ", err)
 	}
-	defer rows.Close()
-
-	cols, err := rows.Columns()
-	if err != nil {
-		t.Fatal("Error getting columns: ", err)
+	cols := make([]string, len(info.Columns))
+	for i, c := range info.Columns {
+		cols[i] = c.Name
 	}
 	return cols
 }
 
+// genericQuery returns the columns of query followed by its rows, with every
+// value as a string and NULL as an empty one.
 func genericQuery(t *testing.T, db *sql.DB, query string) [][]string {
 	rows, err := db.Query(query)
 	if err != nil {
 		t.Fatal("Error creating query: ", err)
 	}
-	defer rows.Close()
-
 	cols, err := rows.Columns()
 	if err != nil {
+		rows.Close()
 		t.Fatal("Error getting columns: ", err)
 	}
-	vals := make([]interface{}, len(cols))
-	for i := range cols {
-		vals[i] = new(sql.RawBytes)
+	values, err := ScanSlices(rows)
+	if err != nil {
+		t.Fatal("Error reading rows: ", err)
 	}
+
 	result := [][]string{}
 	result = append(result, cols)
-	for rows.Next() {
-		err = rows.Scan(vals...)
+	for _, vals := range values {
 		newRow := make([]string, len(cols))
 		for i, v := range vals {
-			vv := v.(*sql.RawBytes)
-			newRow[i] = string(*vv)
+			switch v := v.(type) {
+			case nil:
+			case []byte:
+				newRow[i] = string(v)
+			default:
+				newRow[i] = fmt.Sprint(v)
+			}
 		}
 		result = append(result, newRow)
 	}
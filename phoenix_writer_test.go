@@ -0,0 +1,529 @@
+package learning
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// PhoenixWriter loads rows into a Phoenix table with UPSERT INTO. It buffers
+// rows and writes them in batches of one transaction each, when a batch is
+// full or its first row has waited FlushInterval. A batch failing with a
+// transient error, such as the Phoenix Query Server being unreachable, is
+// retried; UPSERT makes writing a row twice harmless. Rows Phoenix rejects
+// are reported in a *BatchError while the rest of their batch is committed,
+// as are rows of a batch still failing after its retries. Those may have been
+// written if it was the commit that failed, its outcome unknown.
+//
+// A batch written in the background reports its errors from the next call
+// to Write, Flush or Close. PhoenixWriter is safe for concurrent use.
+type PhoenixWriter struct {
+	db      *sql.DB
+	upsert  string
+	columns int
+	options PhoenixWriterOptions
+
+	// flushMu is held while writing batches, keeping them in order, and mu
+	// only while the fields below change, so rows can be buffered meanwhile
+	flushMu  sync.Mutex
+	mu       sync.Mutex
+	buffer   [][]interface{}
+	timer    *time.Timer
+	timerGen int64   // tells a timer that fired from the one now running
+	pending  []error // from batches written in the background
+	stats    PhoenixWriterStats
+	closed   bool
+}
+
+type PhoenixWriterOptions struct {
+	BatchSize     int           // rows per transaction, 500 by default
+	FlushInterval time.Duration // longest a row waits to be written, 1s by default
+	// MaxRetries is how many times a batch is retried after transient errors,
+	// 3 by default, or none if negative. Retries back off exponentially
+	// from Backoff, 100ms by default, to MaxBackoff, 5s by default.
+	MaxRetries int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Retryable decides which errors are transient, isTransientPhoenixError
+	// by default.
+	Retryable func(error) bool
+}
+
+type PhoenixWriterStats struct {
+	Rows    int64 // written
+	Failed  int64
+	Batches int64
+	Retries int64
+}
+
+// RowError is a row that could not be written.
+type RowError struct {
+	Row []interface{}
+	Err error
+}
+
+func (e RowError) Error() string {
+	return fmt.Sprintf("row %v: %v", e.Row, e.Err)
+}
+
+func (e RowError) Unwrap() error {
+	return e.Err
+}
+
+// BatchError reports the rows of a batch that could not be written. The other
+// rows in the batch were.
+type BatchError struct {
+	Rows  []RowError
+	Batch int // rows in the batch
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("%d of %d rows not written, the first %v", len(e.Rows), e.Batch, e.Rows[0])
+}
+
+func (e *BatchError) Unwrap() []error {
+	errs := make([]error, len(e.Rows))
+	for i, row := range e.Rows {
+		errs[i] = row
+	}
+	return errs
+}
+
+// NewPhoenixWriter writes to the columns of table, which may be SCHEMA.TABLE.
+// Names are as Phoenix stores them, usually upper case.
+func NewPhoenixWriter(db *sql.DB, table string, columns []string, options PhoenixWriterOptions) *PhoenixWriter {
+	if options.BatchSize <= 0 {
+		options.BatchSize = 500
+	}
+	if options.FlushInterval <= 0 {
+		options.FlushInterval = time.Second
+	}
+	if options.MaxRetries == 0 {
+		options.MaxRetries = 3
+	}
+	if options.Backoff <= 0 {
+		options.Backoff = 100 * time.Millisecond
+	}
+	if options.MaxBackoff <= 0 {
+		options.MaxBackoff = 5 * time.Second
+	}
+	if options.Retryable == nil {
+		options.Retryable = isTransientPhoenixError
+	}
+	target := TableInfo{}
+	target.Schema, target.Name = splitQualifiedName(table)
+	names := make([]string, len(columns))
+	for i, col := range columns {
+		names[i] = quoteIdentifier(col)
+	}
+	return &PhoenixWriter{
+		db:      db,
+		upsert:  fmt.Sprintf("UPSERT INTO %s (%s) VALUES (%s)", target.QualifiedName(), strings.Join(names, ", "), strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ")),
+		columns: len(columns),
+		options: options,
+	}
+}
+
+// garbledAvaticaResponse matches the errors of the avatica driver reading a
+// response that isn't Avatica's protobuf, such as a proxy's 502 or 503 page.
+// The driver ignores the HTTP status and has no way to wrap its transport, so
+// these errors are all there is to go by.
+var garbledAvaticaResponse = regexp.MustCompile(`^(proto: |Unable to create response from the string)`)
+
+// isTransientPhoenixError is true of errors reaching the Phoenix Query Server,
+// of responses from something other than it, and of its connection being
+// gone, which database/sql retries elsewhere but not in a transaction. Errors
+// from Phoenix itself aren't transient.
+func isTransientPhoenixError(err error) bool {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		err = urlErr.Err
+	}
+	var netErr net.Error
+	return errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &netErr) ||
+		garbledAvaticaResponse.MatchString(err.Error())
+}
+
+// Write buffers a row of values for the writer's columns, writing the batch
+// if it is full.
+func (w *PhoenixWriter) Write(values ...interface{}) error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return errors.New("phoenix writer is closed")
+	}
+	if len(values) != w.columns {
+		w.mu.Unlock()
+		return fmt.Errorf("%d values for %d columns", len(values), w.columns)
+	}
+	w.buffer = append(w.buffer, append([]interface{}(nil), values...))
+	if len(w.buffer) == 1 {
+		w.timerGen++
+		gen := w.timerGen
+		w.timer = time.AfterFunc(w.options.FlushInterval, func() { w.flushInBackground(gen) })
+	}
+	full := len(w.buffer) >= w.options.BatchSize
+	pending := w.takePending()
+	w.mu.Unlock()
+	if !full {
+		return pending
+	}
+	w.flushMu.Lock()
+	defer w.flushMu.Unlock()
+	return errors.Join(pending, w.flush(false))
+}
+
+// Flush writes the buffered rows.
+func (w *PhoenixWriter) Flush() error {
+	w.flushMu.Lock()
+	defer w.flushMu.Unlock()
+	err := w.flush(true)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return errors.Join(w.takePending(), err)
+}
+
+// Close flushes the writer. Writing after Close is an error.
+func (w *PhoenixWriter) Close() error {
+	w.mu.Lock()
+	w.closed = true
+	w.mu.Unlock()
+	return w.Flush()
+}
+
+func (w *PhoenixWriter) Stats() PhoenixWriterStats {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.stats
+}
+
+// flushInBackground flushes the rows the timer of generation gen was started
+// for, unless they have been already and the timer fired while they were.
+func (w *PhoenixWriter) flushInBackground(gen int64) {
+	w.flushMu.Lock()
+	defer w.flushMu.Unlock()
+	w.mu.Lock()
+	stale := w.timer == nil || gen != w.timerGen
+	w.mu.Unlock()
+	if stale {
+		return
+	}
+	if err := w.flush(true); err != nil {
+		w.mu.Lock()
+		w.pending = append(w.pending, err)
+		w.mu.Unlock()
+	}
+}
+
+// takePending is called with mu held.
+func (w *PhoenixWriter) takePending() error {
+	err := errors.Join(w.pending...)
+	w.pending = nil
+	return err
+}
+
+// flush writes full batches from the buffer, and with all the rest too. It is
+// called with flushMu held and takes mu only to take rows and count them.
+func (w *PhoenixWriter) flush(all bool) error {
+	var errs []error
+	for {
+		w.mu.Lock()
+		if len(w.buffer) == 0 || !all && len(w.buffer) < w.options.BatchSize {
+			w.mu.Unlock()
+			return errors.Join(errs...)
+		}
+		n := len(w.buffer)
+		if n > w.options.BatchSize {
+			n = w.options.BatchSize
+		}
+		rows := w.buffer[:n:n]
+		w.buffer = append([][]interface{}(nil), w.buffer[n:]...)
+		if len(w.buffer) == 0 && w.timer != nil {
+			w.timer.Stop()
+			w.timer = nil
+		}
+		w.mu.Unlock()
+
+		failed := w.writeWithRetries(rows)
+		w.mu.Lock()
+		w.stats.Batches++
+		w.stats.Rows += int64(len(rows) - len(failed))
+		w.stats.Failed += int64(len(failed))
+		w.mu.Unlock()
+		if len(failed) > 0 {
+			errs = append(errs, &BatchError{Rows: failed, Batch: len(rows)})
+		}
+	}
+}
+
+// writeWithRetries writes rows, retrying transient errors, and returns the
+// rows that could not be written.
+func (w *PhoenixWriter) writeWithRetries(rows [][]interface{}) []RowError {
+	backoff := w.options.Backoff
+	for attempt := 0; ; attempt++ {
+		failed, err := w.writeBatch(rows)
+		if err == nil {
+			return failed
+		}
+		if attempt >= w.options.MaxRetries || !w.options.Retryable(err) {
+			failed = make([]RowError, len(rows))
+			for i, row := range rows {
+				failed[i] = RowError{Row: row, Err: err}
+			}
+			return failed
+		}
+		w.mu.Lock()
+		w.stats.Retries++
+		w.mu.Unlock()
+		// Jitter keeps writers that failed together from retrying together
+		time.Sleep(backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1)))
+		if backoff *= 2; backoff > w.options.MaxBackoff {
+			backoff = w.options.MaxBackoff
+		}
+	}
+}
+
+// writeBatch returns the rows Phoenix rejected, or an error if the batch as a
+// whole failed.
+func (w *PhoenixWriter) writeBatch(rows [][]interface{}) ([]RowError, error) {
+	tx, err := w.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	stmt, err := tx.Prepare(w.upsert)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	defer stmt.Close()
+	var failed []RowError
+	for _, row := range rows {
+		if _, err := stmt.Exec(row...); err != nil {
+			if w.options.Retryable(err) {
+				tx.Rollback()
+				return nil, err
+			}
+			failed = append(failed, RowError{Row: row, Err: err})
+		}
+	}
+	return failed, tx.Commit()
+}
+
+func openPhoenixWriterDB(t *testing.T, failures map[string]int) (*sql.DB, *sql.DB, *flakyAvaticaHandler) {
+	fake, backing := newFakePhoenix(t)
+	flaky := &flakyAvaticaHandler{next: fake, failures: failures}
+	server := httptest.NewServer(flaky)
+	t.Cleanup(server.Close)
+	db, err := sql.Open("avatica", server.URL)
+	if err != nil {
+		t.Fatal("Could not open DB: ", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db, backing, flaky
+}
+
+var phoenixWriterColumns = []string{"EMAIL", "PASSWORD", "FIRST_NAME", "LAST_NAME", "IS_ACTIVE"}
+
+func countUsers(t *testing.T, db *sql.DB) int {
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(1) FROM USERS`).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestPhoenixWriterBatches(t *testing.T) {
+	db, backing, _ := openPhoenixWriterDB(t, nil)
+	w := NewPhoenixWriter(db, "USERS", phoenixWriterColumns, PhoenixWriterOptions{BatchSize: 3, FlushInterval: time.Hour})
+	for i := 0; i < 7; i++ {
+		if err := w.Write(fmt.Sprintf("user%d@example.com", i), "x", "User", "", true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := countUsers(t, backing); n != 6 {
+		t.Error("Expected 2 full batches written. Users:", n)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := countUsers(t, backing); n != 7 {
+		t.Error("Expected Close to write the rest. Users:", n)
+	}
+	if stats := w.Stats(); stats != (PhoenixWriterStats{Rows: 7, Batches: 3}) {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+	if err := w.Write("late@example.com", "x", "Late", "", true); err == nil {
+		t.Error("Expected writing after Close to fail")
+	}
+
+	// UPSERT replaces rows with the same key
+	w = NewPhoenixWriter(db, "USERS", append([]string{"ID"}, phoenixWriterColumns...), PhoenixWriterOptions{})
+	w.Write(int64(1), "arun@e2open.com", "x", "Arun", "Barua", false)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var email string
+	backing.QueryRow(`SELECT email FROM USERS WHERE id = 1`).Scan(&email)
+	if email != "arun@e2open.com" || countUsers(t, backing) != 7 {
+		t.Error("Expected user 1 to be replaced. Got:", email)
+	}
+}
+
+func TestPhoenixWriterFlushInterval(t *testing.T) {
+	db, backing, _ := openPhoenixWriterDB(t, nil)
+	w := NewPhoenixWriter(db, "USERS", phoenixWriterColumns, PhoenixWriterOptions{BatchSize: 100, FlushInterval: 20 * time.Millisecond})
+	defer w.Close()
+	w.Write("arunsworld@gmail.com", "x", "Arun", "Barua", true)
+	w.Write("arun@e2open.com", "x", "Arun", "Barua", true)
+	deadline := time.Now().Add(2 * time.Second)
+	for w.Stats().Rows != 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the rows written after the flush interval")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stats := w.Stats(); stats.Batches != 1 {
+		t.Errorf("Expected one batch. Got: %+v", stats)
+	}
+	if n := countUsers(t, backing); n != 2 {
+		t.Error("Expected 2 users. Got:", n)
+	}
+}
+
+func TestPhoenixWriterRetriesTransientErrors(t *testing.T) {
+	db, backing, flaky := openPhoenixWriterDB(t, map[string]int{"ExecuteRequest": 1, "CommitRequest": 1})
+	w := NewPhoenixWriter(db, "USERS", phoenixWriterColumns, PhoenixWriterOptions{BatchSize: 10, Backoff: time.Millisecond})
+	for i := 0; i < 3; i++ {
+		w.Write(fmt.Sprintf("user%d@example.com", i), "x", "User", "", true)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := countUsers(t, backing); n != 3 {
+		t.Error("Expected 3 users after retries. Got:", n)
+	}
+	if stats := w.Stats(); stats != (PhoenixWriterStats{Rows: 3, Batches: 1, Retries: 2}) {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+	if flaky.dropped["ExecuteRequest"] != 1 || flaky.dropped["CommitRequest"] != 1 {
+		t.Error("Expected an execute and a commit to fail. Got:", flaky.dropped)
+	}
+
+	// Retries run out
+	flaky.mu.Lock()
+	flaky.failures["ExecuteRequest"] = 10
+	flaky.mu.Unlock()
+	w = NewPhoenixWriter(db, "USERS", phoenixWriterColumns, PhoenixWriterOptions{MaxRetries: 2, Backoff: time.Millisecond})
+	w.Write("lost@example.com", "x", "Lost", "", true)
+	err := w.Close()
+	batchErr := &BatchError{}
+	if !errors.As(err, &batchErr) || len(batchErr.Rows) != 1 || !isTransientPhoenixError(batchErr.Rows[0].Err) {
+		t.Fatal("Expected the row to fail with a transient error. Got:", err)
+	}
+	if stats := w.Stats(); stats != (PhoenixWriterStats{Failed: 1, Batches: 1, Retries: 2}) {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+	if n := countUsers(t, backing); n != 3 {
+		t.Error("Expected no more users. Got:", n)
+	}
+}
+
+func TestPhoenixWriterRetriesUnavailableServer(t *testing.T) {
+	db, backing, flaky := openPhoenixWriterDB(t, map[string]int{"ExecuteRequest": 2})
+	flaky.unavailable = true
+	w := NewPhoenixWriter(db, "USERS", phoenixWriterColumns, PhoenixWriterOptions{Backoff: time.Millisecond})
+	w.Write("arunsworld@gmail.com", "x", "Arun", "Barua", true)
+	if err := w.Close(); err != nil {
+		t.Fatal("Expected the 503s to be retried. Got:", err)
+	}
+	if n := countUsers(t, backing); n != 1 {
+		t.Error("Expected the user written. Got:", n)
+	}
+	if stats := w.Stats(); stats.Retries != 2 {
+		t.Errorf("Expected 2 retries. Got: %+v", stats)
+	}
+}
+
+func TestPhoenixWriterBuffersWhileRetrying(t *testing.T) {
+	db, backing, flaky := openPhoenixWriterDB(t, map[string]int{"ExecuteRequest": 1})
+	w := NewPhoenixWriter(db, "USERS", phoenixWriterColumns, PhoenixWriterOptions{BatchSize: 2, FlushInterval: time.Hour, Backoff: time.Second})
+	w.Write("user0@example.com", "x", "User", "", true)
+	flushed := make(chan error)
+	go func() {
+		flushed <- w.Write("user1@example.com", "x", "User", "", true)
+	}()
+	for {
+		flaky.mu.Lock()
+		dropped := flaky.dropped["ExecuteRequest"]
+		flaky.mu.Unlock()
+		if dropped == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// The first batch is backing off; rows still go into the buffer
+	start := time.Now()
+	w.Write("user2@example.com", "x", "User", "", true)
+	w.Stats()
+	if waited := time.Since(start); waited > 200*time.Millisecond {
+		t.Error("Expected Write not to wait for the retry. Waited:", waited)
+	}
+	if err := <-flushed; err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := backing.Query(`SELECT email FROM USERS ORDER BY id`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	emails, err := ScanSlices(rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(emails) != "[[user0@example.com] [user1@example.com] [user2@example.com]]" {
+		t.Error("Expected the rows in the order written. Got:", emails)
+	}
+}
+
+func TestPhoenixWriterReportsRowFailures(t *testing.T) {
+	db, backing, _ := openPhoenixWriterDB(t, nil)
+	w := NewPhoenixWriter(db, "USERS", phoenixWriterColumns, PhoenixWriterOptions{BatchSize: 4, FlushInterval: time.Hour})
+	if err := w.Write("short@example.com", "x"); err == nil || err.Error() != "2 values for 5 columns" {
+		t.Error("Expected a row of the wrong length to be rejected. Got:", err)
+	}
+	w.Write("arunsworld@gmail.com", "x", "Arun", "Barua", true)
+	w.Write(nil, "x", "No", "Email", true)
+	w.Write("arun@e2open.com", "x", "Arun", "Barua", true)
+	err := w.Write("abarua@zyme.com", "x", nil, "Barua", true)
+
+	batchErr := &BatchError{}
+	if !errors.As(err, &batchErr) || batchErr.Batch != 4 || len(batchErr.Rows) != 2 {
+		t.Fatal("Expected 2 of 4 rows to fail. Got:", err)
+	}
+	if batchErr.Rows[0].Row[2] != "No" || !strings.Contains(batchErr.Rows[0].Err.Error(), "NOT NULL constraint failed: USERS.email") {
+		t.Error("Unexpected first failure:", batchErr.Rows[0])
+	}
+	if batchErr.Rows[1].Row[0] != "abarua@zyme.com" {
+		t.Error("Unexpected second failure:", batchErr.Rows[1])
+	}
+	if n := countUsers(t, backing); n != 2 {
+		t.Error("Expected the other 2 rows written. Users:", n)
+	}
+	if stats := w.Stats(); stats != (PhoenixWriterStats{Rows: 2, Failed: 2, Batches: 1}) {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
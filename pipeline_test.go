@@ -0,0 +1,467 @@
+package learning
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Pipeline connects stages, each running in its own goroutines and joined by
+// channels. The first stage error cancels the pipeline's context, which every
+// stage watches, so the whole pipeline winds down; Wait returns that error.
+type Pipeline struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu     sync.Mutex
+	err    error
+	stages []*stageCounters
+
+	waitOnce sync.Once
+	result   error
+}
+
+// Stream is the output of a stage and the input of the next.
+type Stream[T any] struct {
+	p  *Pipeline
+	ch <-chan T
+}
+
+// StageStats reports how much a stage has processed. Throughput is items out
+// per second of the stage's running time.
+type StageStats struct {
+	Name       string
+	In         uint64
+	Out        uint64
+	Elapsed    time.Duration
+	Throughput float64
+}
+
+type stageCounters struct {
+	name     string
+	in       atomic.Uint64
+	out      atomic.Uint64
+	started  time.Time
+	finished atomic.Int64 // unix nanos, 0 while running
+}
+
+type stageConfig struct {
+	buffer      int
+	concurrency int
+}
+
+// StageOption tunes a single stage.
+type StageOption func(*stageConfig)
+
+// StageBuffer sets the buffer of the channel a stage writes to. The default is unbuffered.
+func StageBuffer(n int) StageOption {
+	return func(cfg *stageConfig) {
+		cfg.buffer = n
+	}
+}
+
+// StageConcurrency runs a stage on n goroutines. Output order is then no
+// longer guaranteed. The default is 1.
+func StageConcurrency(n int) StageOption {
+	return func(cfg *stageConfig) {
+		cfg.concurrency = n
+	}
+}
+
+func NewPipeline(ctx context.Context) *Pipeline {
+	ctx, cancel := context.WithCancel(ctx)
+	return &Pipeline{ctx: ctx, cancel: cancel}
+}
+
+// Wait blocks until every stage has finished and returns the first error, or
+// the parent context's error if it ended the pipeline. Every call returns the
+// same result.
+func (p *Pipeline) Wait() error {
+	p.wg.Wait()
+	p.waitOnce.Do(func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.result = p.err
+		if p.result == nil {
+			p.result = p.ctx.Err()
+		}
+		p.cancel()
+	})
+	return p.result
+}
+
+// Stats reports on every stage in the order they were added.
+func (p *Pipeline) Stats() []StageStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	result := make([]StageStats, len(p.stages))
+	for i, s := range p.stages {
+		end := time.Now()
+		if f := s.finished.Load(); f != 0 {
+			end = time.Unix(0, f)
+		}
+		st := StageStats{Name: s.name, In: s.in.Load(), Out: s.out.Load(), Elapsed: end.Sub(s.started)}
+		if st.Elapsed > 0 {
+			st.Throughput = float64(st.Out) / st.Elapsed.Seconds()
+		}
+		result[i] = st
+	}
+	return result
+}
+
+func (p *Pipeline) fail(stage string, err error) {
+	p.mu.Lock()
+	if p.err == nil {
+		p.err = fmt.Errorf("stage %s: %w", stage, err)
+	}
+	p.mu.Unlock()
+	p.cancel()
+}
+
+// stage starts workers goroutines running fn and closes out once they are
+// all done.
+func stage[T any](p *Pipeline, name string, opts []StageOption, fn func(c *stageCounters, out chan<- T) error) Stream[T] {
+	cfg := stageConfig{concurrency: 1}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	c := &stageCounters{name: name, started: time.Now()}
+	p.mu.Lock()
+	p.stages = append(p.stages, c)
+	p.mu.Unlock()
+
+	out := make(chan T, cfg.buffer)
+	workers := sync.WaitGroup{}
+	for i := 0; i < cfg.concurrency; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			if err := fn(c, out); err != nil {
+				p.fail(name, err)
+			}
+		}()
+	}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		workers.Wait()
+		c.finished.Store(time.Now().UnixNano())
+		close(out)
+	}()
+	return Stream[T]{p: p, ch: out}
+}
+
+// send delivers v unless the pipeline is cancelled first.
+func send[T any](ctx context.Context, c *stageCounters, out chan<- T, v T) bool {
+	select {
+	case out <- v:
+		c.out.Add(1)
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Source starts the pipeline with items produced by gen. gen should stop
+// when emit returns false, which means the pipeline was cancelled.
+func Source[T any](p *Pipeline, name string, gen func(ctx context.Context, emit func(T) bool) error, opts ...StageOption) Stream[T] {
+	return stage(p, name, opts, func(c *stageCounters, out chan<- T) error {
+		return gen(p.ctx, func(v T) bool {
+			return send(p.ctx, c, out, v)
+		})
+	})
+}
+
+// Map transforms every item with fn.
+func Map[In, Out any](s Stream[In], name string, fn func(ctx context.Context, v In) (Out, error), opts ...StageOption) Stream[Out] {
+	p := s.p
+	return stage(p, name, opts, func(c *stageCounters, out chan<- Out) error {
+		for v := range s.ch {
+			c.in.Add(1)
+			result, err := fn(p.ctx, v)
+			if err != nil {
+				return err
+			}
+			if !send(p.ctx, c, out, result) {
+				return nil
+			}
+		}
+		return nil
+	})
+}
+
+// Filter passes on the items for which keep returns true.
+func Filter[T any](s Stream[T], name string, keep func(v T) bool, opts ...StageOption) Stream[T] {
+	p := s.p
+	return stage(p, name, opts, func(c *stageCounters, out chan<- T) error {
+		for v := range s.ch {
+			c.in.Add(1)
+			if keep(v) && !send(p.ctx, c, out, v) {
+				return nil
+			}
+		}
+		return nil
+	})
+}
+
+// Batch groups items into slices of size, flushing a partial batch when the
+// input ends or, if maxWait > 0, when the oldest item has waited that long.
+// size must be positive.
+func Batch[T any](s Stream[T], name string, size int, maxWait time.Duration, opts ...StageOption) Stream[[]T] {
+	if size <= 0 {
+		panic("pipeline: batch size must be positive")
+	}
+	p := s.p
+	return stage(p, name, opts, func(c *stageCounters, out chan<- []T) error {
+		batch := make([]T, 0, size)
+		var timeout <-chan time.Time
+		flush := func() bool {
+			if len(batch) == 0 {
+				return true
+			}
+			ok := send(p.ctx, c, out, batch)
+			batch = make([]T, 0, size)
+			timeout = nil
+			return ok
+		}
+		for {
+			select {
+			case v, ok := <-s.ch:
+				if !ok {
+					flush()
+					return nil
+				}
+				c.in.Add(1)
+				batch = append(batch, v)
+				if len(batch) == 1 && maxWait > 0 {
+					timeout = time.After(maxWait)
+				}
+				if len(batch) == size && !flush() {
+					return nil
+				}
+			case <-timeout:
+				if !flush() {
+					return nil
+				}
+			case <-p.ctx.Done():
+				return nil
+			}
+		}
+	})
+}
+
+// FanOut splits s into n streams that share its items, each item going to
+// exactly one of them, like the listeners in TestPublishToMultipleListeners.
+// This is work-sharing, not broadcast: the streams all read the same channel,
+// so a stage on each of them spreads the work over n stages.
+func FanOut[T any](s Stream[T], n int) []Stream[T] {
+	result := make([]Stream[T], n)
+	for i := range result {
+		result[i] = s
+	}
+	return result
+}
+
+// Merge combines streams into one. It runs one worker per input stream, so a
+// StageConcurrency option is ignored. Merging no streams gives a stream that
+// is closed straight away.
+func Merge[T any](p *Pipeline, name string, streams []Stream[T], opts ...StageOption) Stream[T] {
+	next := atomic.Int64{}
+	opts = append(opts[:len(opts):len(opts)], StageConcurrency(len(streams)))
+	return stage(p, name, opts, func(c *stageCounters, out chan<- T) error {
+		// Each worker drains one of the input streams
+		s := streams[next.Add(1)-1]
+		for v := range s.ch {
+			c.in.Add(1)
+			if !send(p.ctx, c, out, v) {
+				return nil
+			}
+		}
+		return nil
+	})
+}
+
+// Sink ends the pipeline, handing every item to fn.
+func Sink[T any](s Stream[T], name string, fn func(ctx context.Context, v T) error, opts ...StageOption) {
+	p := s.p
+	stage(p, name, opts, func(c *stageCounters, out chan<- struct{}) error {
+		for v := range s.ch {
+			c.in.Add(1)
+			if p.ctx.Err() != nil {
+				return nil
+			}
+			if err := fn(p.ctx, v); err != nil {
+				return err
+			}
+			c.out.Add(1)
+		}
+		return nil
+	})
+}
+
+func countTo(n int) func(ctx context.Context, emit func(int) bool) error {
+	return func(ctx context.Context, emit func(int) bool) error {
+		for i := 1; i <= n; i++ {
+			if !emit(i) {
+				return nil
+			}
+		}
+		return nil
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	checkGoroutineLeaks(t)
+	p := NewPipeline(context.Background())
+	numbers := Source(p, "count", countTo(1000), StageBuffer(100))
+	squares := Map(numbers, "square", func(ctx context.Context, v int) (int, error) {
+		return v * v, nil
+	}, StageConcurrency(4))
+	even := Filter(squares, "even", func(v int) bool { return v%2 == 0 })
+	batches := Batch(even, "batch", 10, 0)
+	var sums []Stream[int]
+	for i, b := range FanOut(batches, 3) {
+		sums = append(sums, Map(b, fmt.Sprintf("sum-%d", i), func(ctx context.Context, batch []int) (int, error) {
+			total := 0
+			for _, v := range batch {
+				total += v
+			}
+			return total, nil
+		}))
+	}
+	total := 0
+	Sink(Merge(p, "merge", sums), "total", func(ctx context.Context, v int) error {
+		total += v
+		return nil
+	})
+	if err := p.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Wait(); err != nil {
+		t.Fatal("Expected Wait to keep its result. Got:", err)
+	}
+
+	expected := 0
+	for i := 2; i <= 1000; i += 2 {
+		expected += i * i
+	}
+	if total != expected {
+		t.Errorf("Expected a total of %d. Got %d.", expected, total)
+	}
+	stats := map[string]StageStats{}
+	for _, s := range p.Stats() {
+		stats[s.Name] = s
+	}
+	if stats["count"].Out != 1000 || stats["square"].In != 1000 || stats["even"].Out != 500 {
+		t.Errorf("Unexpected stage counts: %+v", p.Stats())
+	}
+	if stats["batch"].Out != 50 || stats["merge"].Out != 50 || stats["total"].In != 50 {
+		t.Errorf("Unexpected batch counts: %+v", p.Stats())
+	}
+	if stats["sum-0"].In+stats["sum-1"].In+stats["sum-2"].In != 50 {
+		t.Error("Expected the fanned out stages to share the 50 batches.")
+	}
+	if stats["count"].Throughput <= 0 {
+		t.Error("Expected a throughput for the source.")
+	}
+}
+
+func TestMerge(t *testing.T) {
+	checkGoroutineLeaks(t)
+	p := NewPipeline(context.Background())
+	streams := []Stream[int]{Source(p, "a", countTo(10)), Source(p, "b", countTo(10))}
+	// The option can't change the one worker per stream Merge needs
+	merged := Merge(p, "merge", streams, StageConcurrency(5))
+	empty := Merge(p, "empty", []Stream[int]{})
+	var count atomic.Int64
+	Sink(merged, "merged", func(ctx context.Context, v int) error {
+		count.Add(1)
+		return nil
+	})
+	Sink(empty, "nothing", func(ctx context.Context, v int) error {
+		return errors.New("unexpected item")
+	})
+	if err := p.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if count.Load() != 20 {
+		t.Error("Expected 20 merged items. Got:", count.Load())
+	}
+}
+
+func TestBatchRejectsImpossibleSizes(t *testing.T) {
+	checkGoroutineLeaks(t)
+	p := NewPipeline(context.Background())
+	s := Source(p, "none", func(ctx context.Context, emit func(int) bool) error {
+		return nil
+	})
+	for _, size := range []int{0, -1} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Error("Expected a panic for a batch size of", size)
+				}
+			}()
+			Batch(s, "batch", size, 0)
+		}()
+	}
+	Sink(s, "drain", func(ctx context.Context, v int) error {
+		return nil
+	})
+	if err := p.Wait(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPipelineStopsOnError(t *testing.T) {
+	checkGoroutineLeaks(t)
+	p := NewPipeline(context.Background())
+	errBad := errors.New("bad item")
+	numbers := Source(p, "count", countTo(1000000))
+	checked := Map(numbers, "check", func(ctx context.Context, v int) (int, error) {
+		if v == 50 {
+			return 0, errBad
+		}
+		return v, nil
+	})
+	Sink(checked, "discard", func(ctx context.Context, v int) error { return nil })
+
+	if err := p.Wait(); !errors.Is(err, errBad) {
+		t.Fatal("Expected the stage error. Got:", err)
+	}
+	if emitted := p.Stats()[0].Out; emitted >= 1000000 {
+		t.Error("Expected the source to stop early. Emitted:", emitted)
+	}
+}
+
+func TestPipelineCancellation(t *testing.T) {
+	checkGoroutineLeaks(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	p := NewPipeline(ctx)
+	numbers := Source(p, "forever", func(ctx context.Context, emit func(int) bool) error {
+		for i := 0; emit(i); i++ {
+		}
+		return nil
+	})
+	batches := Batch(numbers, "batch", 1000000, time.Millisecond*5)
+	flushed := make(chan struct{}, 1)
+	Sink(batches, "sink", func(ctx context.Context, batch []int) error {
+		select {
+		case flushed <- struct{}{}:
+		default:
+		}
+		return nil
+	})
+
+	// The batch can never fill up, so only the timer gets it to the sink
+	<-flushed
+	cancel()
+	if err := p.Wait(); err != context.Canceled {
+		t.Error("Expected the pipeline to end with the parent context. Got:", err)
+	}
+}
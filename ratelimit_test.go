@@ -0,0 +1,549 @@
+package learning
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Limiter throttles events. Allow takes a permit if one is free right now;
+// Wait blocks until one is, or until ctx ends.
+type Limiter interface {
+	Allow() bool
+	Wait(ctx context.Context) error
+}
+
+// TokenBucket allows rate events per second on average with bursts of up to
+// burst events.
+type TokenBucket struct {
+	rate  float64
+	burst float64
+	now   func() time.Time
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucket panics unless rate is positive and burst at least 1, as no
+// event could ever be allowed.
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	if rate <= 0 || burst < 1 {
+		panic("ratelimit: token bucket needs a positive rate and a burst of at least 1")
+	}
+	return &TokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), now: time.Now}
+}
+
+func (b *TokenBucket) Allow() bool {
+	return b.reserve() == 0
+}
+
+func (b *TokenBucket) Wait(ctx context.Context) error {
+	for {
+		d := b.reserve()
+		if d == 0 {
+			return nil
+		}
+		if err := sleepCtx(ctx, d); err != nil {
+			return err
+		}
+	}
+}
+
+// reserve takes a token and returns 0, or returns how long until one is due.
+func (b *TokenBucket) reserve() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// SlidingWindow allows at most limit events in any window long period. It
+// keeps the time of each event in the window, so it is exact but uses memory
+// proportional to limit.
+type SlidingWindow struct {
+	limit  int
+	window time.Duration
+	now    func() time.Time
+
+	mu     sync.Mutex
+	events []time.Time // oldest first
+}
+
+// NewSlidingWindow panics unless limit and window are positive.
+func NewSlidingWindow(limit int, window time.Duration) *SlidingWindow {
+	if limit <= 0 || window <= 0 {
+		panic("ratelimit: sliding window needs a positive limit and window")
+	}
+	return &SlidingWindow{limit: limit, window: window, now: time.Now}
+}
+
+func (w *SlidingWindow) Allow() bool {
+	return w.reserve() == 0
+}
+
+func (w *SlidingWindow) Wait(ctx context.Context) error {
+	for {
+		d := w.reserve()
+		if d == 0 {
+			return nil
+		}
+		if err := sleepCtx(ctx, d); err != nil {
+			return err
+		}
+	}
+}
+
+func (w *SlidingWindow) reserve() time.Duration {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	now := w.now()
+	expired := 0
+	for expired < len(w.events) && now.Sub(w.events[expired]) >= w.window {
+		expired++
+	}
+	w.events = w.events[expired:]
+	if len(w.events) < w.limit {
+		w.events = append(w.events, now)
+		return 0
+	}
+	return w.events[0].Add(w.window).Sub(now)
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Semaphore is a weighted semaphore limiting concurrent use of a resource.
+// Waiters are served in order, so a large request is not starved by a stream
+// of small ones.
+type Semaphore struct {
+	size int64
+
+	mu      sync.Mutex
+	cur     int64
+	waiters list.List // of semaphoreWaiter
+}
+
+type semaphoreWaiter struct {
+	n     int64
+	ready chan struct{}
+}
+
+func NewSemaphore(size int64) *Semaphore {
+	return &Semaphore{size: size}
+}
+
+// Acquire takes n units, blocking until they are free or ctx ends.
+func (s *Semaphore) Acquire(ctx context.Context, n int64) error {
+	s.mu.Lock()
+	if s.size-s.cur >= n && s.waiters.Len() == 0 {
+		s.cur += n
+		s.mu.Unlock()
+		return nil
+	}
+	if n > s.size {
+		// Can never be satisfied; don't block everyone queued behind it
+		s.mu.Unlock()
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	ready := make(chan struct{})
+	elem := s.waiters.PushBack(semaphoreWaiter{n: n, ready: ready})
+	s.mu.Unlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		select {
+		case <-ready:
+			// Granted just as ctx ended; hand the units back
+			s.cur -= n
+			s.notifyWaiters()
+		default:
+			front := s.waiters.Front() == elem
+			s.waiters.Remove(elem)
+			if front {
+				// We may have been holding up smaller waiters behind us
+				s.notifyWaiters()
+			}
+		}
+		s.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// TryAcquire takes n units if they are free right now.
+func (s *Semaphore) TryAcquire(n int64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.size-s.cur >= n && s.waiters.Len() == 0 {
+		s.cur += n
+		return true
+	}
+	return false
+}
+
+// Release returns n units.
+func (s *Semaphore) Release(n int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cur -= n
+	if s.cur < 0 {
+		panic("semaphore: released more than held")
+	}
+	s.notifyWaiters()
+}
+
+func (s *Semaphore) notifyWaiters() {
+	for {
+		next := s.waiters.Front()
+		if next == nil {
+			return
+		}
+		w := next.Value.(semaphoreWaiter)
+		if s.size-s.cur < w.n {
+			return
+		}
+		s.cur += w.n
+		s.waiters.Remove(next)
+		close(w.ready)
+	}
+}
+
+// KeyedLimiter keeps one Limiter per key, e.g. per user or per client IP.
+// Limiters idle for longer than idle are dropped, so a long tail of keys does
+// not grow the map forever; a dropped key starts afresh on its next use.
+type KeyedLimiter[K comparable] struct {
+	create func(key K) Limiter
+	idle   time.Duration
+	now    func() time.Time
+
+	mu        sync.Mutex
+	limiters  map[K]*keyedLimiterEntry
+	lastSweep time.Time
+}
+
+type keyedLimiterEntry struct {
+	limiter  Limiter
+	lastUsed time.Time
+	inUse    int // callers in Allow or Wait, whose limiter mustn't be swept
+}
+
+func NewKeyedLimiter[K comparable](idle time.Duration, create func(key K) Limiter) *KeyedLimiter[K] {
+	if idle <= 0 {
+		panic("ratelimit: keyed limiter needs a positive idle time")
+	}
+	return &KeyedLimiter[K]{
+		create:   create,
+		idle:     idle,
+		now:      time.Now,
+		limiters: make(map[K]*keyedLimiterEntry),
+	}
+}
+
+func (k *KeyedLimiter[K]) Allow(key K) bool {
+	e := k.acquire(key)
+	defer k.release(e)
+	return e.limiter.Allow()
+}
+
+func (k *KeyedLimiter[K]) Wait(ctx context.Context, key K) error {
+	e := k.acquire(key)
+	defer k.release(e)
+	return e.limiter.Wait(ctx)
+}
+
+// Len reports how many keys currently have a limiter.
+func (k *KeyedLimiter[K]) Len() int {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return len(k.limiters)
+}
+
+func (k *KeyedLimiter[K]) acquire(key K) *keyedLimiterEntry {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	now := k.now()
+	// Sweeping at most once per idle period keeps the cost amortised
+	if now.Sub(k.lastSweep) >= k.idle {
+		for key, e := range k.limiters {
+			if e.inUse == 0 && now.Sub(e.lastUsed) >= k.idle {
+				delete(k.limiters, key)
+			}
+		}
+		k.lastSweep = now
+	}
+	e, ok := k.limiters[key]
+	if !ok {
+		e = &keyedLimiterEntry{limiter: k.create(key)}
+		k.limiters[key] = e
+	}
+	e.lastUsed = now
+	e.inUse++
+	return e
+}
+
+// release counts the entry as used until now, so a long Wait isn't idle time.
+func (k *KeyedLimiter[K]) release(e *keyedLimiterEntry) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	e.inUse--
+	e.lastUsed = k.now()
+}
+
+func TestTokenBucket(t *testing.T) {
+	bucket := NewTokenBucket(10, 3)
+	now := time.Now()
+	bucket.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if !bucket.Allow() {
+			t.Fatal("Expected the burst to be allowed at event", i)
+		}
+	}
+	if bucket.Allow() {
+		t.Error("Expected the bucket to be empty after the burst.")
+	}
+	now = now.Add(time.Millisecond * 100)
+	if !bucket.Allow() {
+		t.Error("Expected a token after 100ms at 10/s.")
+	}
+	if bucket.Allow() {
+		t.Error("Expected only one token after 100ms.")
+	}
+	now = now.Add(time.Hour)
+	allowed := 0
+	for bucket.Allow() {
+		allowed++
+	}
+	if allowed != 3 {
+		t.Error("Expected refills to be capped at the burst. Got:", allowed)
+	}
+}
+
+func TestTokenBucketWait(t *testing.T) {
+	bucket := NewTokenBucket(100, 1)
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if err := bucket.Wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < time.Millisecond*35 {
+		t.Error("Expected 5 events at 100/s to take about 40ms. Took:", elapsed)
+	}
+
+	slow := NewTokenBucket(1, 1)
+	slow.Allow()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	if err := slow.Wait(ctx); err != context.DeadlineExceeded {
+		t.Error("Expected Wait to give up with the context. Got:", err)
+	}
+}
+
+func TestSlidingWindow(t *testing.T) {
+	window := NewSlidingWindow(3, time.Minute)
+	now := time.Now()
+	window.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		window.Allow()
+		now = now.Add(time.Second * 10)
+	}
+	if window.Allow() {
+		t.Error("Expected the 4th event in the window to be refused.")
+	}
+	if d := window.reserve(); d != time.Second*30 {
+		t.Error("Expected the next slot in 30s when the first event leaves. Got:", d)
+	}
+	now = now.Add(time.Second * 30)
+	if !window.Allow() {
+		t.Error("Expected a slot once the first event left the window.")
+	}
+	if window.Allow() {
+		t.Error("Expected the window to be full again.")
+	}
+}
+
+func TestSemaphore(t *testing.T) {
+	sem := NewSemaphore(10)
+	if err := sem.Acquire(context.Background(), 7); err != nil {
+		t.Fatal(err)
+	}
+	if sem.TryAcquire(5) {
+		t.Error("Expected 5 units not to fit alongside 7.")
+	}
+
+	// A large waiter queues first; a small one behind it must not overtake
+	order := make(chan int64, 2)
+	go func() {
+		sem.Acquire(context.Background(), 8)
+		order <- 8
+	}()
+	time.Sleep(time.Millisecond * 10)
+	go func() {
+		sem.Acquire(context.Background(), 2)
+		order <- 2
+	}()
+	time.Sleep(time.Millisecond * 10)
+	select {
+	case n := <-order:
+		t.Fatal("Expected the small waiter to queue behind the large one. Got:", n)
+	default:
+	}
+
+	sem.Release(7)
+	if granted := <-order + <-order; granted != 10 {
+		t.Error("Expected both waiters to be served. Got units:", granted)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	if err := sem.Acquire(ctx, 1); err != context.DeadlineExceeded {
+		t.Error("Expected Acquire on a full semaphore to time out. Got:", err)
+	}
+	sem.Release(10)
+	if !sem.TryAcquire(10) {
+		t.Error("Expected a timed out waiter to leave nothing behind.")
+	}
+}
+
+func TestKeyedLimiter(t *testing.T) {
+	limiter := NewKeyedLimiter(time.Minute, func(ip string) Limiter {
+		return NewTokenBucket(1, 2)
+	})
+	now := time.Now()
+	limiter.now = func() time.Time { return now }
+
+	for _, ip := range []string{"10.0.0.1", "10.0.0.1", "10.0.0.2"} {
+		if !limiter.Allow(ip) {
+			t.Error("Expected burst to be allowed for", ip)
+		}
+	}
+	if limiter.Allow("10.0.0.1") {
+		t.Error("Expected 10.0.0.1 to be throttled.")
+	}
+	if !limiter.Allow("10.0.0.2") {
+		t.Error("Expected 10.0.0.2 to have its own bucket.")
+	}
+	if limiter.Len() != 2 {
+		t.Error("Expected 2 limiters. Got:", limiter.Len())
+	}
+
+	now = now.Add(time.Minute * 2)
+	limiter.Allow("10.0.0.3")
+	if limiter.Len() != 1 {
+		t.Error("Expected idle limiters to be evicted. Got:", limiter.Len())
+	}
+	if err := limiter.Wait(context.Background(), "10.0.0.3"); err != nil {
+		t.Error(err)
+	}
+}
+
+// gateLimiter allows nothing until its gate opens.
+type gateLimiter struct {
+	gate chan struct{}
+}
+
+func (g gateLimiter) Allow() bool {
+	select {
+	case <-g.gate:
+		return true
+	default:
+		return false
+	}
+}
+
+func (g gateLimiter) Wait(ctx context.Context) error {
+	select {
+	case <-g.gate:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func TestKeyedLimiterKeepsLimitersInUse(t *testing.T) {
+	gate := make(chan struct{})
+	created := map[string]int{}
+	var mu sync.Mutex
+	now := time.Now()
+	limiter := NewKeyedLimiter(time.Minute, func(key string) Limiter {
+		created[key]++
+		return gateLimiter{gate: gate}
+	})
+	limiter.now = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+
+	waited := make(chan error)
+	go func() {
+		waited <- limiter.Wait(context.Background(), "slow")
+	}()
+	for limiter.Len() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	// The sweep triggered by another key finds slow idle for longer than
+	// the idle period, but still waiting
+	mu.Lock()
+	now = now.Add(time.Minute * 2)
+	mu.Unlock()
+	limiter.Allow("other")
+	if limiter.Len() != 2 {
+		t.Error("Expected the limiter in use to survive the sweep. Got:", limiter.Len())
+	}
+	close(gate)
+	if err := <-waited; err != nil {
+		t.Fatal(err)
+	}
+	limiter.Allow("slow")
+	if created["slow"] != 1 {
+		t.Error("Expected slow's limiter to be kept, not recreated. Created:", created["slow"])
+	}
+}
+
+func TestLimiterConstructorsRejectImpossibleLimits(t *testing.T) {
+	for name, create := range map[string]func(){
+		"zero rate":     func() { NewTokenBucket(0, 1) },
+		"negative rate": func() { NewTokenBucket(-1, 1) },
+		"zero burst":    func() { NewTokenBucket(1, 0) },
+		"zero limit":    func() { NewSlidingWindow(0, time.Second) },
+		"zero window":   func() { NewSlidingWindow(1, 0) },
+		"zero idle":     func() { NewKeyedLimiter[string](0, nil) },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Error("Expected a panic for", name)
+				}
+			}()
+			create()
+		}()
+	}
+}
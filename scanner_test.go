@@ -0,0 +1,363 @@
+package learning
+
+import (
+	"database/sql"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// RowIter streams rows one at a time, scanned into T, without holding the
+// whole result in memory:
+//
+//	it, err := IterStructs[User](rows)
+//	for it.Next() {
+//		u := it.Value()
+//	}
+//	err = it.Err()
+//
+// The iterator owns rows and closes them once exhausted or on Close.
+type RowIter[T any] struct {
+	rows  *sql.Rows
+	scan  func() (T, error)
+	value T
+	err   error
+}
+
+func (it *RowIter[T]) Next() bool {
+	if it.err != nil || !it.rows.Next() {
+		it.Close()
+		return false
+	}
+	it.value, it.err = it.scan()
+	if it.err != nil {
+		it.Close()
+		return false
+	}
+	return true
+}
+
+func (it *RowIter[T]) Value() T {
+	return it.value
+}
+
+// Err returns the first scan or iteration error.
+func (it *RowIter[T]) Err() error {
+	if it.err != nil {
+		return it.err
+	}
+	return it.rows.Err()
+}
+
+func (it *RowIter[T]) Close() error {
+	return it.rows.Close()
+}
+
+// collect drains it into a slice.
+func collect[T any](it *RowIter[T], err error) ([]T, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+	result := []T{}
+	for it.Next() {
+		result = append(result, it.Value())
+	}
+	return result, it.Err()
+}
+
+// IterSlices streams rows as values in column order, so unlike IterMaps it
+// keeps every column of a result whose column names repeat, e.g. a join of two
+// tables that both have an id. Values are typed as with IterMaps.
+func IterSlices(rows *sql.Rows) (*RowIter[[]interface{}], error) {
+	cols, err := rows.Columns()
+	if err != nil {
+		rows.Close()
+		return nil, err
+	}
+	return &RowIter[[]interface{}]{rows: rows, scan: scanSlice(rows, len(cols))}, nil
+}
+
+func scanSlice(rows *sql.Rows, n int) func() ([]interface{}, error) {
+	dest := make([]interface{}, n)
+	return func() ([]interface{}, error) {
+		row := make([]interface{}, n)
+		for i := range row {
+			dest[i] = &row[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		for i, v := range row {
+			// Drivers may reuse byte slices on the next call to Next
+			if b, ok := v.([]byte); ok {
+				row[i] = append([]byte(nil), b...)
+			}
+		}
+		return row, nil
+	}
+}
+
+func ScanSlices(rows *sql.Rows) ([][]interface{}, error) {
+	return collect(IterSlices(rows))
+}
+
+// IterMaps streams rows as column name to value maps. Values keep the type
+// the driver gave them (int64, float64, bool, string, []byte, time.Time) and
+// NULL stays nil, unlike an empty string. Columns must have distinct names,
+// as a map can't hold two values for one; use IterSlices otherwise.
+func IterMaps(rows *sql.Rows) (*RowIter[map[string]interface{}], error) {
+	cols, err := rows.Columns()
+	if err != nil {
+		rows.Close()
+		return nil, err
+	}
+	seen := make(map[string]bool, len(cols))
+	for _, col := range cols {
+		if seen[col] {
+			rows.Close()
+			return nil, fmt.Errorf("duplicate column %q: use IterSlices", col)
+		}
+		seen[col] = true
+	}
+	scanValues := scanSlice(rows, len(cols))
+	scan := func() (map[string]interface{}, error) {
+		vals, err := scanValues()
+		if err != nil {
+			return nil, err
+		}
+		row := make(map[string]interface{}, len(cols))
+		for i, v := range vals {
+			row[cols[i]] = v
+		}
+		return row, nil
+	}
+	return &RowIter[map[string]interface{}]{rows: rows, scan: scan}, nil
+}
+
+func ScanMaps(rows *sql.Rows) ([]map[string]interface{}, error) {
+	return collect(IterMaps(rows))
+}
+
+// IterStructs streams rows into structs of type T. A column goes to the field
+// tagged with its name, `db:"first_name"`, or else to the field whose name
+// matches ignoring case and underscores. Fields of embedded structs count as
+// fields of T, fields tagged `db:"-"` are skipped, and a column without a
+// field is an error. NULLs need pointer or sql.Null* fields.
+func IterStructs[T any](rows *sql.Rows) (*RowIter[T], error) {
+	cols, err := rows.Columns()
+	if err != nil {
+		rows.Close()
+		return nil, err
+	}
+	var zero T
+	typ := reflect.TypeOf(zero)
+	if typ == nil || typ.Kind() != reflect.Struct {
+		rows.Close()
+		return nil, fmt.Errorf("cannot scan into %T: not a struct", zero)
+	}
+	fields := structFields(typ)
+	indexes := make([][]int, len(cols))
+	for i, col := range cols {
+		index, ok := fields[col]
+		if !ok {
+			index, ok = fields[normalizeColumnName(col)]
+		}
+		if !ok {
+			rows.Close()
+			return nil, fmt.Errorf("column %q has no field in %s", col, typ)
+		}
+		indexes[i] = index
+	}
+	dest := make([]interface{}, len(cols))
+	scan := func() (T, error) {
+		var value T
+		v := reflect.ValueOf(&value).Elem()
+		for i, index := range indexes {
+			dest[i] = v.FieldByIndex(index).Addr().Interface()
+		}
+		err := rows.Scan(dest...)
+		return value, err
+	}
+	return &RowIter[T]{rows: rows, scan: scan}, nil
+}
+
+func ScanStructs[T any](rows *sql.Rows) ([]T, error) {
+	return collect(IterStructs[T](rows))
+}
+
+// structFields maps db tags and normalized field names to field indexes.
+func structFields(typ reflect.Type) map[string][]int {
+	fields := map[string][]int{}
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		tag := f.Tag.Get("db")
+		switch {
+		case tag == "-":
+			continue
+		case f.Anonymous && f.Type.Kind() == reflect.Struct && tag == "":
+			for name, index := range structFields(f.Type) {
+				if _, ok := fields[name]; !ok {
+					fields[name] = append([]int{i}, index...)
+				}
+			}
+			continue
+		case !f.IsExported():
+			continue
+		}
+		if tag != "" {
+			fields[tag] = f.Index
+		} else {
+			fields[normalizeColumnName(f.Name)] = f.Index
+		}
+	}
+	return fields
+}
+
+func normalizeColumnName(name string) string {
+	return strings.ToLower(strings.ReplaceAll(name, "_", ""))
+}
+
+func openScannerDB(t *testing.T) *sql.DB {
+	db := openUsersDB(t)
+	_, err := db.Exec(`INSERT INTO "USERS" ("email", "password", "first_name", "last_name", "is_active") VALUES
+		('arunsworld@gmail.com', 'password', 'Arun', 'Barua', 1),
+		('arun@e2open.com', 'password', 'Arun', '', 0)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestScanMapsKeepsTypesAndNulls(t *testing.T) {
+	db := openScannerDB(t)
+	rows, err := db.Query(`SELECT "id", "email", "last_name", NULL AS "nothing", 1.5 AS "ratio", x'00ff' AS "blob" FROM "USERS" ORDER BY "id"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := ScanMaps(rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 2 {
+		t.Fatal("Expected 2 rows. Got:", len(result))
+	}
+	first, second := result[0], result[1]
+	if first["id"] != int64(1) || first["email"] != "arunsworld@gmail.com" || first["ratio"] != 1.5 {
+		t.Errorf("Expected typed values. Got: %#v", first)
+	}
+	if v, ok := second["last_name"]; !ok || v != "" {
+		t.Errorf("Expected an empty last_name. Got: %#v", v)
+	}
+	if v, ok := second["nothing"]; !ok || v != nil {
+		t.Errorf("Expected NULL as nil. Got: %#v", v)
+	}
+	if b, ok := first["blob"].([]byte); !ok || len(b) != 2 || b[1] != 0xff {
+		t.Errorf("Expected a blob. Got: %#v", first["blob"])
+	}
+}
+
+func TestScanDuplicateColumnNames(t *testing.T) {
+	db := openScannerDB(t)
+	query := `SELECT a."id", b."id", a."email" FROM "USERS" a JOIN "USERS" b ON b."id" = a."id" + 1`
+	rows, err := db.Query(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ScanMaps(rows); err == nil || !strings.Contains(err.Error(), `duplicate column "id"`) {
+		t.Error("Expected maps to refuse the duplicate id. Got:", err)
+	}
+
+	rows, err = db.Query(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := ScanSlices(rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 1 || result[0][0] != int64(1) || result[0][1] != int64(2) || result[0][2] != "arunsworld@gmail.com" {
+		t.Errorf("Expected both ids in column order. Got: %#v", result)
+	}
+}
+
+func TestScanStructs(t *testing.T) {
+	db := openScannerDB(t)
+	rows, err := db.Query(`SELECT * FROM "USERS" ORDER BY "id"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, err := ScanStructs[User](rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 || users[0].FirstName != "Arun" || !users[0].IsActive || users[1].IsActive || users[1].ID != 2 {
+		t.Errorf("Unexpected users: %+v", users)
+	}
+
+	type audit struct {
+		CreatedBy string `db:"created_by"`
+	}
+	type userSummary struct {
+		audit
+		ID       int64
+		Name     string  `db:"full_name"`
+		LastName *string `db:"last"`
+		Ignored  string  `db:"-"`
+	}
+	rows, err = db.Query(`SELECT "id", "first_name" || ' ' || "last_name" AS "full_name", NULLIF("last_name", '') AS "last", 'admin' AS "created_by" FROM "USERS" ORDER BY "id"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	summaries, err := ScanStructs[userSummary](rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summaries[0].Name != "Arun Barua" || summaries[0].LastName == nil || *summaries[0].LastName != "Barua" || summaries[0].CreatedBy != "admin" {
+		t.Errorf("Unexpected first summary: %+v", summaries[0])
+	}
+	if summaries[1].LastName != nil {
+		t.Error("Expected NULL to scan into a nil pointer. Got:", *summaries[1].LastName)
+	}
+
+	rows, _ = db.Query(`SELECT "id", "email" AS "unknown" FROM "USERS"`)
+	if _, err := ScanStructs[userSummary](rows); err == nil || !strings.Contains(err.Error(), `"unknown"`) {
+		t.Error("Expected an error for a column without a field. Got:", err)
+	}
+}
+
+func TestIterStructsStreams(t *testing.T) {
+	db := openScannerDB(t)
+	rows, err := db.Query(`SELECT "id", "email" FROM "USERS" ORDER BY "id"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	it, err := IterStructs[struct {
+		ID    int64
+		Email string
+	}](rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !it.Next() || it.Value().Email != "arunsworld@gmail.com" {
+		t.Fatal("Expected the first user. Got:", it.Value(), it.Err())
+	}
+	// Stopping early releases the connection
+	it.Close()
+	if it.Next() {
+		t.Error("Expected no more rows after Close.")
+	}
+
+	rows, _ = db.Query(`SELECT "email" FROM "USERS"`)
+	intIt, _ := IterStructs[struct{ Email int }](rows)
+	for intIt.Next() {
+		t.Error("Expected scanning an email into an int to fail.")
+	}
+	if intIt.Err() == nil {
+		t.Error("Expected the scan error to be reported.")
+	}
+	if n := db.Stats().InUse; n != 0 {
+		t.Error("Expected every connection to be released. In use:", n)
+	}
+}
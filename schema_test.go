@@ -0,0 +1,508 @@
+package learning
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+)
+
+var ErrNoSuchTable = errors.New("no such table")
+
+// SchemaInspector describes the tables of a database. Names are as the
+// database stores them: Phoenix upper-cases unquoted identifiers, so a table
+// created as users is USERS. A name may be qualified with its schema, SCHEMA.TABLE.
+type SchemaInspector interface {
+	Tables() ([]TableInfo, error)
+	// Table returns the table with its columns, primary key and indexes, or
+	// ErrNoSuchTable.
+	Table(name string) (TableInfo, error)
+}
+
+type TableInfo struct {
+	Schema     string
+	Name       string
+	Type       string // table, view or system table
+	Columns    []ColumnInfo
+	PrimaryKey []string
+	Indexes    []IndexInfo
+	// Attributes are database specific table options, e.g. Phoenix's
+	// SALT_BUCKETS or DISABLE_WAL.
+	Attributes map[string]string
+}
+
+// QualifiedName is the quoted SCHEMA.NAME, or just NAME without a schema.
+func (t TableInfo) QualifiedName() string {
+	if t.Schema == "" {
+		return quoteIdentifier(t.Name)
+	}
+	return quoteIdentifier(t.Schema) + "." + quoteIdentifier(t.Name)
+}
+
+type ColumnInfo struct {
+	Name     string
+	Type     string
+	Nullable bool
+	Default  *string
+	Family   string // Phoenix column family
+}
+
+type IndexInfo struct {
+	Name    string
+	Unique  bool
+	Columns []string
+}
+
+// quoteIdentifier quotes name for use as a table or column name in SQL, in
+// the standard way that SQLite and Phoenix share: wrap it in double quotes and
+// double any double quotes inside.
+func quoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// splitQualifiedName splits SCHEMA.TABLE at its last dot. A part wrapped in
+// double quotes, with any quotes inside doubled, may hold dots of its own, as
+// in "MY.SCHEMA"."MY.TABLE"; anything else is taken literally.
+func splitQualifiedName(name string) (schema, table string) {
+	parts := []string{}
+	for rest := name; ; rest = rest[1:] {
+		part, after, ok := cutQualifiedPart(rest)
+		if !ok {
+			// Not quoted the way we expect, so the quotes are part of the name
+			if i := strings.LastIndex(name, "."); i >= 0 {
+				return name[:i], name[i+1:]
+			}
+			return "", name
+		}
+		parts = append(parts, part)
+		if rest = after; rest == "" {
+			break
+		}
+	}
+	if len(parts) == 1 {
+		return "", parts[0]
+	}
+	return strings.Join(parts[:len(parts)-1], "."), parts[len(parts)-1]
+}
+
+// cutQualifiedPart cuts the first part off a qualified name, unquoting it.
+// rest is empty or starts with the dot after the part.
+func cutQualifiedPart(s string) (part, rest string, ok bool) {
+	if !strings.HasPrefix(s, `"`) {
+		if i := strings.Index(s, "."); i >= 0 {
+			return s[:i], s[i:], true
+		}
+		return s, "", true
+	}
+	b := strings.Builder{}
+	for i := 1; i < len(s); i++ {
+		switch {
+		case s[i] != '"':
+			b.WriteByte(s[i])
+		case i+1 < len(s) && s[i+1] == '"':
+			b.WriteByte('"')
+			i++
+		case i+1 == len(s) || s[i+1] == '.':
+			return b.String(), s[i+1:], true
+		default:
+			return "", "", false
+		}
+	}
+	return "", "", false
+}
+
+// sqliteInspector reads sqlite_master and the table_info, index_list and
+// index_info pragmas.
+type sqliteInspector struct {
+	db *sql.DB
+}
+
+func newSQLiteInspector(db *sql.DB) *sqliteInspector {
+	return &sqliteInspector{db: db}
+}
+
+func (i *sqliteInspector) Tables() ([]TableInfo, error) {
+	rows, err := i.db.Query(`SELECT name, type FROM sqlite_master WHERE type IN ('table', 'view') AND name NOT LIKE 'sqlite_%' ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	return ScanStructs[TableInfo](rows)
+}
+
+// Table describes name, which may be qualified with the name of an attached
+// database, as in main.USERS.
+func (i *sqliteInspector) Table(name string) (TableInfo, error) {
+	schema, table := splitQualifiedName(name)
+	t := TableInfo{Schema: schema, Name: table}
+	if schema == "" {
+		schema = "main"
+	}
+	var attached int
+	err := i.db.QueryRow(`SELECT COUNT(1) FROM pragma_database_list WHERE name = $1`, schema).Scan(&attached)
+	if err != nil {
+		return t, err
+	}
+	if attached == 0 {
+		return t, fmt.Errorf("%w: %s", ErrNoSuchTable, name)
+	}
+	err = i.db.QueryRow(`SELECT type FROM `+quoteIdentifier(schema)+`.sqlite_master WHERE type IN ('table', 'view') AND name = $1`, table).Scan(&t.Type)
+	if err == sql.ErrNoRows {
+		return t, fmt.Errorf("%w: %s", ErrNoSuchTable, name)
+	}
+	if err != nil {
+		return t, err
+	}
+
+	rows, err := i.db.Query(`SELECT name, type, "notnull", dflt_value, pk FROM pragma_table_info($1, $2) ORDER BY cid`, table, schema)
+	if err != nil {
+		return t, err
+	}
+	columns, err := ScanStructs[struct {
+		Name    string
+		Type    string
+		NotNull bool
+		Default *string `db:"dflt_value"`
+		PK      int
+	}](rows)
+	if err != nil {
+		return t, err
+	}
+	pk := map[int]string{}
+	for _, c := range columns {
+		t.Columns = append(t.Columns, ColumnInfo{Name: c.Name, Type: c.Type, Nullable: !c.NotNull, Default: c.Default})
+		if c.PK > 0 {
+			pk[c.PK] = c.Name
+		}
+	}
+	for n := 1; n <= len(pk); n++ {
+		t.PrimaryKey = append(t.PrimaryKey, pk[n])
+	}
+
+	rows, err = i.db.Query(`SELECT name, "unique" FROM pragma_index_list($1, $2) ORDER BY name`, table, schema)
+	if err != nil {
+		return t, err
+	}
+	if t.Indexes, err = ScanStructs[IndexInfo](rows); err != nil {
+		return t, err
+	}
+	for n := range t.Indexes {
+		rows, err := i.db.Query(`SELECT name FROM pragma_index_info($1, $2) ORDER BY seqno`, t.Indexes[n].Name, schema)
+		if err != nil {
+			return t, err
+		}
+		for rows.Next() {
+			var column string
+			if err := rows.Scan(&column); err != nil {
+				rows.Close()
+				return t, err
+			}
+			t.Indexes[n].Columns = append(t.Indexes[n].Columns, column)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return t, err
+		}
+	}
+	return t, nil
+}
+
+// phoenixInspector reads Phoenix's SYSTEM.CATALOG, which has a header row per
+// table, with COLUMN_NAME and COLUMN_FAMILY NULL, and a row per column.
+// Indexes are tables of type i pointing at their table with DATA_TABLE_NAME.
+type phoenixInspector struct {
+	db *sql.DB
+}
+
+func newPhoenixInspector(db *sql.DB) *phoenixInspector {
+	return &phoenixInspector{db: db}
+}
+
+var phoenixTableTypes = map[string]string{"s": "system table", "u": "table", "v": "view", "i": "index"}
+
+// phoenixTableAttributes are the header row columns returned as Attributes.
+var phoenixTableAttributes = []string{"SALT_BUCKETS", "DISABLE_WAL", "IMMUTABLE_ROWS", "MULTI_TENANT", "DEFAULT_COLUMN_FAMILY", "PK_NAME", "GUIDE_POSTS_WIDTH"}
+
+// phoenixDataTypes names the java.sql.Types codes in DATA_TYPE.
+var phoenixDataTypes = map[int64]string{
+	-7: "BIT", -6: "TINYINT", 5: "SMALLINT", 4: "INTEGER", -5: "BIGINT", 6: "FLOAT", 7: "REAL", 8: "DOUBLE",
+	3: "DECIMAL", 1: "CHAR", 12: "VARCHAR", 91: "DATE", 92: "TIME", 93: "TIMESTAMP", -2: "BINARY", -3: "VARBINARY",
+	16: "BOOLEAN", 2003: "ARRAY",
+}
+
+const phoenixHeaderRow = `TENANT_ID IS NULL AND COLUMN_NAME IS NULL AND COLUMN_FAMILY IS NULL`
+
+func (i *phoenixInspector) Tables() ([]TableInfo, error) {
+	rows, err := i.db.Query(`SELECT TABLE_SCHEM, TABLE_NAME, TABLE_TYPE FROM SYSTEM.CATALOG
+		WHERE ` + phoenixHeaderRow + ` AND TABLE_TYPE <> 'i' ORDER BY TABLE_SCHEM, TABLE_NAME`)
+	if err != nil {
+		return nil, err
+	}
+	tables, err := ScanStructs[struct {
+		Schema sql.NullString `db:"TABLE_SCHEM"`
+		Name   string         `db:"TABLE_NAME"`
+		Type   string         `db:"TABLE_TYPE"`
+	}](rows)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]TableInfo, len(tables))
+	for n, t := range tables {
+		result[n] = TableInfo{Schema: t.Schema.String, Name: t.Name, Type: phoenixTableTypes[t.Type]}
+	}
+	return result, nil
+}
+
+func (i *phoenixInspector) Table(name string) (TableInfo, error) {
+	schema, table := splitQualifiedName(name)
+	t := TableInfo{Schema: schema, Name: table, Attributes: map[string]string{}}
+	rows, err := i.db.Query(`SELECT TABLE_TYPE, `+strings.Join(phoenixTableAttributes, ", ")+` FROM SYSTEM.CATALOG
+		WHERE `+phoenixHeaderRow+` AND COALESCE(TABLE_SCHEM, '') = ? AND TABLE_NAME = ?`, schema, table)
+	if err != nil {
+		return t, err
+	}
+	header, err := ScanMaps(rows)
+	if err != nil {
+		return t, err
+	}
+	if len(header) == 0 {
+		return t, fmt.Errorf("%w: %s", ErrNoSuchTable, name)
+	}
+	t.Type = phoenixTableTypes[fmt.Sprint(header[0]["TABLE_TYPE"])]
+	for _, attribute := range phoenixTableAttributes {
+		if v := header[0][attribute]; v != nil {
+			t.Attributes[attribute] = formatCSVValue(v)
+		}
+	}
+
+	if t.Columns, t.PrimaryKey, err = i.columns(schema, table); err != nil {
+		return t, err
+	}
+
+	rows, err = i.db.Query(`SELECT TABLE_NAME AS NAME FROM SYSTEM.CATALOG
+		WHERE `+phoenixHeaderRow+` AND TABLE_TYPE = 'i' AND COALESCE(TABLE_SCHEM, '') = ? AND DATA_TABLE_NAME = ? ORDER BY TABLE_NAME`, schema, table)
+	if err != nil {
+		return t, err
+	}
+	if t.Indexes, err = ScanStructs[IndexInfo](rows); err != nil {
+		return t, err
+	}
+	for n := range t.Indexes {
+		_, key, err := i.columns(schema, t.Indexes[n].Name)
+		if err != nil {
+			return t, err
+		}
+		// Index columns are named FAMILY:COLUMN, or :COLUMN for primary key columns
+		for _, column := range key {
+			t.Indexes[n].Columns = append(t.Indexes[n].Columns, column[strings.Index(column, ":")+1:])
+		}
+	}
+	return t, nil
+}
+
+// columns returns the columns of a table or index and, ordered by KEY_SEQ,
+// those that make up its row key.
+func (i *phoenixInspector) columns(schema, table string) ([]ColumnInfo, []string, error) {
+	rows, err := i.db.Query(`SELECT COLUMN_NAME, COLUMN_FAMILY, DATA_TYPE, COLUMN_SIZE, NULLABLE, COLUMN_DEF, KEY_SEQ FROM SYSTEM.CATALOG
+		WHERE TENANT_ID IS NULL AND COLUMN_NAME IS NOT NULL AND COALESCE(TABLE_SCHEM, '') = ? AND TABLE_NAME = ? ORDER BY ORDINAL_POSITION`, schema, table)
+	if err != nil {
+		return nil, nil, err
+	}
+	columns, err := ScanStructs[struct {
+		Name     string         `db:"COLUMN_NAME"`
+		Family   sql.NullString `db:"COLUMN_FAMILY"`
+		DataType sql.NullInt64  `db:"DATA_TYPE"`
+		Size     sql.NullInt64  `db:"COLUMN_SIZE"`
+		Nullable sql.NullInt64  `db:"NULLABLE"`
+		Default  *string        `db:"COLUMN_DEF"`
+		KeySeq   sql.NullInt64  `db:"KEY_SEQ"`
+	}](rows)
+	if err != nil {
+		return nil, nil, err
+	}
+	result := []ColumnInfo{}
+	key := map[int64]string{}
+	for _, c := range columns {
+		typ, ok := phoenixDataTypes[c.DataType.Int64]
+		if !ok {
+			typ = fmt.Sprint("TYPE ", c.DataType.Int64)
+		}
+		if (typ == "CHAR" || typ == "VARCHAR" || typ == "DECIMAL") && c.Size.Valid {
+			typ = fmt.Sprintf("%s(%d)", typ, c.Size.Int64)
+		}
+		result = append(result, ColumnInfo{Name: c.Name, Type: typ, Nullable: c.Nullable.Int64 == 1, Default: c.Default, Family: c.Family.String})
+		if c.KeySeq.Valid {
+			key[c.KeySeq.Int64] = c.Name
+		}
+	}
+	seqs := make([]int64, 0, len(key))
+	for seq := range key {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(a, b int) bool { return seqs[a] < seqs[b] })
+	primaryKey := []string{}
+	for _, seq := range seqs {
+		primaryKey = append(primaryKey, key[seq])
+	}
+	return result, primaryKey, nil
+}
+
+// fakePhoenixCatalogSQL creates a SYSTEM.CATALOG shaped like Phoenix's,
+// describing itself and USERS, salted, with an index on EMAIL.
+const fakePhoenixCatalogSQL = `CREATE TABLE SYSTEM.CATALOG (
+		TENANT_ID varchar, TABLE_SCHEM varchar, TABLE_NAME varchar, COLUMN_NAME varchar, COLUMN_FAMILY varchar,
+		TABLE_TYPE char(1), PK_NAME varchar, SALT_BUCKETS integer, DISABLE_WAL boolean, IMMUTABLE_ROWS boolean,
+		MULTI_TENANT boolean, DEFAULT_COLUMN_FAMILY varchar, GUIDE_POSTS_WIDTH bigint, DATA_TABLE_NAME varchar,
+		DATA_TYPE integer, COLUMN_SIZE integer, NULLABLE integer, COLUMN_DEF varchar, ORDINAL_POSITION integer, KEY_SEQ integer);
+	INSERT INTO SYSTEM.CATALOG (TABLE_SCHEM, TABLE_NAME, TABLE_TYPE, PK_NAME, SALT_BUCKETS, DISABLE_WAL) VALUES
+		('SYSTEM', 'CATALOG', 's', 'PK', NULL, 0),
+		(NULL, 'USERS', 'u', 'PK_USERS', 8, 1);
+	INSERT INTO SYSTEM.CATALOG (TABLE_NAME, TABLE_TYPE, DATA_TABLE_NAME) VALUES ('USERS_EMAIL_IDX', 'i', 'USERS');
+	INSERT INTO SYSTEM.CATALOG (TABLE_SCHEM, TABLE_NAME, COLUMN_NAME, COLUMN_FAMILY, DATA_TYPE, COLUMN_SIZE, NULLABLE, COLUMN_DEF, ORDINAL_POSITION, KEY_SEQ) VALUES
+		('SYSTEM', 'CATALOG', 'TENANT_ID', NULL, 12, NULL, 1, NULL, 1, 1),
+		('SYSTEM', 'CATALOG', 'TABLE_SCHEM', NULL, 12, NULL, 1, NULL, 2, 2),
+		('SYSTEM', 'CATALOG', 'TABLE_NAME', NULL, 12, NULL, 0, NULL, 3, 3),
+		('SYSTEM', 'CATALOG', 'COLUMN_NAME', NULL, 12, NULL, 1, NULL, 4, 4),
+		('SYSTEM', 'CATALOG', 'COLUMN_FAMILY', NULL, 12, NULL, 1, NULL, 5, 5),
+		(NULL, 'USERS', 'ID', NULL, -5, NULL, 0, NULL, 1, 1),
+		(NULL, 'USERS', 'EMAIL', '0', 12, 75, 0, NULL, 2, NULL),
+		(NULL, 'USERS', 'IS_ACTIVE', '0', 16, NULL, 1, 'true', 3, NULL),
+		(NULL, 'USERS_EMAIL_IDX', '0:EMAIL', NULL, 12, 75, 1, NULL, 1, 1),
+		(NULL, 'USERS_EMAIL_IDX', ':ID', NULL, -5, NULL, 0, NULL, 2, 2);`
+
+// openFakePhoenixCatalog returns a SQLite database with a fake SYSTEM.CATALOG.
+func openFakePhoenixCatalog(t *testing.T) *sql.DB {
+	db := openMigrationsDB(t)
+	// ATTACH is per connection
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(`ATTACH DATABASE ':memory:' AS SYSTEM; ` + fakePhoenixCatalogSQL); err != nil {
+		t.Fatal("Could not create SYSTEM.CATALOG: ", err)
+	}
+	return db
+}
+
+func TestQuoteIdentifier(t *testing.T) {
+	db := openMigrationsDB(t)
+	name := `we"ird; DROP TABLE x --`
+	if quoted := quoteIdentifier(name); quoted != `"we""ird; DROP TABLE x --"` {
+		t.Error("Unexpected quoting:", quoted)
+	}
+	if _, err := db.Exec(`CREATE TABLE ` + quoteIdentifier(name) + ` (` + quoteIdentifier("a b") + ` integer)`); err != nil {
+		t.Fatal(err)
+	}
+	table, err := newSQLiteInspector(db).Table(name)
+	if err != nil || table.Columns[0].Name != "a b" {
+		t.Errorf("Expected the oddly named table to be created as is. Got %+v, %v", table, err)
+	}
+	if table.QualifiedName() != `"we""ird; DROP TABLE x --"` {
+		t.Error("Unexpected qualified name:", table.QualifiedName())
+	}
+}
+
+func TestSplitQualifiedName(t *testing.T) {
+	for name, expected := range map[string][2]string{
+		"USERS":                   {"", "USERS"},
+		"main.USERS":              {"main", "USERS"},
+		`"a.b"`:                   {"", "a.b"},
+		`"MY.SCHEMA"."MY.TABLE"`:  {"MY.SCHEMA", "MY.TABLE"},
+		`main."we""ird.name"`:     {"main", `we"ird.name`},
+		`we"ird`:                  {"", `we"ird`},
+		`"unterminated.name`:      {`"unterminated`, "name"},
+		`"trailing"text.USERS`:    {`"trailing"text`, "USERS"},
+		`SYSTEM."CATALOG"`:        {"SYSTEM", "CATALOG"},
+		`"SYSTEM".CATALOG`:        {"SYSTEM", "CATALOG"},
+		`"SYSTEM"."CATALOG.BAK"`:  {"SYSTEM", "CATALOG.BAK"},
+		`SYSTEM.CATALOG."IDX"`:    {"SYSTEM.CATALOG", "IDX"},
+		`"MY.SCHEMA".TABLE.EXTRA`: {"MY.SCHEMA.TABLE", "EXTRA"},
+	} {
+		if schema, table := splitQualifiedName(name); schema != expected[0] || table != expected[1] {
+			t.Errorf("Expected %q to split into %q and %q. Got %q and %q.", name, expected[0], expected[1], schema, table)
+		}
+	}
+
+	db := openMigrationsDB(t)
+	if _, err := db.Exec(`CREATE TABLE "a.b" ("x" integer)`); err != nil {
+		t.Fatal(err)
+	}
+	if table, err := newSQLiteInspector(db).Table(`main."a.b"`); err != nil || table.Name != "a.b" || len(table.Columns) != 1 {
+		t.Errorf("Expected to describe a.b. Got %+v, %v", table, err)
+	}
+}
+
+func TestSQLiteInspector(t *testing.T) {
+	inspector := newSQLiteInspector(openUsersDB(t))
+	tables, err := inspector.Tables()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tables) != 2 || tables[0].Name != "USERS" || tables[0].Type != "table" || tables[1].Name != "schema_migrations" {
+		t.Errorf("Unexpected tables: %+v", tables)
+	}
+
+	users, err := inspector.Table("USERS")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users.Columns) != 6 || users.Columns[1] != (ColumnInfo{Name: "email", Type: "varchar(75)"}) {
+		t.Errorf("Unexpected columns: %+v", users.Columns)
+	}
+	if strings.Join(users.PrimaryKey, ",") != "id" {
+		t.Error("Expected the primary key to be id. Got:", users.PrimaryKey)
+	}
+	indexes := fmt.Sprint(users.Indexes)
+	if indexes != "[{USERS_NAME_IDX false [last_name first_name]} {sqlite_autoindex_USERS_1 true [email]}]" {
+		t.Error("Unexpected indexes:", indexes)
+	}
+
+	qualified, err := inspector.Table("main.USERS")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if qualified.Schema != "main" || qualified.Name != "USERS" || len(qualified.Columns) != 6 || len(qualified.Indexes) != 2 {
+		t.Errorf("Expected main.USERS to be USERS. Got: %+v", qualified)
+	}
+
+	for _, name := range []string{`USERS" --`, "other.USERS", `main"."USERS`} {
+		if _, err := inspector.Table(name); !errors.Is(err, ErrNoSuchTable) {
+			t.Errorf("Expected ErrNoSuchTable for %s. Got: %v", name, err)
+		}
+	}
+}
+
+func TestPhoenixInspector(t *testing.T) {
+	inspector := newPhoenixInspector(openFakePhoenixCatalog(t))
+	tables, err := inspector.Tables()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(tables) != fmt.Sprint([]TableInfo{{Name: "USERS", Type: "table"}, {Schema: "SYSTEM", Name: "CATALOG", Type: "system table"}}) {
+		t.Errorf("Unexpected tables: %+v", tables)
+	}
+
+	users, err := inspector.Table("USERS")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users.Columns) != 3 || users.Columns[1] != (ColumnInfo{Name: "EMAIL", Type: "VARCHAR(75)", Family: "0"}) ||
+		!users.Columns[2].Nullable || *users.Columns[2].Default != "true" {
+		t.Errorf("Unexpected columns: %+v", users.Columns)
+	}
+	if strings.Join(users.PrimaryKey, ",") != "ID" {
+		t.Error("Expected the primary key to be ID. Got:", users.PrimaryKey)
+	}
+	if fmt.Sprint(users.Indexes) != "[{USERS_EMAIL_IDX false [EMAIL ID]}]" {
+		t.Error("Unexpected indexes:", users.Indexes)
+	}
+	if users.Attributes["SALT_BUCKETS"] != "8" || users.Attributes["PK_NAME"] != "PK_USERS" || len(users.Attributes) != 3 {
+		t.Error("Unexpected attributes:", users.Attributes)
+	}
+
+	catalog, err := inspector.Table("SYSTEM.CATALOG")
+	if err != nil || catalog.Type != "system table" || catalog.QualifiedName() != `"SYSTEM"."CATALOG"` {
+		t.Errorf("Unexpected SYSTEM.CATALOG: %+v, %v", catalog, err)
+	}
+	if _, err := inspector.Table("users"); !errors.Is(err, ErrNoSuchTable) {
+		t.Error("Expected names to be case sensitive. Got:", err)
+	}
+}
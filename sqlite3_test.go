@@ -2,21 +2,15 @@ package learning
 
 import (
 	"database/sql"
-	"os"
-	"strconv"
-	"strings"
+	"errors"
+	"path/filepath"
 	"testing"
 
-	_ "github.com/mattn/go-sqlite3"
+	sqlite3 "github.com/mattn/go-sqlite3"
 )
 
 func TestCreateAndExerciseSqliteDB(t *testing.T) {
-	_, err := os.Stat("/tmp/test.db")
-	if err == nil {
-		os.Remove("/tmp/test.db")
-	}
-
-	db, err := sql.Open("sqlite3", "file:/tmp/test.db")
+	db, err := sql.Open("sqlite3", "file:"+filepath.Join(t.TempDir(), "test.db"))
 	if err != nil {
 		t.Error("Could not open DB: ", err)
 		return
@@ -29,14 +23,7 @@ func TestCreateAndExerciseSqliteDB(t *testing.T) {
 		return
 	}
 
-	createSQL := `CREATE TABLE IF NOT EXISTS "USERS" (
-					"id" integer NOT NULL PRIMARY KEY AUTOINCREMENT,
-					"email" varchar(75) NOT NULL UNIQUE,
-					"password" varchar(128) NOT NULL,
-					"first_name" varchar(30) NOT NULL,
-					"last_name" varchar(30) NOT NULL,
-					"is_active" bool NOT NULL)`
-	_, err = db.Exec(createSQL)
+	err = migrateSchema(db)
 	if err != nil {
 		t.Error("Could not create USERS table: ", err)
 		return
@@ -50,12 +37,6 @@ func TestCreateAndExerciseSqliteDB(t *testing.T) {
 	genericQueryTest(t, db)
 	noRecordFoundTest(t, db)
 	deleteRecordTest(t, db)
-
-	err = os.Remove("/tmp/test.db")
-	if err != nil {
-		t.Error("Could not delete the database: ", err)
-		return
-	}
 }
 
 func insertRecordTest(t *testing.T, db *sql.DB, email string, expectedID int64) {
@@ -166,46 +147,34 @@ func deleteRecordTest(t *testing.T, db *sql.DB) {
 func genericQueryTest(t *testing.T, db *sql.DB) {
 	rows, err := db.Query("SELECT * FROM USERS WHERE first_name = $1 ORDER BY id", "Arun")
 	if err != nil {
-		t.Log("Error creating Select query: ", err)
+		t.Error("Error creating Select query: ", err)
 		return
 	}
-	cols, err := rows.Columns()
+	data, err := ScanMaps(rows)
 	if err != nil {
-		t.Log("Error getting columns: ", err)
-		return
-	}
-	allCols := strings.Join(cols, "|")
-	if allCols != "id|email|password|first_name|last_name|is_active" {
-		t.Log("Columns not as expected. Got: ", cols)
+		t.Error("Error scanning rows: ", err)
 		return
 	}
-	vals := make([]interface{}, len(cols))
-	for i := range cols {
-		vals[i] = new(sql.RawBytes)
-	}
-	type row map[string]string
-	type table []row
-	data := table{}
-	for rows.Next() {
-		err = rows.Scan(vals...)
-		newRow := make(row)
-		for i, v := range vals {
-			vv := v.(*sql.RawBytes)
-			if len(*vv) == 0 {
-				continue
-			}
-			newRow[cols[i]] = string(*vv)
-		}
-		data = append(data, newRow)
-	}
-	rows.Close()
 
 	if len(data) != 2 {
 		t.Error("Expected to see 2 rows. Found:", len(data))
 	}
 	for i, r := range data {
-		if r["id"] != strconv.Itoa(i+1) {
-			t.Errorf("Expected id to be %s. Found %s.", strconv.Itoa(i), r["id"])
+		if len(r) != 6 {
+			t.Error("Expected id, email, password, first_name, last_name and is_active. Got: ", r)
 		}
+		if r["id"] != int64(i+1) {
+			t.Errorf("Expected id to be %d. Found %v.", i+1, r["id"])
+		}
+	}
+}
+
+// isUniqueViolation reports whether err is sqlite rejecting a duplicate value
+// for a UNIQUE or PRIMARY KEY column.
+func isUniqueViolation(err error) bool {
+	var e sqlite3.Error
+	if !errors.As(err, &e) {
+		return false
 	}
+	return e.ExtendedCode == sqlite3.ErrConstraintUnique || e.ExtendedCode == sqlite3.ErrConstraintPrimaryKey
 }
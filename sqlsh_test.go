@@ -0,0 +1,547 @@
+package learning
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	_ "github.com/apache/calcite-avatica-go/v4"
+	"github.com/jinzhu/gorm"
+)
+
+// openShellDB opens dsn with one of the drivers the project uses: sqlite3,
+// avatica for Phoenix, or gorm, which goes through gorm's sqlite3 dialect.
+func openShellDB(driver, dsn string) (*sql.DB, SchemaInspector, error) {
+	switch driver {
+	case "sqlite3":
+		db, err := sql.Open("sqlite3", dsn)
+		return db, newSQLiteInspector(db), err
+	case "avatica":
+		db, err := sql.Open("avatica", dsn)
+		return db, newPhoenixInspector(db), err
+	case "gorm":
+		db, err := gorm.Open("sqlite3", dsn)
+		if err != nil {
+			return nil, nil, err
+		}
+		return db.DB(), newSQLiteInspector(db.DB()), nil
+	}
+	return nil, nil, fmt.Errorf("unknown driver %q: use sqlite3, avatica or gorm", driver)
+}
+
+// sqlShell reads statements, which may span lines and end with a semicolon,
+// and backslash commands, which take a line of their own.
+type sqlShell struct {
+	db        *sql.DB
+	inspector SchemaInspector
+	out       io.Writer
+	prompt    bool
+	timing    bool
+	history   []string
+	// historyFile, if set, keeps history across sessions
+	historyFile string
+}
+
+const sqlShellHelp = `\d           list tables
+\d NAME      describe table NAME
+\timing      toggle timing of statements
+\history     show statement history
+\q           quit
+\?           this help
+`
+
+func (s *sqlShell) Run(in io.Reader) error {
+	s.loadHistory()
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	pending := ""
+	for {
+		if s.prompt {
+			if pending == "" {
+				fmt.Fprint(s.out, "sqlsh> ")
+			} else {
+				fmt.Fprint(s.out, "  ...> ")
+			}
+		}
+		if !scanner.Scan() {
+			break
+		}
+		line := scanner.Text()
+		if pending == "" && strings.HasPrefix(strings.TrimSpace(line), `\`) {
+			if quit := s.command(strings.Fields(strings.TrimSpace(line))); quit {
+				return nil
+			}
+			continue
+		}
+		var statements []string
+		statements, pending = splitStatements(pending + line + "\n")
+		for _, stmt := range statements {
+			s.addHistory(stmt)
+			s.execute(stmt)
+		}
+	}
+	if strings.TrimSpace(pending) != "" {
+		fmt.Fprintln(s.out, "Incomplete statement discarded; end statements with ;")
+	}
+	return scanner.Err()
+}
+
+// command runs a backslash command and reports whether to quit.
+func (s *sqlShell) command(args []string) bool {
+	switch {
+	case args[0] == `\q`:
+		return true
+	case args[0] == `\d` && len(args) == 1:
+		s.listTables()
+	case args[0] == `\d` && len(args) == 2:
+		s.describeTable(args[1])
+	case args[0] == `\timing`:
+		s.timing = !s.timing
+		state := "off"
+		if s.timing {
+			state = "on"
+		}
+		fmt.Fprintln(s.out, "Timing is", state+".")
+	case args[0] == `\history`:
+		for i, stmt := range s.history {
+			fmt.Fprintf(s.out, "%4d  %s\n", i+1, stmt)
+		}
+	case args[0] == `\?`:
+		fmt.Fprint(s.out, sqlShellHelp)
+	default:
+		fmt.Fprintf(s.out, "Unknown command %s. Try \\?\n", strings.Join(args, " "))
+	}
+	return false
+}
+
+func (s *sqlShell) listTables() {
+	tables, err := s.inspector.Tables()
+	if err != nil {
+		fmt.Fprintln(s.out, "ERROR:", err)
+		return
+	}
+	rows := make([][]string, len(tables))
+	for i, t := range tables {
+		name := t.Name
+		if t.Schema != "" {
+			name = t.Schema + "." + t.Name
+		}
+		rows[i] = []string{name, t.Type}
+	}
+	renderTable(s.out, []string{"name", "type"}, rows)
+}
+
+func (s *sqlShell) describeTable(name string) {
+	t, err := s.inspector.Table(name)
+	if err != nil {
+		fmt.Fprintln(s.out, "ERROR:", err)
+		return
+	}
+	rows := make([][]string, len(t.Columns))
+	for i, c := range t.Columns {
+		def := "NULL"
+		if c.Default != nil {
+			def = *c.Default
+		}
+		column := c.Name
+		if c.Family != "" {
+			column = c.Family + "." + c.Name
+		}
+		rows[i] = []string{column, c.Type, strconv.FormatBool(c.Nullable), def}
+	}
+	renderTable(s.out, []string{"column", "type", "nullable", "default"}, rows)
+	fmt.Fprintf(s.out, "Primary key: %s\n", strings.Join(t.PrimaryKey, ", "))
+	for _, index := range t.Indexes {
+		unique := ""
+		if index.Unique {
+			unique = " UNIQUE"
+		}
+		fmt.Fprintf(s.out, "Index%s %s: %s\n", unique, index.Name, strings.Join(index.Columns, ", "))
+	}
+	attributes := make([]string, 0, len(t.Attributes))
+	for k, v := range t.Attributes {
+		attributes = append(attributes, k+"="+v)
+	}
+	sort.Strings(attributes)
+	if len(attributes) > 0 {
+		fmt.Fprintf(s.out, "Attributes: %s\n", strings.Join(attributes, ", "))
+	}
+}
+
+func (s *sqlShell) execute(stmt string) {
+	// Phoenix rejects the trailing semicolon
+	s.query(strings.TrimSuffix(strings.TrimSpace(stmt), ";"))
+}
+
+// resultColumns returns the columns of rows, and false if the statement gave
+// no result set at all. The avatica driver panics in Columns then, as Phoenix
+// sends only an update count for statements that change rows.
+func resultColumns(rows *sql.Rows) (cols []string, ok bool, err error) {
+	defer func() {
+		if recover() != nil {
+			cols, ok, err = nil, false, nil
+		}
+	}()
+	cols, err = rows.Columns()
+	return cols, true, err
+}
+
+// query runs any statement as a query, and shows its rows if it has columns.
+// Statements without are run to completion, leaving no rows affected to show
+// as the count only comes with Exec.
+func (s *sqlShell) query(query string) {
+	start := time.Now()
+	rows, err := s.db.Query(query)
+	if err != nil {
+		fmt.Fprintln(s.out, "ERROR:", err)
+		return
+	}
+	cols, ok, err := resultColumns(rows)
+	if err != nil {
+		rows.Close()
+		fmt.Fprintln(s.out, "ERROR:", err)
+		return
+	}
+	if len(cols) == 0 {
+		// SQLite only runs the statement on the first Next
+		for ok && rows.Next() {
+		}
+		if err := rows.Err(); err != nil {
+			fmt.Fprintln(s.out, "ERROR:", err)
+			return
+		}
+		rows.Close()
+		fmt.Fprintln(s.out, "OK")
+		s.printTiming(start)
+		return
+	}
+	it, err := IterSlices(rows)
+	if err != nil {
+		fmt.Fprintln(s.out, "ERROR:", err)
+		return
+	}
+	table := [][]string{}
+	for it.Next() {
+		row := make([]string, len(cols))
+		for i, v := range it.Value() {
+			if v == nil {
+				row[i] = "NULL"
+			} else {
+				row[i] = formatCSVValue(v)
+			}
+		}
+		table = append(table, row)
+	}
+	if err := it.Err(); err != nil {
+		fmt.Fprintln(s.out, "ERROR:", err)
+		return
+	}
+	renderTable(s.out, cols, table)
+	s.printTiming(start)
+}
+
+func (s *sqlShell) printTiming(start time.Time) {
+	if s.timing {
+		fmt.Fprintf(s.out, "Time: %.3f ms\n", float64(time.Since(start).Microseconds())/1000)
+	}
+}
+
+func (s *sqlShell) loadHistory() {
+	if s.historyFile == "" {
+		return
+	}
+	data, err := os.ReadFile(s.historyFile)
+	if err != nil {
+		return
+	}
+	for _, stmt := range strings.Split(string(data), "\x00") {
+		if stmt != "" {
+			s.history = append(s.history, stmt)
+		}
+	}
+}
+
+// addHistory records stmt, NUL separated in the history file as statements
+// span lines.
+func (s *sqlShell) addHistory(stmt string) {
+	stmt = strings.TrimSpace(stmt)
+	s.history = append(s.history, stmt)
+	if s.historyFile == "" {
+		return
+	}
+	f, err := os.OpenFile(s.historyFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	f.WriteString(stmt + "\x00")
+}
+
+// splitStatements cuts complete statements, ended by a semicolon outside
+// quotes and comments, from input and returns the incomplete rest.
+func splitStatements(input string) (statements []string, rest string) {
+	start := 0
+	var quote rune
+	comment := false
+	for i, r := range input {
+		switch {
+		case comment:
+			comment = r != '\n'
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case r == '-' && strings.HasPrefix(input[i:], "--"):
+			comment = true
+		case r == ';':
+			if stmt := strings.TrimSpace(input[start : i+1]); stmt != ";" {
+				statements = append(statements, stmt)
+			}
+			start = i + 1
+		}
+	}
+	rest = input[start:]
+	if strings.TrimSpace(rest) == "" {
+		rest = ""
+	}
+	return statements, rest
+}
+
+// renderTable writes rows as an aligned table:
+//
+//	 id | email
+//	----+----------------------
+//	  1 | arunsworld@gmail.com
+//	(1 row)
+func renderTable(w io.Writer, cols []string, rows [][]string) {
+	widths := make([]int, len(cols))
+	// Right align columns of numbers, which may have NULLs but not only NULLs
+	numeric := make([]bool, len(cols))
+	notNumeric := make([]bool, len(cols))
+	for i, col := range cols {
+		widths[i] = utf8.RuneCountInString(col)
+	}
+	for _, row := range rows {
+		for i, v := range row {
+			if n := utf8.RuneCountInString(v); n > widths[i] {
+				widths[i] = n
+			}
+			if v != "NULL" {
+				numeric[i] = isNumeric(v) && !notNumeric[i]
+				notNumeric[i] = !numeric[i]
+			}
+		}
+	}
+	line := func(cells []string, alignRight []bool) {
+		b := bytes.Buffer{}
+		for i, v := range cells {
+			if i > 0 {
+				b.WriteString(" |")
+			}
+			pad := strings.Repeat(" ", widths[i]-utf8.RuneCountInString(v))
+			if alignRight[i] {
+				b.WriteString(" " + pad + v)
+			} else {
+				b.WriteString(" " + v + pad)
+			}
+		}
+		fmt.Fprintln(w, strings.TrimRight(b.String(), " "))
+	}
+	line(cols, make([]bool, len(cols)))
+	rule := make([]string, len(cols))
+	for i := range cols {
+		rule[i] = strings.Repeat("-", widths[i]+2)
+	}
+	fmt.Fprintln(w, strings.Join(rule, "+"))
+	for _, row := range rows {
+		line(row, numeric)
+	}
+	fmt.Fprintf(w, "(%d %s)\n", len(rows), plural(int64(len(rows)), "row"))
+}
+
+func isNumeric(v string) bool {
+	_, err := fmt.Sscanf(v, "%g", new(float64))
+	return err == nil && strings.Trim(v, "0123456789.-+eE") == ""
+}
+
+func plural(n int64, word string) string {
+	if n == 1 {
+		return word
+	}
+	return word + "s"
+}
+
+// TestSQLShell is the sqlsh command. go test doesn't pass stdin on, so
+// `make sqlsh` builds the test binary and runs it directly, e.g.
+//
+//	make sqlsh DRIVER=sqlite3 DSN=file:/tmp/test.db
+//	make sqlsh DRIVER=avatica DSN=http://172.16.3.196:8765
+func TestSQLShell(t *testing.T) {
+	if os.Getenv("SQLSH_DRIVER") == "" {
+		t.Skip("Set SQLSH_DRIVER and SQLSH_DSN to run the SQL shell.")
+	}
+	db, inspector, err := openShellDB(os.Getenv("SQLSH_DRIVER"), os.Getenv("SQLSH_DSN"))
+	if err != nil {
+		t.Fatal("Could not open DB: ", err)
+	}
+	defer db.Close()
+	home, _ := os.UserHomeDir()
+	shell := &sqlShell{db: db, inspector: inspector, out: os.Stdout, prompt: true, historyFile: filepath.Join(home, ".sqlsh_history")}
+	if err := shell.Run(os.Stdin); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSplitStatements(t *testing.T) {
+	statements, rest := splitStatements("SELECT 1; SELECT ';' -- a ; comment\n, \"a;b\";\nINSERT INTO T\n")
+	if len(statements) != 2 || statements[0] != "SELECT 1;" || !strings.HasSuffix(statements[1], `"a;b";`) {
+		t.Errorf("Unexpected statements: %q", statements)
+	}
+	if rest != "\nINSERT INTO T\n" {
+		t.Errorf("Expected the incomplete INSERT to remain. Got: %q", rest)
+	}
+	if statements, rest := splitStatements(" ; \n"); len(statements) != 0 || rest != "" {
+		t.Errorf("Expected empty statements to be dropped. Got %q, %q", statements, rest)
+	}
+}
+
+func TestSQLShellSession(t *testing.T) {
+	db, inspector, err := openShellDB("gorm", "file:"+filepath.Join(t.TempDir(), "sqlsh.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := migrateSchema(db); err != nil {
+		t.Fatal(err)
+	}
+	out := bytes.Buffer{}
+	history := filepath.Join(t.TempDir(), "history")
+	shell := &sqlShell{db: db, inspector: inspector, out: &out, historyFile: history}
+	session := `INSERT INTO "USERS" ("email", "password", "first_name", "last_name", "is_active")
+	VALUES ('arunsworld@gmail.com', 'x', 'Arun', 'Barua', 1), ('arun@e2open.com', 'x', 'Arun', NULL, 0);
+\d
+SELECT id, email,
+	last_name
+FROM USERS ORDER BY id;
+\timing
+DELETE FROM USERS WHERE id = 42;
+\d USERS
+SELECT nonsense FROM USERS;
+\q
+SELECT 'not reached';
+`
+	if err := shell.Run(strings.NewReader(session)); err != nil {
+		t.Fatal(err)
+	}
+	output := out.String()
+	for _, expected := range []string{
+		"ERROR: NOT NULL constraint failed: USERS.last_name",
+		" USERS             | table\n",
+		" schema_migrations | table\n",
+		"Timing is on.",
+		"OK\nTime: ",
+		" email      | varchar(75)  | false    | NULL",
+		"ERROR: no such column: nonsense",
+	} {
+		if !strings.Contains(output, expected) {
+			t.Errorf("Expected the output to contain %q. Got:\n%s", expected, output)
+		}
+	}
+	if strings.Contains(output, "not reached") {
+		t.Error("Expected \\q to end the session.")
+	}
+
+	// Fix the insert and check the aligned result
+	out.Reset()
+	shell.timing = false
+	shell.Run(strings.NewReader(`INSERT INTO "USERS" ("email", "password", "first_name", "last_name", "is_active") VALUES ('arunsworld@gmail.com', 'x', 'Arun', 'Barua', 1);
+SELECT id, email, NULLIF(last_name, 'Barua') AS last_name FROM USERS;
+`))
+	expected := `OK
+ id | email                | last_name
+----+----------------------+-----------
+  1 | arunsworld@gmail.com | NULL
+(1 row)
+`
+	if !strings.HasPrefix(out.String(), expected) {
+		t.Errorf("Expected:\n%s\nGot:\n%s", expected, out.String())
+	}
+
+	// History survives into the next session
+	next := &sqlShell{db: db, inspector: inspector, out: &out, historyFile: history}
+	out.Reset()
+	next.Run(strings.NewReader("\\history\n"))
+	if !strings.Contains(out.String(), "   6  SELECT id, email, NULLIF") {
+		t.Error("Expected the history of the earlier sessions. Got:\n", out.String())
+	}
+}
+
+func TestSQLShellStatementKinds(t *testing.T) {
+	db, inspector, err := openShellDB("sqlite3", "file:"+filepath.Join(t.TempDir(), "sqlsh.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := migrateSchema(db); err != nil {
+		t.Fatal(err)
+	}
+	out := bytes.Buffer{}
+	shell := &sqlShell{db: db, inspector: inspector, out: &out}
+	shell.Run(strings.NewReader(`WITH new AS (SELECT 'arun@e2open.com' AS email)
+	INSERT INTO "USERS" ("email", "password", "first_name", "last_name", "is_active") SELECT email, 'x', 'Arun', 'B', 1 FROM new;
+PRAGMA cache_size = 100;
+SELECT a.id, b.id, a.email FROM USERS a JOIN USERS b ON b.id = a.id;
+`))
+	expected := `OK
+OK
+ id | id | email
+----+----+-----------------
+  1 |  1 | arun@e2open.com
+(1 row)
+`
+	if out.String() != expected {
+		t.Errorf("Expected:\n%s\nGot:\n%s", expected, out.String())
+	}
+
+	// Phoenix answers an UPSERT with an update count and no result set
+	phoenix := openFakePhoenix(t)
+	out.Reset()
+	shell = &sqlShell{db: phoenix, inspector: newPhoenixInspector(phoenix), out: &out}
+	shell.Run(strings.NewReader(`UPSERT INTO USERS (email, password, first_name, last_name, is_active) VALUES ('arun@e2open.com', 'x', 'Arun', 'B', true);
+SELECT email FROM USERS;
+`))
+	if !strings.HasPrefix(out.String(), "OK\n email\n") {
+		t.Error("Expected the upsert to run and its row to be found. Got:\n", out.String())
+	}
+}
+
+func TestRenderTableAlignsNumbers(t *testing.T) {
+	out := bytes.Buffer{}
+	renderTable(&out, []string{"n", "maybe", "nothing", "text"}, [][]string{
+		{"1", "NULL", "NULL", "a"},
+		{"100", "2.5", "NULL", "10"},
+	})
+	// NULLs don't stop a column of numbers being right aligned, but a column
+	// of only NULLs or with any text stays left aligned
+	expected := ` n   | maybe | nothing | text
+-----+-------+---------+------
+   1 |  NULL | NULL    | a
+ 100 |   2.5 | NULL    | 10
+(2 rows)
+`
+	if out.String() != expected {
+		t.Errorf("Expected:\n%s\nGot:\n%s", expected, out.String())
+	}
+}
@@ -0,0 +1,561 @@
+package learning
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// SupervisedJob is a long-running job like infiniteJob. It should run until
+// ctx ends, calling heartbeat regularly to show it is alive. Returning an error
+// or panicking gets it restarted; returning nil means it finished for good.
+type SupervisedJob func(ctx context.Context, heartbeat func()) error
+
+type RestartStrategy int
+
+const (
+	// OneForOne restarts only the job that failed.
+	OneForOne RestartStrategy = iota
+	// OneForAll stops every job when one fails and restarts them all.
+	OneForAll
+)
+
+type JobState string
+
+const (
+	JobRunning    JobState = "RUNNING"
+	JobRestarting JobState = "RESTARTING"
+	JobCompleted  JobState = "COMPLETED"
+	JobFailed     JobState = "FAILED"
+	JobStopped    JobState = "STOPPED"
+)
+
+var ErrTooManyRestarts = errors.New("too many restarts")
+
+// SupervisorConfig controls restarts. Zero values fall back to the defaults
+// noted on each field.
+type SupervisorConfig struct {
+	Strategy         RestartStrategy
+	MaxRestarts      int           // per job within Window before giving up; default 5
+	Window           time.Duration // default 1m
+	MinBackoff       time.Duration // delay before the first restart, doubling after; default 100ms
+	MaxBackoff       time.Duration // default 10s
+	HeartbeatTimeout time.Duration // a running job is unhealthy without a heartbeat this long; 0 disables
+}
+
+// JobHealth is a snapshot of a supervised job.
+type JobHealth struct {
+	Name          string
+	State         JobState
+	Healthy       bool
+	Restarts      int
+	LastError     error
+	StartedAt     time.Time
+	LastHeartbeat time.Time
+}
+
+type supervisedJob struct {
+	name string
+	run  SupervisedJob
+
+	// guarded by Supervisor.mu
+	health   JobHealth
+	failures []time.Time
+	cancel   context.CancelFunc
+
+	// only touched by Run
+	running, restartPending, completed bool
+}
+
+type jobExit struct {
+	job     *supervisedJob
+	err     error
+	stopped bool // the job's context had ended by the time it returned
+}
+
+// Supervisor runs named jobs and restarts them when they fail, with
+// exponential backoff and a cap on restarts.
+type Supervisor struct {
+	cfg SupervisorConfig
+
+	mu   sync.Mutex
+	jobs []*supervisedJob
+}
+
+func NewSupervisor(cfg SupervisorConfig) *Supervisor {
+	if cfg.MaxRestarts <= 0 {
+		cfg.MaxRestarts = 5
+	}
+	if cfg.Window <= 0 {
+		cfg.Window = time.Minute
+	}
+	if cfg.MinBackoff <= 0 {
+		cfg.MinBackoff = time.Millisecond * 100
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = time.Second * 10
+	}
+	return &Supervisor{cfg: cfg}
+}
+
+// Add registers a job. Jobs must be added before Run.
+func (s *Supervisor) Add(name string, job SupervisedJob) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs = append(s.jobs, &supervisedJob{name: name, run: job, health: JobHealth{Name: name}})
+}
+
+// Health reports on every job in the order they were added.
+func (s *Supervisor) Health() []JobHealth {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	result := make([]JobHealth, len(s.jobs))
+	for i, j := range s.jobs {
+		h := j.health
+		h.Healthy = h.State == JobRunning
+		if h.Healthy && s.cfg.HeartbeatTimeout > 0 {
+			last := h.LastHeartbeat
+			if last.Before(h.StartedAt) {
+				last = h.StartedAt
+			}
+			h.Healthy = now.Sub(last) < s.cfg.HeartbeatTimeout
+		}
+		result[i] = h
+	}
+	return result
+}
+
+// Run starts every job and supervises them until ctx ends, when it stops them
+// all and returns nil. If a job exceeds MaxRestarts within Window, Run stops
+// everything and returns an error wrapping ErrTooManyRestarts.
+func (s *Supervisor) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	exits := make(chan jobExit)
+	restarts := make(chan *supervisedJob)
+	running, pendingRestarts := 0, 0
+	restartingAll := false
+	var failure error
+
+	start := func(j *supervisedJob) {
+		jobCtx, jobCancel := context.WithCancel(ctx)
+		s.mu.Lock()
+		j.cancel = jobCancel
+		j.health.State = JobRunning
+		j.health.StartedAt = time.Now()
+		s.mu.Unlock()
+		j.running = true
+		running++
+		go func() {
+			err := s.invoke(jobCtx, j)
+			exits <- jobExit{job: j, err: err, stopped: jobCtx.Err() != nil}
+		}()
+	}
+	restartAfter := func(j *supervisedJob, d time.Duration) {
+		j.restartPending = true
+		pendingRestarts++
+		go func() {
+			select {
+			case <-time.After(d):
+			case <-ctx.Done():
+			}
+			restarts <- j
+		}()
+	}
+	// restartStopped restarts the jobs of a one-for-all round once they have
+	// all stopped. Jobs already waiting to restart keep their timer and jobs
+	// that finished for good stay finished.
+	restartStopped := func() {
+		restartingAll = false
+		for _, j := range s.jobs {
+			if !j.running && !j.restartPending && !j.completed {
+				restartAfter(j, s.backoff(j))
+			}
+		}
+	}
+
+	for _, j := range s.jobs {
+		start(j)
+	}
+	done := ctx.Done()
+	for running > 0 || pendingRestarts > 0 {
+		select {
+		case e := <-exits:
+			running--
+			e.job.running = false
+			e.job.cancel()
+			if ctx.Err() != nil {
+				s.setState(e.job, JobStopped, nil)
+				continue
+			}
+			if e.err == nil && !e.stopped {
+				// Finished for good, even if a one-for-all round has begun
+				e.job.completed = true
+				s.setState(e.job, JobCompleted, nil)
+			}
+			if restartingAll {
+				// A sibling we stopped for a one-for-all restart
+				if running == 0 {
+					restartStopped()
+				}
+				continue
+			}
+			if e.job.completed {
+				continue
+			}
+			if !s.recordFailure(e.job, e.err) {
+				failure = fmt.Errorf("job %s: %w after %d in %s: %v", e.job.name, ErrTooManyRestarts, s.cfg.MaxRestarts, s.cfg.Window, e.err)
+				s.setState(e.job, JobFailed, e.err)
+				cancel()
+				continue
+			}
+			if s.cfg.Strategy == OneForAll {
+				restartingAll = true
+				s.mu.Lock()
+				for _, j := range s.jobs {
+					if j.completed {
+						continue
+					}
+					j.health.State = JobRestarting
+					if j.running {
+						j.cancel()
+					}
+				}
+				s.mu.Unlock()
+				if running == 0 {
+					restartStopped()
+				}
+				continue
+			}
+			restartAfter(e.job, s.backoff(e.job))
+		case j := <-restarts:
+			pendingRestarts--
+			j.restartPending = false
+			if ctx.Err() != nil {
+				s.setState(j, JobStopped, nil)
+				continue
+			}
+			if restartingAll {
+				// Restarted with the others once they have all stopped
+				continue
+			}
+			start(j)
+		case <-done:
+			done = nil
+			s.mu.Lock()
+			for _, j := range s.jobs {
+				if j.cancel != nil {
+					j.cancel()
+				}
+			}
+			s.mu.Unlock()
+		}
+	}
+	return failure
+}
+
+// invoke runs the job once, turning a panic into an error.
+func (s *Supervisor) invoke(ctx context.Context, j *supervisedJob) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &PanicError{Value: r, Stack: debug.Stack()}
+		}
+	}()
+	return j.run(ctx, func() {
+		s.mu.Lock()
+		j.health.LastHeartbeat = time.Now()
+		s.mu.Unlock()
+	})
+}
+
+// recordFailure notes a failure of j and reports whether it may be restarted.
+func (s *Supervisor) recordFailure(j *supervisedJob, err error) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	recent := j.failures[:0]
+	for _, at := range j.failures {
+		if now.Sub(at) < s.cfg.Window {
+			recent = append(recent, at)
+		}
+	}
+	j.failures = append(recent, now)
+	j.health.LastError = err
+	if len(j.failures) > s.cfg.MaxRestarts {
+		return false
+	}
+	j.health.Restarts++
+	j.health.State = JobRestarting
+	return true
+}
+
+// backoff doubles with every recent failure of j, up to MaxBackoff.
+func (s *Supervisor) backoff(j *supervisedJob) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d := s.cfg.MinBackoff
+	for i := 1; i < len(j.failures) && d < s.cfg.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > s.cfg.MaxBackoff {
+		d = s.cfg.MaxBackoff
+	}
+	return d
+}
+
+func (s *Supervisor) setState(j *supervisedJob, state JobState, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j.health.State = state
+	if err != nil {
+		j.health.LastError = err
+	}
+}
+
+// supervisedInfiniteJob is infiniteJob reporting liveness through heartbeat
+// instead of the log.
+func supervisedInfiniteJob(interval time.Duration) SupervisedJob {
+	return func(ctx context.Context, heartbeat func()) error {
+		heartbeat()
+		for {
+			select {
+			case <-time.After(interval):
+				heartbeat()
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	}
+}
+
+func healthOf(s *Supervisor, name string) JobHealth {
+	for _, h := range s.Health() {
+		if h.Name == name {
+			return h
+		}
+	}
+	return JobHealth{}
+}
+
+func waitForState(t *testing.T, s *Supervisor, name string, state JobState) JobHealth {
+	deadline := time.Now().Add(time.Second * 5)
+	for time.Now().Before(deadline) {
+		if h := healthOf(s, name); h.State == state {
+			return h
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("Job %s never reached %s. Last: %+v", name, state, healthOf(s, name))
+	return JobHealth{}
+}
+
+func TestSupervisorOneForOne(t *testing.T) {
+	checkGoroutineLeaks(t)
+	sup := NewSupervisor(SupervisorConfig{MinBackoff: time.Millisecond})
+	var flakyRuns, steadyRuns int64
+	sup.Add("flaky", func(ctx context.Context, heartbeat func()) error {
+		switch atomic.AddInt64(&flakyRuns, 1) {
+		case 1:
+			return errors.New("lost connection")
+		case 2:
+			panic("nil map")
+		}
+		<-ctx.Done()
+		return nil
+	})
+	sup.Add("steady", func(ctx context.Context, heartbeat func()) error {
+		atomic.AddInt64(&steadyRuns, 1)
+		return supervisedInfiniteJob(time.Millisecond)(ctx, heartbeat)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error)
+	go func() { result <- sup.Run(ctx) }()
+
+	for atomic.LoadInt64(&flakyRuns) < 3 {
+		time.Sleep(time.Millisecond)
+	}
+	flaky := waitForState(t, sup, "flaky", JobRunning)
+	if flaky.Restarts != 2 {
+		t.Error("Expected flaky to have restarted twice. Got:", flaky.Restarts)
+	}
+	var panicErr *PanicError
+	if !errors.As(flaky.LastError, &panicErr) {
+		t.Error("Expected the last error to be the panic. Got:", flaky.LastError)
+	}
+	if steadyRuns != 1 {
+		t.Error("Expected one-for-one to leave steady alone. Runs:", steadyRuns)
+	}
+
+	cancel()
+	if err := <-result; err != nil {
+		t.Error("Expected a clean stop. Got:", err)
+	}
+	for _, h := range sup.Health() {
+		if h.State != JobStopped {
+			t.Errorf("Expected %s to be stopped. Got %s.", h.Name, h.State)
+		}
+	}
+}
+
+func TestSupervisorOneForAll(t *testing.T) {
+	checkGoroutineLeaks(t)
+	sup := NewSupervisor(SupervisorConfig{Strategy: OneForAll, MinBackoff: time.Millisecond})
+	var failed, siblingRuns int64
+	sup.Add("failing", func(ctx context.Context, heartbeat func()) error {
+		if atomic.AddInt64(&failed, 1) == 1 {
+			return errors.New("bad state")
+		}
+		<-ctx.Done()
+		return nil
+	})
+	sup.Add("sibling", func(ctx context.Context, heartbeat func()) error {
+		atomic.AddInt64(&siblingRuns, 1)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error)
+	go func() { result <- sup.Run(ctx) }()
+
+	deadline := time.Now().Add(time.Second * 5)
+	for atomic.LoadInt64(&siblingRuns) < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if atomic.LoadInt64(&siblingRuns) != 2 {
+		t.Error("Expected the sibling to be restarted along with the failing job.")
+	}
+	cancel()
+	if err := <-result; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSupervisorOneForAllRunsOneInstanceOfEachJob(t *testing.T) {
+	checkGoroutineLeaks(t)
+	sup := NewSupervisor(SupervisorConfig{Strategy: OneForAll, MaxRestarts: 8, MinBackoff: time.Millisecond * 2, MaxBackoff: time.Millisecond * 100})
+	var mu sync.Mutex
+	instances, most := map[string]int{}, map[string]int{}
+	track := func(name string, job SupervisedJob) SupervisedJob {
+		return func(ctx context.Context, heartbeat func()) error {
+			mu.Lock()
+			instances[name]++
+			if instances[name] > most[name] {
+				most[name] = instances[name]
+			}
+			mu.Unlock()
+			defer func() {
+				mu.Lock()
+				instances[name]--
+				mu.Unlock()
+			}()
+			return job(ctx, heartbeat)
+		}
+	}
+	// No failures before oneshot is done, or its return would race its stop
+	afterOneshot := func() {
+		for healthOf(sup, "oneshot").State != JobCompleted {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	var oneshotRuns, slowRuns int64
+	sup.Add("failing", track("failing", func(ctx context.Context, heartbeat func()) error {
+		afterOneshot()
+		return errors.New("fails straight away")
+	}))
+	sup.Add("slow", track("slow", func(ctx context.Context, heartbeat func()) error {
+		afterOneshot()
+		// Its own failures give it a longer backoff than the failing job, so
+		// it is still waiting to restart when that fails again
+		if atomic.AddInt64(&slowRuns, 1) <= 2 {
+			return errors.New("slow to start")
+		}
+		<-ctx.Done()
+		return ctx.Err()
+	}))
+	sup.Add("oneshot", track("oneshot", func(ctx context.Context, heartbeat func()) error {
+		atomic.AddInt64(&oneshotRuns, 1)
+		return nil
+	}))
+
+	// Rounds start while earlier restarts are still pending
+	if err := sup.Run(context.Background()); !errors.Is(err, ErrTooManyRestarts) {
+		t.Fatal("Expected ErrTooManyRestarts. Got:", err)
+	}
+	for name, n := range most {
+		if n > 1 {
+			t.Errorf("Expected at most one instance of %s at a time. Got: %d", name, n)
+		}
+	}
+	if oneshotRuns != 1 {
+		t.Error("Expected the completed job to stay completed. Runs:", oneshotRuns)
+	}
+	if h := healthOf(sup, "oneshot"); h.State != JobCompleted {
+		t.Error("Expected oneshot to be completed. Got:", h.State)
+	}
+}
+
+func TestSupervisorGivesUpAfterMaxRestarts(t *testing.T) {
+	checkGoroutineLeaks(t)
+	sup := NewSupervisor(SupervisorConfig{MaxRestarts: 3, MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond * 4})
+	var runs int64
+	sup.Add("broken", func(ctx context.Context, heartbeat func()) error {
+		atomic.AddInt64(&runs, 1)
+		return errors.New("always fails")
+	})
+	sup.Add("bystander", supervisedInfiniteJob(time.Millisecond))
+
+	err := sup.Run(context.Background())
+	if !errors.Is(err, ErrTooManyRestarts) {
+		t.Fatal("Expected ErrTooManyRestarts. Got:", err)
+	}
+	if runs != 4 {
+		t.Error("Expected the first run plus 3 restarts. Got:", runs)
+	}
+	if h := healthOf(sup, "broken"); h.State != JobFailed || h.Restarts != 3 {
+		t.Errorf("Unexpected health for broken: %+v", h)
+	}
+	if h := healthOf(sup, "bystander"); h.State != JobStopped {
+		t.Error("Expected the bystander to be stopped. Got:", h.State)
+	}
+}
+
+func TestSupervisorHeartbeats(t *testing.T) {
+	checkGoroutineLeaks(t)
+	sup := NewSupervisor(SupervisorConfig{HeartbeatTimeout: time.Millisecond * 50})
+	sup.Add("alive", supervisedInfiniteJob(time.Millisecond*5))
+	sup.Add("stuck", func(ctx context.Context, heartbeat func()) error {
+		<-ctx.Done()
+		return nil
+	})
+	sup.Add("oneshot", func(ctx context.Context, heartbeat func()) error {
+		return nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	result := make(chan error)
+	go func() { result <- sup.Run(ctx) }()
+
+	time.Sleep(time.Millisecond * 75)
+	if h := healthOf(sup, "alive"); !h.Healthy || h.LastHeartbeat.IsZero() {
+		t.Errorf("Expected alive to be healthy. Got %+v.", h)
+	}
+	if h := healthOf(sup, "stuck"); h.Healthy || h.State != JobRunning {
+		t.Errorf("Expected stuck to be running but unhealthy. Got %+v.", h)
+	}
+	if h := healthOf(sup, "oneshot"); h.State != JobCompleted || h.Restarts != 0 {
+		t.Errorf("Expected oneshot to complete without restarts. Got %+v.", h)
+	}
+	if err := <-result; err != nil {
+		t.Error(err)
+	}
+}
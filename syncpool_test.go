@@ -1,8 +1,8 @@
 package learning
 
 import (
+	"context"
 	"log"
-	"sync"
 	"testing"
 )
 
@@ -21,38 +21,26 @@ func BenchmarkSyncPool(b *testing.B) {
 	}
 }
 
+// Shared across calls so that chunks are reused from one run to the next
+var chunkPool = NewBufferPool[int](false)
+
 func testSyncPool() []int {
-	pool := sync.Pool{
-		New: func() interface{} {
-			return make([]int, 1000)
-		},
-	}
-	ch := make(chan []int, 1000)
-	go func() {
-		// buffer := make([]int, 1000)
-		buffer := pool.Get().([]int)
-		counter := 0
-		for i := 0; i < 9999991; i++ {
-			if counter == 1000 {
-				ch <- buffer
-				// buffer = make([]int, 1000)
-				buffer = pool.Get().([]int)
-				counter = 0
+	stream := NewChunkedStream(context.Background(), ChunkedStreamConfig[int]{ChunkSize: 1000, MaxBuffered: 1000, Pool: chunkPool},
+		func(ctx context.Context, emit func(int) error) error {
+			for i := 0; i < 9999991; i++ {
+				if err := emit(i); err != nil {
+					return err
+				}
 			}
-			buffer[counter] = i
-			counter++
+			return nil
+		})
+	defer stream.Close()
+	data := make([]int, 0, 9999991)
+	for {
+		buffer, err := stream.Next()
+		if err != nil {
+			return data
 		}
-		ch <- buffer[:counter]
-		close(ch)
-	}()
-	data := make([]int, 0, 300000000)
-	// data := []int{}
-	for buffer := range ch {
-		// for _, v := range buffer {
-		// 	data = append(data, v)
-		// }
 		data = append(data, buffer...)
-		pool.Put(buffer)
 	}
-	return data
 }
@@ -0,0 +1,929 @@
+package learning
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var ErrCopyMismatch = errors.New("target does not match source")
+
+// TableCopy copies a table from one database to another, e.g. a Phoenix
+// table to SQLite for debugging, or back. Rows go in primary key order, in
+// batches of one transaction each, written in parallel. Writes replace rows
+// with the same key, so copying again, or resuming from a checkpoint, is safe.
+type TableCopy struct {
+	Source *sql.DB
+	// SourceSchema gives the source table's primary key and nullability; its
+	// column types come from the driver's column types
+	SourceSchema  SchemaInspector
+	Table         string // SCHEMA.TABLE or TABLE
+	Target        *sql.DB
+	TargetDialect copyDialect
+	// TargetTable defaults to Table without its schema. It is created if it
+	// doesn't exist.
+	TargetTable string
+	BatchSize   int // rows per batch, 1000 by default
+	Parallelism int // batches written at once, 1 by default
+	// Checkpoint, if set, is a file recording the copy's progress, from
+	// which an interrupted copy resumes. It is removed once the copy completes.
+	Checkpoint string
+	// Checksum compares the data in both tables after the copy, not just
+	// the number of rows, reading each table again.
+	Checksum bool
+}
+
+type TableCopyResult struct {
+	Columns        []CopyColumn
+	Resumed        bool  // from a checkpoint
+	Copied         int64 // rows copied by this run
+	SourceRows     int64
+	TargetRows     int64
+	SourceChecksum string // if Checksum is set
+	TargetChecksum string
+}
+
+type CopyColumn struct {
+	Name       string
+	SourceType string
+	Type       string // in the target
+	Kind       string // of values, see valueKind
+	Nullable   bool
+}
+
+// copyDialect is how a copy writes to a kind of database.
+type copyDialect struct {
+	// types are the column types for kinds of value. KindNull is for
+	// columns of unknown type, which a dialect without it can't copy.
+	types  map[string]string
+	insert string // a statement that inserts or replaces rows
+	// keyOnlyNotNull puts NOT NULL on primary key columns only, for
+	// databases that refuse it elsewhere
+	keyOnlyNotNull bool
+}
+
+// SQLite has no exact decimal type: TEXT keeps decimals as they are. Columns
+// of unknown type stay untyped.
+var sqliteCopyDialect = copyDialect{
+	types: map[string]string{
+		KindInt64: "INTEGER", KindFloat64: "REAL", KindDecimal: "TEXT", KindBool: "BOOLEAN", KindString: "TEXT",
+		KindBytes: "BLOB", KindTime: "TIMESTAMP", KindNull: "",
+	},
+	insert: "INSERT OR REPLACE INTO",
+}
+
+// Phoenix needs a type for every column and allows NOT NULL only in the
+// primary key.
+var phoenixCopyDialect = copyDialect{
+	types: map[string]string{
+		KindInt64: "BIGINT", KindFloat64: "DOUBLE", KindDecimal: "DECIMAL", KindBool: "BOOLEAN", KindString: "VARCHAR",
+		KindBytes: "VARBINARY", KindTime: "TIMESTAMP",
+	},
+	insert:         "UPSERT INTO",
+	keyOnlyNotNull: true,
+}
+
+// copyDialectFor takes the drivers openShellDB takes.
+func copyDialectFor(driver string) (copyDialect, error) {
+	switch driver {
+	case "sqlite3", "gorm":
+		return sqliteCopyDialect, nil
+	case "avatica":
+		return phoenixCopyDialect, nil
+	}
+	return copyDialect{}, fmt.Errorf("unknown driver %q: use sqlite3, avatica or gorm", driver)
+}
+
+// KindDecimal is the kind of DECIMAL and NUMERIC columns, whose values are
+// copied as exact decimal strings rather than floats.
+const KindDecimal = "decimal"
+
+// databaseTypeKind is the kind of value a column of a SQLite or Phoenix type
+// holds, or KindNull if unknown. It follows SQLite's rules for type affinity,
+// which cover Phoenix's names too, e.g. UNSIGNED_LONG, and SQLite's
+// declared types like varchar(75).
+func databaseTypeKind(typ string) string {
+	typ = strings.ToUpper(typ)
+	switch {
+	case strings.Contains(typ, "BOOL"):
+		return KindBool
+	case strings.Contains(typ, "INT") || strings.Contains(typ, "LONG"):
+		return KindInt64
+	case strings.Contains(typ, "CHAR") || strings.Contains(typ, "CLOB") || strings.Contains(typ, "TEXT"):
+		return KindString
+	case strings.Contains(typ, "BLOB") || strings.Contains(typ, "BINARY"):
+		return KindBytes
+	case strings.Contains(typ, "DATE") || strings.Contains(typ, "TIME"):
+		return KindTime
+	case strings.Contains(typ, "DECIMAL") || strings.Contains(typ, "NUMERIC"):
+		return KindDecimal
+	case strings.Contains(typ, "REAL") || strings.Contains(typ, "FLOA") || strings.Contains(typ, "DOUB"):
+		return KindFloat64
+	}
+	return KindNull
+}
+
+// copyValue converts v to the kind of its column where drivers differ: SQLite
+// has no booleans and returns decimals as whatever it stored them as, Phoenix
+// returns DECIMAL as a string and FLOAT as float32.
+func copyValue(v interface{}, kind string) interface{} {
+	switch kind {
+	case KindDecimal:
+		switch n := v.(type) {
+		case int64:
+			return strconv.FormatInt(n, 10)
+		case float64:
+			return strconv.FormatFloat(n, 'f', -1, 64)
+		case []byte:
+			return string(n)
+		}
+	case KindBool:
+		if n, ok := v.(int64); ok {
+			return n != 0
+		}
+	case KindFloat64:
+		switch n := v.(type) {
+		case float32:
+			return float64(n)
+		case int64:
+			return float64(n)
+		case string:
+			if f, err := strconv.ParseFloat(n, 64); err == nil {
+				return f
+			}
+		}
+	}
+	return v
+}
+
+// tableCheckpoint is the key of the last row of the copy's last batch before
+// which all batches are written.
+type tableCheckpoint struct {
+	Source string        `json:"source"`
+	Target string        `json:"target"`
+	Key    []interface{} `json:"key"`
+	Rows   int64         `json:"rows"`
+}
+
+func (c *TableCopy) Run() (TableCopyResult, error) {
+	result := TableCopyResult{}
+	info, err := c.SourceSchema.Table(c.Table)
+	if err != nil {
+		return result, err
+	}
+	if len(info.PrimaryKey) == 0 {
+		return result, fmt.Errorf("table %s has no primary key to copy in order of", c.Table)
+	}
+	target := TableInfo{Name: info.Name}
+	if c.TargetTable != "" {
+		target.Schema, target.Name = splitQualifiedName(c.TargetTable)
+	}
+	result.Columns, err = c.columns(info)
+	if err != nil {
+		return result, err
+	}
+	key, err := copyKey(result.Columns, info.PrimaryKey)
+	if err != nil {
+		return result, err
+	}
+	if _, err := c.Target.Exec(createCopyTableSQL(c.TargetDialect, target, result.Columns, key)); err != nil {
+		return result, fmt.Errorf("creating %s: %w", target.QualifiedName(), err)
+	}
+
+	cp := &tableCheckpoint{Source: info.QualifiedName(), Target: target.QualifiedName()}
+	if c.Checkpoint != "" {
+		if result.Resumed, err = loadTableCheckpoint(c.Checkpoint, cp, result.Columns, key); err != nil {
+			return result, err
+		}
+	}
+	copier := tableCopier{TableCopy: c, columns: result.Columns, key: key, source: info, target: target, checkpoint: cp}
+	result.Copied, err = copier.run()
+	if err != nil {
+		return result, err
+	}
+	if c.Checkpoint != "" {
+		if err := os.Remove(c.Checkpoint); err != nil && !os.IsNotExist(err) {
+			return result, err
+		}
+	}
+	return result, c.verify(&result, info, target, key)
+}
+
+// columns reads the source's column types from a query for no rows.
+func (c *TableCopy) columns(info TableInfo) ([]CopyColumn, error) {
+	rows, err := c.Source.Query(`SELECT * FROM ` + info.QualifiedName() + ` WHERE 1 = 0`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+	nullable := map[string]bool{}
+	for _, col := range info.Columns {
+		nullable[strings.ToUpper(col.Name)] = col.Nullable
+	}
+	columns := make([]CopyColumn, len(types))
+	for i, ct := range types {
+		col := CopyColumn{Name: ct.Name(), SourceType: ct.DatabaseTypeName(), Kind: databaseTypeKind(ct.DatabaseTypeName()), Nullable: true}
+		typ, ok := c.TargetDialect.types[col.Kind]
+		if !ok {
+			return nil, fmt.Errorf("column %s: the target has no type for a column declared %q", col.Name, col.SourceType)
+		}
+		col.Type = typ
+		if n, ok := nullable[strings.ToUpper(col.Name)]; ok {
+			col.Nullable = n
+		}
+		columns[i] = col
+	}
+	return columns, rows.Err()
+}
+
+// copyKey is the positions of the primary key's columns. Names are matched
+// ignoring case as SQLite does.
+func copyKey(columns []CopyColumn, primaryKey []string) ([]int, error) {
+	key := make([]int, len(primaryKey))
+next:
+	for k, name := range primaryKey {
+		for i, col := range columns {
+			if strings.EqualFold(col.Name, name) {
+				key[k] = i
+				continue next
+			}
+		}
+		return nil, fmt.Errorf("primary key column %s is not in the table", name)
+	}
+	return key, nil
+}
+
+func createCopyTableSQL(dialect copyDialect, target TableInfo, columns []CopyColumn, key []int) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "CREATE TABLE IF NOT EXISTS %s (", target.QualifiedName())
+	isKey := map[int]bool{}
+	for _, k := range key {
+		isKey[k] = true
+	}
+	for i, col := range columns {
+		fmt.Fprintf(&b, "\n\t%s", quoteIdentifier(col.Name))
+		if col.Type != "" {
+			b.WriteString(" " + col.Type)
+		}
+		if isKey[i] || !col.Nullable && !dialect.keyOnlyNotNull {
+			b.WriteString(" NOT NULL")
+		}
+		b.WriteString(",")
+	}
+	fmt.Fprintf(&b, "\n\tCONSTRAINT %s PRIMARY KEY (%s)\n)", quoteIdentifier("PK_"+target.Name), copyColumnList(columns, key))
+	return b.String()
+}
+
+// copyColumnList quotes the names of columns at positions, or all columns.
+func copyColumnList(columns []CopyColumn, positions []int) string {
+	if positions == nil {
+		positions = make([]int, len(columns))
+		for i := range positions {
+			positions[i] = i
+		}
+	}
+	names := make([]string, len(positions))
+	for i, p := range positions {
+		names[i] = quoteIdentifier(columns[p].Name)
+	}
+	return strings.Join(names, ", ")
+}
+
+// loadTableCheckpoint reads the checkpoint from file into cp, if there is one
+// for the same copy.
+func loadTableCheckpoint(file string, cp *tableCheckpoint, columns []CopyColumn, key []int) (bool, error) {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	saved := tableCheckpoint{}
+	dec := json.NewDecoder(f)
+	dec.UseNumber()
+	if err := dec.Decode(&saved); err != nil {
+		return false, fmt.Errorf("checkpoint %s: %w", file, err)
+	}
+	if saved.Source != cp.Source || saved.Target != cp.Target || len(saved.Key) != len(key) {
+		return false, fmt.Errorf("checkpoint %s is for copying %s to %s", file, saved.Source, saved.Target)
+	}
+	// JSON loses the key's types, which its columns have
+	for i, v := range saved.Key {
+		if saved.Key[i], err = checkpointKeyValue(v, columns[key[i]].Kind); err != nil {
+			return false, fmt.Errorf("checkpoint %s: %w", file, err)
+		}
+	}
+	cp.Key, cp.Rows = saved.Key, saved.Rows
+	return true, nil
+}
+
+func checkpointKeyValue(v interface{}, kind string) (interface{}, error) {
+	switch v := v.(type) {
+	case json.Number:
+		if kind == KindFloat64 {
+			return v.Float64()
+		}
+		return v.Int64()
+	case string:
+		switch kind {
+		case KindTime:
+			return time.Parse(time.RFC3339Nano, v)
+		case KindBytes:
+			return base64.StdEncoding.DecodeString(v)
+		}
+	}
+	return v, nil
+}
+
+func saveTableCheckpoint(file string, cp *tableCheckpoint) error {
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	// Replace the checkpoint whole, so a crash leaves the old or the new one
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// tableCopier is one run of a TableCopy. One goroutine reads batches of rows
+// from the source, Parallelism goroutines write them, and run advances the
+// checkpoint as batches are written in order.
+type tableCopier struct {
+	*TableCopy
+	columns        []CopyColumn
+	key            []int
+	source, target TableInfo
+	checkpoint     *tableCheckpoint
+}
+
+type copyBatch struct {
+	seq  int
+	rows [][]interface{}
+}
+
+type copyBatchResult struct {
+	seq     int
+	rows    int64
+	lastKey []interface{}
+	err     error
+}
+
+func (c *tableCopier) run() (int64, error) {
+	batchSize, parallelism := c.BatchSize, c.Parallelism
+	if batchSize <= 0 {
+		batchSize = 1000
+	}
+	if parallelism <= 0 {
+		parallelism = 1
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	query := `SELECT ` + copyColumnList(c.columns, nil) + ` FROM ` + c.source.QualifiedName()
+	keyColumns := copyColumnList(c.columns, c.key)
+	if c.checkpoint.Key != nil {
+		query += ` WHERE (` + keyColumns + `) > (` + strings.TrimSuffix(strings.Repeat("?, ", len(c.key)), ", ") + `)`
+	}
+	rows, err := c.Source.QueryContext(ctx, query+` ORDER BY `+keyColumns, c.checkpoint.Key...)
+	if err != nil {
+		return 0, err
+	}
+
+	batches := make(chan copyBatch)
+	readErr := make(chan error, 1)
+	go func() {
+		defer close(batches)
+		readErr <- c.read(ctx, rows, batchSize, batches)
+	}()
+
+	insert := fmt.Sprintf(`%s %s (%s) VALUES (%s)`, c.TargetDialect.insert, c.target.QualifiedName(),
+		copyColumnList(c.columns, nil), strings.TrimSuffix(strings.Repeat("?, ", len(c.columns)), ", "))
+	results := make(chan copyBatchResult)
+	var wg sync.WaitGroup
+	for i := 0; i < parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := range batches {
+				results <- copyBatchResult{seq: b.seq, rows: int64(len(b.rows)), lastKey: c.rowKey(b.rows[len(b.rows)-1]), err: c.write(ctx, insert, b.rows)}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// Batches finish out of order; the checkpoint only passes a batch once
+	// all batches before it are written.
+	var copied int64
+	var firstErr error
+	written := map[int]copyBatchResult{}
+	next := 0
+	for r := range results {
+		if firstErr != nil {
+			continue
+		}
+		if r.err != nil {
+			firstErr = fmt.Errorf("writing rows after %v: %w", c.checkpoint.Key, r.err)
+			cancel()
+			continue
+		}
+		written[r.seq] = r
+		for ; written[next].lastKey != nil; next++ {
+			done := written[next]
+			delete(written, next)
+			copied += done.rows
+			c.checkpoint.Key, c.checkpoint.Rows = done.lastKey, c.checkpoint.Rows+done.rows
+			if c.Checkpoint == "" {
+				continue
+			}
+			if err := saveTableCheckpoint(c.Checkpoint, c.checkpoint); err != nil {
+				firstErr = err
+				cancel()
+				break
+			}
+		}
+	}
+	if firstErr != nil {
+		return copied, firstErr
+	}
+	return copied, <-readErr
+}
+
+func (c *tableCopier) read(ctx context.Context, rows *sql.Rows, batchSize int, batches chan<- copyBatch) error {
+	defer rows.Close()
+	batch := copyBatch{}
+	send := func() bool {
+		select {
+		case batches <- batch:
+			batch = copyBatch{seq: batch.seq + 1}
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	for rows.Next() {
+		row := make([]interface{}, len(c.columns))
+		dest := make([]interface{}, len(row))
+		for i := range row {
+			dest[i] = &row[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return err
+		}
+		for i, col := range c.columns {
+			row[i] = copyValue(row[i], col.Kind)
+		}
+		batch.rows = append(batch.rows, row)
+		if len(batch.rows) == batchSize && !send() {
+			return ctx.Err()
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(batch.rows) > 0 && !send() {
+		return ctx.Err()
+	}
+	return nil
+}
+
+func (c *tableCopier) write(ctx context.Context, insert string, rows [][]interface{}) error {
+	tx, err := c.Target.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.PrepareContext(ctx, insert)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, row := range rows {
+		if _, err := stmt.ExecContext(ctx, row...); err != nil {
+			stmt.Close()
+			tx.Rollback()
+			return err
+		}
+	}
+	stmt.Close()
+	return tx.Commit()
+}
+
+func (c *tableCopier) rowKey(row []interface{}) []interface{} {
+	key := make([]interface{}, len(c.key))
+	for i, k := range c.key {
+		key[i] = row[k]
+	}
+	return key
+}
+
+func (c *TableCopy) verify(result *TableCopyResult, source, target TableInfo, key []int) error {
+	if err := c.Source.QueryRow(`SELECT COUNT(1) FROM ` + source.QualifiedName()).Scan(&result.SourceRows); err != nil {
+		return err
+	}
+	if err := c.Target.QueryRow(`SELECT COUNT(1) FROM ` + target.QualifiedName()).Scan(&result.TargetRows); err != nil {
+		return err
+	}
+	if result.SourceRows != result.TargetRows {
+		return fmt.Errorf("%w: %d rows in %s, %d in %s", ErrCopyMismatch, result.SourceRows, source.QualifiedName(), result.TargetRows, target.QualifiedName())
+	}
+	if !c.Checksum {
+		return nil
+	}
+	var err error
+	if result.SourceChecksum, err = tableChecksum(c.Source, source, result.Columns, key); err != nil {
+		return err
+	}
+	if result.TargetChecksum, err = tableChecksum(c.Target, target, result.Columns, key); err != nil {
+		return err
+	}
+	if result.SourceChecksum != result.TargetChecksum {
+		return fmt.Errorf("%w: checksum of %s is %s, of %s %s", ErrCopyMismatch, source.QualifiedName(), result.SourceChecksum, target.QualifiedName(), result.TargetChecksum)
+	}
+	return nil
+}
+
+// tableChecksum is a SHA-256 of the table's values in primary key order, as
+// both databases can return them: times in UTC to the millisecond, which is
+// all Phoenix keeps.
+func tableChecksum(db *sql.DB, table TableInfo, columns []CopyColumn, key []int) (string, error) {
+	rows, err := db.Query(`SELECT ` + copyColumnList(columns, nil) + ` FROM ` + table.QualifiedName() + ` ORDER BY ` + copyColumnList(columns, key))
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	vals := make([]interface{}, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range vals {
+		dest[i] = &vals[i]
+	}
+	h := sha256.New()
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return "", err
+		}
+		for i, v := range vals {
+			v = copyValue(v, columns[i].Kind)
+			if t, ok := v.(time.Time); ok {
+				v = t.UTC().Truncate(time.Millisecond)
+			}
+			if v == nil {
+				h.Write([]byte{0})
+				continue
+			}
+			s := formatCSVValue(v)
+			fmt.Fprintf(h, "\x01%d:%s", len(s), s)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// TestTableCopyCommand copies a table between databases, e.g. a Phoenix
+// table to SQLite to debug locally:
+//
+//	make tablecopy FROM_DRIVER=avatica FROM_DSN=http://172.16.3.196:8765 TABLE=POS_TRANSACTION_ZYMECUSTOMER \
+//		TO_DRIVER=sqlite3 TO_DSN=file:/tmp/pos.db PARALLEL=4 CHECKPOINT=/tmp/pos.checkpoint
+//
+// If interrupted, the same command resumes from the checkpoint. NO_CHECKSUM=1
+// skips comparing checksums, which reads both tables again.
+func TestTableCopyCommand(t *testing.T) {
+	if os.Getenv("TABLECOPY_TABLE") == "" {
+		t.Skip("Set TABLECOPY_FROM_DRIVER, TABLECOPY_FROM_DSN, TABLECOPY_TABLE, TABLECOPY_TO_DRIVER and TABLECOPY_TO_DSN to copy a table.")
+	}
+	source, inspector, err := openShellDB(os.Getenv("TABLECOPY_FROM_DRIVER"), os.Getenv("TABLECOPY_FROM_DSN"))
+	if err != nil {
+		t.Fatal("Could not open source DB: ", err)
+	}
+	defer source.Close()
+	target, _, err := openShellDB(os.Getenv("TABLECOPY_TO_DRIVER"), os.Getenv("TABLECOPY_TO_DSN"))
+	if err != nil {
+		t.Fatal("Could not open target DB: ", err)
+	}
+	defer target.Close()
+	dialect, err := copyDialectFor(os.Getenv("TABLECOPY_TO_DRIVER"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc := &TableCopy{
+		Source:        source,
+		SourceSchema:  inspector,
+		Table:         os.Getenv("TABLECOPY_TABLE"),
+		Target:        target,
+		TargetDialect: dialect,
+		TargetTable:   os.Getenv("TABLECOPY_TARGET"),
+		Checkpoint:    os.Getenv("TABLECOPY_CHECKPOINT"),
+		Checksum:      os.Getenv("TABLECOPY_NO_CHECKSUM") == "",
+	}
+	tc.BatchSize, _ = strconv.Atoi(os.Getenv("TABLECOPY_BATCH"))
+	tc.Parallelism, _ = strconv.Atoi(os.Getenv("TABLECOPY_PARALLEL"))
+
+	start := time.Now()
+	result, err := tc.Run()
+	for _, col := range result.Columns {
+		fmt.Printf("%-30s %-20s -> %s\n", col.Name, col.SourceType, col.Type)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Resumed {
+		fmt.Println("Resumed from", tc.Checkpoint)
+	}
+	fmt.Printf("Copied %d %s in %v, verified %d %s", result.Copied, plural(result.Copied, "row"),
+		time.Since(start).Round(time.Millisecond), result.TargetRows, plural(result.TargetRows, "row"))
+	if tc.Checksum {
+		fmt.Printf(" with checksum %s", result.TargetChecksum)
+	}
+	fmt.Println()
+}
+
+// openCopySource is a SQLite database with a table of every kind of value.
+func openCopySource(t *testing.T, rows int) *sql.DB {
+	db, err := sql.Open("sqlite3", "file:"+filepath.Join(t.TempDir(), "source.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	_, err = db.Exec(`CREATE TABLE "EVENTS" (
+		"tenant" varchar(10) NOT NULL,
+		"id" integer NOT NULL,
+		"happened_at" timestamp NOT NULL,
+		"amount" decimal(10, 2),
+		"flagged" bool,
+		"payload" blob,
+		PRIMARY KEY ("tenant", "id")
+	)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2019, 7, 1, 9, 30, 0, 0, time.UTC)
+	for i := 0; i < rows; i++ {
+		var amount, payload interface{}
+		if i%3 != 0 {
+			amount, payload = float64(i)*1.25, []byte{byte(i), 0xff}
+		}
+		_, err := db.Exec(`INSERT INTO "EVENTS" VALUES (?, ?, ?, ?, ?, ?)`,
+			[]string{"e2open", "zyme"}[i%2], i, start.Add(time.Duration(i)*time.Minute), amount, i%2 == 0, payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+func openCopyTarget(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", "file:"+filepath.Join(t.TempDir(), "target.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestTableCopySQLite(t *testing.T) {
+	source, target := openCopySource(t, 25), openCopyTarget(t)
+	tc := &TableCopy{
+		Source: source, SourceSchema: newSQLiteInspector(source), Table: "EVENTS",
+		Target: target, TargetDialect: sqliteCopyDialect, TargetTable: "EVENTS_COPY",
+		BatchSize: 4, Parallelism: 3, Checksum: true,
+	}
+	result, err := tc.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Copied != 25 || result.SourceRows != 25 || result.TargetRows != 25 || result.SourceChecksum != result.TargetChecksum {
+		t.Errorf("Unexpected result: %+v", result)
+	}
+
+	info, err := newSQLiteInspector(target).Table("EVENTS_COPY")
+	if err != nil {
+		t.Fatal(err)
+	}
+	types := []string{}
+	for _, col := range info.Columns {
+		types = append(types, fmt.Sprintf("%s %s %v", col.Name, col.Type, col.Nullable))
+	}
+	expected := "tenant TEXT false,id INTEGER false,happened_at TIMESTAMP false,amount TEXT true,flagged BOOLEAN true,payload BLOB true"
+	if strings.Join(types, ",") != expected {
+		t.Errorf("Expected columns %s. Got: %s", expected, strings.Join(types, ","))
+	}
+	if strings.Join(info.PrimaryKey, ",") != "tenant,id" {
+		t.Error("Expected primary key tenant,id. Got:", info.PrimaryKey)
+	}
+
+	// Copying again replaces the rows
+	if _, err := source.Exec(`UPDATE "EVENTS" SET "amount" = 99 WHERE "id" = 1`); err != nil {
+		t.Fatal(err)
+	}
+	if result, err = tc.Run(); err != nil || result.TargetRows != 25 {
+		t.Fatalf("Expected the copy to be repeatable. Got %+v, %v", result, err)
+	}
+	var amount string
+	target.QueryRow(`SELECT "amount" FROM "EVENTS_COPY" WHERE "id" = 1`).Scan(&amount)
+	if amount != "99" {
+		t.Error("Expected the row to be replaced. Got amount:", amount)
+	}
+}
+
+func TestTableCopyKeepsDecimalsExact(t *testing.T) {
+	source := openCopySource(t, 3)
+	// Too many digits for a float. SQLite would round a literal to a REAL in
+	// a decimal column but leaves a blob alone, so the source keeps it exact
+	// as Phoenix's DECIMAL would.
+	exact := "12345678901234567.89"
+	if _, err := source.Exec(`UPDATE "EVENTS" SET "amount" = CAST(? AS BLOB) WHERE "id" = 1`, exact); err != nil {
+		t.Fatal(err)
+	}
+	target := openCopyTarget(t)
+	tc := &TableCopy{
+		Source: source, SourceSchema: newSQLiteInspector(source), Table: "EVENTS",
+		Target: target, TargetDialect: sqliteCopyDialect, Checksum: true,
+	}
+	result, err := tc.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if amount := result.Columns[3]; amount.Kind != KindDecimal || amount.Type != "TEXT" || phoenixCopyDialect.types[amount.Kind] != "DECIMAL" {
+		t.Errorf("Expected amount copied as a decimal. Got: %+v", amount)
+	}
+	var amount string
+	if err := target.QueryRow(`SELECT "amount" FROM "EVENTS" WHERE "id" = 1`).Scan(&amount); err != nil || amount != exact {
+		t.Errorf("Expected the exact amount %s. Got %s, %v", exact, amount, err)
+	}
+
+	// A target that rounds the decimal to a float fails verification
+	lossy := openCopyTarget(t)
+	_, err = lossy.Exec(`CREATE TABLE "EVENTS" ("tenant" TEXT NOT NULL, "id" INTEGER NOT NULL,
+		"happened_at" TIMESTAMP NOT NULL, "amount" REAL, "flagged" BOOLEAN, "payload" BLOB,
+		CONSTRAINT "PK_EVENTS" PRIMARY KEY ("tenant", "id"))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.Target = lossy
+	if _, err := tc.Run(); !errors.Is(err, ErrCopyMismatch) {
+		t.Error("Expected the lost precision to fail the checksum. Got:", err)
+	}
+}
+
+func TestTableCopyResumesFromCheckpoint(t *testing.T) {
+	source, target := openCopySource(t, 10), openCopyTarget(t)
+	checkpoint := filepath.Join(t.TempDir(), "events.checkpoint")
+	tc := &TableCopy{
+		Source: source, SourceSchema: newSQLiteInspector(source), Table: "EVENTS",
+		Target: target, TargetDialect: sqliteCopyDialect,
+		BatchSize: 3, Checkpoint: checkpoint, Checksum: true,
+	}
+
+	// The target rejects one row, interrupting the copy
+	_, err := target.Exec(`CREATE TABLE "EVENTS" ("tenant" TEXT NOT NULL, "id" INTEGER NOT NULL,
+		"happened_at" TIMESTAMP NOT NULL, "amount" TEXT, "flagged" BOOLEAN, "payload" BLOB,
+		CONSTRAINT "PK_EVENTS" PRIMARY KEY ("tenant", "id"));
+		CREATE TRIGGER "REJECT_7" BEFORE INSERT ON "EVENTS" WHEN NEW."id" = 7
+		BEGIN SELECT RAISE(ABORT, 'rejected 7'); END`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tc.Run(); err == nil || !strings.Contains(err.Error(), "rejected 7") {
+		t.Fatal("Expected the copy to fail. Got:", err)
+	}
+	saved, err := os.ReadFile(checkpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// In key order, e2open's ids are 0, 2, 4, 6, 8, then zyme's 1, 3, 5, 7, 9,
+	// so the batch with 7 is the third.
+	if string(saved) != `{"source":"\"EVENTS\"","target":"\"EVENTS\"","key":["zyme",1],"rows":6}` {
+		t.Error("Unexpected checkpoint:", string(saved))
+	}
+
+	if _, err := target.Exec(`DROP TRIGGER "REJECT_7"`); err != nil {
+		t.Fatal(err)
+	}
+	result, err := tc.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Resumed || result.Copied != 4 || result.TargetRows != 10 {
+		t.Errorf("Expected to resume and copy 4 rows. Got: %+v", result)
+	}
+	if _, err := os.Stat(checkpoint); !os.IsNotExist(err) {
+		t.Error("Expected the checkpoint to be removed. Got:", err)
+	}
+}
+
+func TestTableCopyToPhoenixDialect(t *testing.T) {
+	columns := []CopyColumn{
+		{Name: "id", Type: "BIGINT", Nullable: false},
+		{Name: "email", Type: "VARCHAR", Nullable: false},
+		{Name: "note", Type: "VARCHAR", Nullable: true},
+	}
+	expected := `CREATE TABLE IF NOT EXISTS "USERS" (
+	"id" BIGINT NOT NULL,
+	"email" VARCHAR,
+	"note" VARCHAR,
+	CONSTRAINT "PK_USERS" PRIMARY KEY ("id")
+)`
+	if create := createCopyTableSQL(phoenixCopyDialect, TableInfo{Name: "USERS"}, columns, []int{0}); create != expected {
+		t.Errorf("Expected NOT NULL on the key only:\n%s\nGot:\n%s", expected, create)
+	}
+	if create := createCopyTableSQL(sqliteCopyDialect, TableInfo{Name: "USERS"}, columns, []int{0}); !strings.Contains(create, `"email" VARCHAR NOT NULL`) {
+		t.Error("Expected SQLite to keep NOT NULL on other columns. Got:", create)
+	}
+
+	// A column with no declared type has nothing to be in Phoenix
+	source := openCopyTarget(t)
+	if _, err := source.Exec(`CREATE TABLE "NOTES" ("id" integer PRIMARY KEY, "anything")`); err != nil {
+		t.Fatal(err)
+	}
+	tc := &TableCopy{
+		Source: source, SourceSchema: newSQLiteInspector(source), Table: "NOTES",
+		Target: openCopyTarget(t), TargetDialect: phoenixCopyDialect,
+	}
+	if _, err := tc.Run(); err == nil || !strings.Contains(err.Error(), "anything") {
+		t.Error("Expected the untyped column to be refused. Got:", err)
+	}
+}
+
+func TestTableCopyThroughPhoenix(t *testing.T) {
+	url, backing := startFakePhoenix(t)
+	phoenix, err := sql.Open("avatica", url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer phoenix.Close()
+
+	users := openUsersDB(t)
+	for _, email := range []string{"arunsworld@gmail.com", "arun@e2open.com", "abarua@zyme.com"} {
+		if _, err := users.Exec(`INSERT INTO "USERS" ("email", "password", "first_name", "last_name", "is_active") VALUES (?, 'x', 'Arun', '', 1)`, email); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// SQLite to Phoenix, with batches written on parallel connections
+	up := &TableCopy{
+		Source: users, SourceSchema: newSQLiteInspector(users), Table: "USERS",
+		Target: phoenix, TargetDialect: phoenixCopyDialect, TargetTable: "USERS_COPY",
+		BatchSize: 1, Parallelism: 4, Checksum: true,
+	}
+	upResult, err := up.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upResult.Copied != 3 || upResult.TargetRows != 3 {
+		t.Errorf("Expected 3 rows copied to Phoenix. Got: %+v", upResult)
+	}
+	var active bool
+	if err := backing.QueryRow(`SELECT "is_active" FROM "USERS_COPY" WHERE "id" = 2`).Scan(&active); err != nil || !active {
+		t.Errorf("Expected is_active copied as a boolean. Got %v, %v", active, err)
+	}
+
+	// Phoenix to SQLite, with USERS described by the fake's SYSTEM.CATALOG
+	if _, err := backing.Exec(`INSERT INTO "USERS" SELECT * FROM "USERS_COPY"`); err != nil {
+		t.Fatal(err)
+	}
+	local := openCopyTarget(t)
+	down := &TableCopy{
+		Source: phoenix, SourceSchema: newPhoenixInspector(phoenix), Table: "USERS",
+		Target: local, TargetDialect: sqliteCopyDialect,
+		BatchSize: 2, Parallelism: 2, Checksum: true,
+	}
+	result, err := down.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The same rows as the SQLite table copied up
+	if result.Copied != 3 || result.TargetChecksum != upResult.SourceChecksum {
+		t.Errorf("Unexpected copy from Phoenix: %+v", result)
+	}
+	types := []string{}
+	for _, col := range result.Columns {
+		types = append(types, col.SourceType+" "+col.Type)
+	}
+	if strings.Join(types, ",") != "BIGINT INTEGER,VARCHAR TEXT,VARCHAR TEXT,VARCHAR TEXT,VARCHAR TEXT,BOOLEAN BOOLEAN" {
+		t.Error("Unexpected column types:", types)
+	}
+}
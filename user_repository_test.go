@@ -0,0 +1,433 @@
+package learning
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+)
+
+var (
+	ErrNotFound       = errors.New("not found")
+	ErrDuplicateEmail = errors.New("email already in use")
+)
+
+// User is a row of the USERS table.
+type User struct {
+	ID        int64  `gorm:"primary_key"`
+	Email     string `gorm:"unique;not null"`
+	Password  string
+	FirstName string
+	LastName  string
+	IsActive  bool
+}
+
+func (User) TableName() string {
+	return "USERS"
+}
+
+// UserFilter narrows List. Zero fields don't filter.
+type UserFilter struct {
+	FirstName string
+	LastName  string
+	IsActive  *bool
+}
+
+// Page asks for up to Limit users with an ID greater than AfterID. Keyset
+// pagination keeps pages stable while rows are inserted or deleted, and stays
+// fast on deep pages where OFFSET would have to skip rows one by one.
+type Page struct {
+	AfterID int64
+	Limit   int
+}
+
+// UserPage is one page of users. NextAfterID is 0 on the last page, otherwise
+// it is the AfterID to ask for the next page with.
+type UserPage struct {
+	Users       []User
+	NextAfterID int64
+}
+
+// UserRepository stores users. Lookups of missing users return ErrNotFound and
+// writes that would duplicate an email return ErrDuplicateEmail.
+type UserRepository interface {
+	Create(u *User) error
+	GetByID(id int64) (User, error)
+	GetByEmail(email string) (User, error)
+	Update(u User) error
+	Delete(id int64) error
+	List(filter UserFilter, page Page) (UserPage, error)
+}
+
+const defaultPageLimit = 50
+
+func (p Page) limit() int {
+	if p.Limit <= 0 {
+		return defaultPageLimit
+	}
+	return p.Limit
+}
+
+// paginate trims one-past-the-page users, which List implementations fetch to
+// find out whether there is a next page.
+func paginate(users []User, page Page) UserPage {
+	if len(users) <= page.limit() {
+		return UserPage{Users: users}
+	}
+	users = users[:page.limit()]
+	return UserPage{Users: users, NextAfterID: users[len(users)-1].ID}
+}
+
+// sqlUserRepository implements UserRepository with plain database/sql.
+type sqlUserRepository struct {
+	db *sql.DB
+}
+
+func newSQLUserRepository(db *sql.DB) *sqlUserRepository {
+	return &sqlUserRepository{db: db}
+}
+
+const userColumns = `"id", "email", "password", "first_name", "last_name", "is_active"`
+
+func (r *sqlUserRepository) Create(u *User) error {
+	result, err := r.db.Exec(`INSERT INTO "USERS" ("email", "password", "first_name", "last_name", "is_active")
+	VALUES ($1, $2, $3, $4, $5)`, u.Email, u.Password, u.FirstName, u.LastName, u.IsActive)
+	if isUniqueViolation(err) {
+		return ErrDuplicateEmail
+	}
+	if err != nil {
+		return err
+	}
+	u.ID, err = result.LastInsertId()
+	return err
+}
+
+func (r *sqlUserRepository) GetByID(id int64) (User, error) {
+	return scanUser(r.db.QueryRow(`SELECT `+userColumns+` FROM "USERS" WHERE "id" = $1`, id))
+}
+
+func (r *sqlUserRepository) GetByEmail(email string) (User, error) {
+	return scanUser(r.db.QueryRow(`SELECT `+userColumns+` FROM "USERS" WHERE "email" = $1`, email))
+}
+
+func (r *sqlUserRepository) Update(u User) error {
+	result, err := r.db.Exec(`UPDATE "USERS" SET "email" = $1, "password" = $2, "first_name" = $3, "last_name" = $4, "is_active" = $5
+	WHERE "id" = $6`, u.Email, u.Password, u.FirstName, u.LastName, u.IsActive, u.ID)
+	if isUniqueViolation(err) {
+		return ErrDuplicateEmail
+	}
+	return expectOneRow(result, err)
+}
+
+func (r *sqlUserRepository) Delete(id int64) error {
+	return expectOneRow(r.db.Exec(`DELETE FROM "USERS" WHERE "id" = $1`, id))
+}
+
+func (r *sqlUserRepository) List(filter UserFilter, page Page) (UserPage, error) {
+	where := []string{`"id" > $1`}
+	args := []interface{}{page.AfterID}
+	add := func(column string, value interface{}) {
+		args = append(args, value)
+		where = append(where, fmt.Sprintf(`"%s" = $%d`, column, len(args)))
+	}
+	if filter.FirstName != "" {
+		add("first_name", filter.FirstName)
+	}
+	if filter.LastName != "" {
+		add("last_name", filter.LastName)
+	}
+	if filter.IsActive != nil {
+		add("is_active", *filter.IsActive)
+	}
+	args = append(args, page.limit()+1)
+	query := fmt.Sprintf(`SELECT %s FROM "USERS" WHERE %s ORDER BY "id" LIMIT $%d`, userColumns, strings.Join(where, " AND "), len(args))
+
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return UserPage{}, err
+	}
+	defer rows.Close()
+	users := []User{}
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return UserPage{}, err
+		}
+		users = append(users, u)
+	}
+	if err := rows.Err(); err != nil {
+		return UserPage{}, err
+	}
+	return paginate(users, page), nil
+}
+
+func scanUser(row interface{ Scan(...interface{}) error }) (User, error) {
+	var u User
+	err := row.Scan(&u.ID, &u.Email, &u.Password, &u.FirstName, &u.LastName, &u.IsActive)
+	if err == sql.ErrNoRows {
+		return u, ErrNotFound
+	}
+	return u, err
+}
+
+// expectOneRow turns an update or delete that touched no row into ErrNotFound.
+func expectOneRow(result sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// gormUserRepository implements UserRepository with gorm.
+type gormUserRepository struct {
+	db *gorm.DB
+}
+
+func newGormUserRepository(db *gorm.DB) *gormUserRepository {
+	return &gormUserRepository{db: db}
+}
+
+func (r *gormUserRepository) Create(u *User) error {
+	return gormError(r.db.Create(u).Error)
+}
+
+func (r *gormUserRepository) GetByID(id int64) (User, error) {
+	var u User
+	err := r.db.First(&u, "id = ?", id).Error
+	return u, gormError(err)
+}
+
+func (r *gormUserRepository) GetByEmail(email string) (User, error) {
+	var u User
+	err := r.db.First(&u, "email = ?", email).Error
+	return u, gormError(err)
+}
+
+func (r *gormUserRepository) Update(u User) error {
+	// A map, unlike a struct, makes gorm write zero values such as IsActive=false
+	result := r.db.Model(&User{}).Where("id = ?", u.ID).Updates(map[string]interface{}{
+		"email":      u.Email,
+		"password":   u.Password,
+		"first_name": u.FirstName,
+		"last_name":  u.LastName,
+		"is_active":  u.IsActive,
+	})
+	if result.Error != nil {
+		return gormError(result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *gormUserRepository) Delete(id int64) error {
+	result := r.db.Where("id = ?", id).Delete(&User{})
+	if result.Error != nil {
+		return gormError(result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *gormUserRepository) List(filter UserFilter, page Page) (UserPage, error) {
+	q := r.db.Where("id > ?", page.AfterID)
+	if filter.FirstName != "" {
+		q = q.Where("first_name = ?", filter.FirstName)
+	}
+	if filter.LastName != "" {
+		q = q.Where("last_name = ?", filter.LastName)
+	}
+	if filter.IsActive != nil {
+		q = q.Where("is_active = ?", *filter.IsActive)
+	}
+	users := []User{}
+	if err := q.Order("id").Limit(page.limit() + 1).Find(&users).Error; err != nil {
+		return UserPage{}, gormError(err)
+	}
+	return paginate(users, page), nil
+}
+
+func gormError(err error) error {
+	switch {
+	case gorm.IsRecordNotFoundError(err):
+		return ErrNotFound
+	case isUniqueViolation(err):
+		return ErrDuplicateEmail
+	}
+	return err
+}
+
+// openUsersDB opens a fresh database with the USERS table in the test's
+// temporary directory.
+func openUsersDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", "file:"+filepath.Join(t.TempDir(), "users.db"))
+	if err != nil {
+		t.Fatal("Could not open DB: ", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := migrateSchema(db); err != nil {
+		t.Fatal("Could not create USERS table: ", err)
+	}
+	return db
+}
+
+func TestSQLUserRepository(t *testing.T) {
+	testUserRepository(t, func(t *testing.T) UserRepository {
+		return newSQLUserRepository(openUsersDB(t))
+	})
+}
+
+func TestGormUserRepository(t *testing.T) {
+	testUserRepository(t, func(t *testing.T) UserRepository {
+		db, err := gorm.Open("sqlite3", openUsersDB(t))
+		if err != nil {
+			t.Fatal("Could not open gorm: ", err)
+		}
+		db.LogMode(false)
+		return newGormUserRepository(db)
+	})
+}
+
+// testUserRepository is the conformance suite every UserRepository must pass.
+func testUserRepository(t *testing.T, newRepo func(t *testing.T) UserRepository) {
+	t.Run("CreateAndGet", func(t *testing.T) {
+		repo := newRepo(t)
+		u := User{Email: "arunsworld@gmail.com", Password: "password", FirstName: "Arun", LastName: "Barua", IsActive: true}
+		if err := repo.Create(&u); err != nil {
+			t.Fatal(err)
+		}
+		if u.ID != 1 {
+			t.Error("Expected the new user to get ID 1. Got:", u.ID)
+		}
+		byID, err := repo.GetByID(u.ID)
+		if err != nil || byID != u {
+			t.Errorf("GetByID: expected %+v. Got %+v, %v.", u, byID, err)
+		}
+		byEmail, err := repo.GetByEmail("arunsworld@gmail.com")
+		if err != nil || byEmail != u {
+			t.Errorf("GetByEmail: expected %+v. Got %+v, %v.", u, byEmail, err)
+		}
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		repo := newRepo(t)
+		if _, err := repo.GetByID(10); err != ErrNotFound {
+			t.Error("GetByID: expected ErrNotFound. Got:", err)
+		}
+		if _, err := repo.GetByEmail("nobody@example.com"); err != ErrNotFound {
+			t.Error("GetByEmail: expected ErrNotFound. Got:", err)
+		}
+		if err := repo.Update(User{ID: 10, Email: "nobody@example.com"}); err != ErrNotFound {
+			t.Error("Update: expected ErrNotFound. Got:", err)
+		}
+		if err := repo.Delete(10); err != ErrNotFound {
+			t.Error("Delete: expected ErrNotFound. Got:", err)
+		}
+	})
+
+	t.Run("DuplicateEmail", func(t *testing.T) {
+		repo := newRepo(t)
+		first := User{Email: "arunsworld@gmail.com", FirstName: "Arun", IsActive: true}
+		second := User{Email: "arun@e2open.com", FirstName: "Arun", IsActive: true}
+		if err := repo.Create(&first); err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.Create(&second); err != nil {
+			t.Fatal(err)
+		}
+		dup := User{Email: "arunsworld@gmail.com", FirstName: "Arun"}
+		if err := repo.Create(&dup); err != ErrDuplicateEmail {
+			t.Error("Create: expected ErrDuplicateEmail. Got:", err)
+		}
+		second.Email = first.Email
+		if err := repo.Update(second); err != ErrDuplicateEmail {
+			t.Error("Update: expected ErrDuplicateEmail. Got:", err)
+		}
+	})
+
+	t.Run("UpdateAndDelete", func(t *testing.T) {
+		repo := newRepo(t)
+		u := User{Email: "arunsworld@gmail.com", FirstName: "Arun", IsActive: true}
+		if err := repo.Create(&u); err != nil {
+			t.Fatal(err)
+		}
+		u.LastName = "Barua"
+		u.IsActive = false
+		if err := repo.Update(u); err != nil {
+			t.Fatal(err)
+		}
+		got, err := repo.GetByID(u.ID)
+		if err != nil || got != u {
+			t.Errorf("Expected the update to stick. Got %+v, %v.", got, err)
+		}
+		if err := repo.Delete(u.ID); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := repo.GetByID(u.ID); err != ErrNotFound {
+			t.Error("Expected the deleted user to be gone. Got:", err)
+		}
+	})
+
+	t.Run("ListWithKeysetPagination", func(t *testing.T) {
+		repo := newRepo(t)
+		for i := 1; i <= 7; i++ {
+			u := User{Email: fmt.Sprintf("user%d@example.com", i), FirstName: "Arun", IsActive: i%2 == 1}
+			if i == 7 {
+				u.FirstName = "Other"
+			}
+			if err := repo.Create(&u); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		var ids []int64
+		page := Page{Limit: 2}
+		pages := 0
+		for {
+			result, err := repo.List(UserFilter{FirstName: "Arun"}, page)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pages++
+			for _, u := range result.Users {
+				ids = append(ids, u.ID)
+			}
+			if result.NextAfterID == 0 {
+				break
+			}
+			page.AfterID = result.NextAfterID
+		}
+		if fmt.Sprint(ids) != "[1 2 3 4 5 6]" || pages != 3 {
+			t.Errorf("Expected users 1-6 over 3 pages. Got %v over %d.", ids, pages)
+		}
+
+		active := true
+		result, err := repo.List(UserFilter{IsActive: &active}, Page{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(result.Users) != 4 || result.NextAfterID != 0 {
+			t.Errorf("Expected the 4 active users on one page. Got %+v.", result)
+		}
+		inactive := false
+		result, _ = repo.List(UserFilter{IsActive: &inactive}, Page{})
+		if len(result.Users) != 3 {
+			t.Error("Expected 3 inactive users. Got:", len(result.Users))
+		}
+	})
+}
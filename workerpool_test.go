@@ -0,0 +1,475 @@
+package learning
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var ErrPoolClosed = errors.New("worker pool closed")
+
+// Job is a unit of work for a WorkerPool. It should return promptly once ctx ends.
+type Job[R any] func(ctx context.Context) (R, error)
+
+// JobResult is the outcome of a job. Index is the job's position in submission
+// order, as returned by Submit.
+type JobResult[R any] struct {
+	Index int
+	Value R
+	Err   error
+}
+
+// PanicError is the error reported for a job that panicked.
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("job panicked: %v", e.Value)
+}
+
+type queuedJob[R any] struct {
+	index  int
+	job    Job[R]
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// WorkerPool runs jobs on a fixed number of goroutines, replacing the one
+// goroutine per job of TestRunningConcurrentJobsAndWaitingForThemToComplete.
+// Submit blocks while the queue is full. Results must be consumed; the Results
+// channel is closed once Shutdown has finished.
+type WorkerPool[R any] struct {
+	queue   chan queuedJob[R]
+	raw     chan JobResult[R] // straight from the workers
+	results chan JobResult[R]
+	ordered bool
+
+	// abort cancels every job when Shutdown runs out of time
+	abortCtx context.Context
+	abort    context.CancelFunc
+
+	mu         sync.Mutex
+	next       int
+	skipped    map[int]bool // indexes an ordered pool will never get results for
+	skip       chan struct{}
+	closed     bool
+	closing    chan struct{}
+	submitters sync.WaitGroup
+	workers    sync.WaitGroup
+	finished   chan struct{}
+}
+
+// NewWorkerPool starts workers goroutines fed by a queue of queueSize jobs. If
+// ordered is set results are delivered in submission order, otherwise as soon
+// as each job completes.
+func NewWorkerPool[R any](workers, queueSize int, ordered bool) *WorkerPool[R] {
+	abortCtx, abort := context.WithCancel(context.Background())
+	p := &WorkerPool[R]{
+		queue:    make(chan queuedJob[R], queueSize),
+		raw:      make(chan JobResult[R], queueSize),
+		results:  make(chan JobResult[R], queueSize),
+		ordered:  ordered,
+		abortCtx: abortCtx,
+		abort:    abort,
+		skipped:  make(map[int]bool),
+		skip:     make(chan struct{}, 1),
+		closing:  make(chan struct{}),
+		finished: make(chan struct{}),
+	}
+	for i := 0; i < workers; i++ {
+		p.workers.Add(1)
+		go p.work()
+	}
+	go p.collect()
+	return p
+}
+
+// Submit queues job and returns its index. The job runs with a context that
+// ends when ctx does or when Shutdown aborts, so ctx should live as long as
+// the job, not just the submission.
+func (p *WorkerPool[R]) Submit(ctx context.Context, job Job[R]) (int, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return 0, ErrPoolClosed
+	}
+	index := p.next
+	p.next++
+	p.submitters.Add(1)
+	p.mu.Unlock()
+	defer p.submitters.Done()
+
+	jobCtx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(p.abortCtx, cancel)
+	q := queuedJob[R]{
+		index: index,
+		job:   job,
+		ctx:   jobCtx,
+		cancel: func() {
+			stop()
+			cancel()
+		},
+	}
+	var err error
+	select {
+	case p.queue <- q:
+		return index, nil
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-p.closing:
+		err = ErrPoolClosed
+	}
+	q.cancel()
+	if p.ordered {
+		// Tell the collector not to wait for this index. Sending it on raw
+		// could block behind results nobody is reading.
+		p.mu.Lock()
+		p.skipped[index] = true
+		p.mu.Unlock()
+		select {
+		case p.skip <- struct{}{}:
+		default:
+		}
+	}
+	return 0, err
+}
+
+// Results delivers one JobResult per submitted job.
+func (p *WorkerPool[R]) Results() <-chan JobResult[R] {
+	return p.results
+}
+
+// Shutdown stops accepting jobs and waits for queued and running jobs to
+// finish. If ctx ends first the remaining jobs are cancelled and Shutdown
+// returns ctx.Err() straight away; the workers wind down in the background
+// and Results is closed once they have and their results have been read.
+func (p *WorkerPool[R]) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.closing)
+		p.mu.Unlock()
+		go func() {
+			// Submitters blocked on a full queue give up on closing, after
+			// which nobody can send on the queue any more.
+			p.submitters.Wait()
+			close(p.queue)
+			p.workers.Wait()
+			close(p.raw)
+		}()
+	} else {
+		p.mu.Unlock()
+	}
+
+	select {
+	case <-p.finished:
+		p.abort()
+		return nil
+	case <-ctx.Done():
+		p.abort()
+		return ctx.Err()
+	}
+}
+
+func (p *WorkerPool[R]) work() {
+	defer p.workers.Done()
+	for q := range p.queue {
+		p.raw <- p.run(q)
+	}
+}
+
+func (p *WorkerPool[R]) run(q queuedJob[R]) (result JobResult[R]) {
+	defer q.cancel()
+	result.Index = q.index
+	if err := q.ctx.Err(); err != nil {
+		result.Err = err
+		return result
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			result.Err = &PanicError{Value: r, Stack: debug.Stack()}
+		}
+	}()
+	result.Value, result.Err = q.job(q.ctx)
+	return result
+}
+
+// collect forwards results, reordering them by index when the pool is ordered.
+func (p *WorkerPool[R]) collect() {
+	defer close(p.finished)
+	defer close(p.results)
+	if !p.ordered {
+		for r := range p.raw {
+			p.results <- r
+		}
+		return
+	}
+	next := 0
+	pending := make(map[int]JobResult[R])
+	for {
+		select {
+		case r, ok := <-p.raw:
+			if !ok {
+				// Every submitter has returned, so every skip is recorded
+				p.deliver(pending, next)
+				return
+			}
+			pending[r.Index] = r
+		case <-p.skip:
+		}
+		next = p.deliver(pending, next)
+	}
+}
+
+// deliver sends the results that are ready from next onwards, passing over
+// skipped indexes, and returns the index to wait for after them.
+func (p *WorkerPool[R]) deliver(pending map[int]JobResult[R], next int) int {
+	for {
+		if r, ok := pending[next]; ok {
+			delete(pending, next)
+			next++
+			p.results <- r
+			continue
+		}
+		p.mu.Lock()
+		skipped := p.skipped[next]
+		delete(p.skipped, next)
+		p.mu.Unlock()
+		if !skipped {
+			return next
+		}
+		next++
+	}
+}
+
+func TestWorkerPoolRunsJobsOnFixedWorkers(t *testing.T) {
+	checkGoroutineLeaks(t)
+	pool := NewWorkerPool[int](3, 10, false)
+	var running, maxRunning int64
+	go func() {
+		for i := 0; i < 20; i++ {
+			i := i
+			_, err := pool.Submit(context.Background(), func(ctx context.Context) (int, error) {
+				now := atomic.AddInt64(&running, 1)
+				defer atomic.AddInt64(&running, -1)
+				for {
+					seen := atomic.LoadInt64(&maxRunning)
+					if now <= seen || atomic.CompareAndSwapInt64(&maxRunning, seen, now) {
+						break
+					}
+				}
+				time.Sleep(time.Millisecond * 5)
+				return i * i, nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}
+		pool.Shutdown(context.Background())
+	}()
+
+	sum := 0
+	for r := range pool.Results() {
+		if r.Err != nil {
+			t.Error("Unexpected job error: ", r.Err)
+		}
+		if r.Value != r.Index*r.Index {
+			t.Errorf("Job %d returned %d.", r.Index, r.Value)
+		}
+		sum++
+	}
+	if sum != 20 {
+		t.Error("Expected 20 results. Got:", sum)
+	}
+	if maxRunning > 3 {
+		t.Error("Expected at most 3 jobs at once. Got:", maxRunning)
+	}
+}
+
+func TestWorkerPoolOrderedResults(t *testing.T) {
+	checkGoroutineLeaks(t)
+	pool := NewWorkerPool[int](4, 4, true)
+	go func() {
+		for i := 0; i < 12; i++ {
+			i := i
+			pool.Submit(context.Background(), func(ctx context.Context) (int, error) {
+				// Later jobs finish first
+				time.Sleep(time.Millisecond * time.Duration(12-i))
+				return i, nil
+			})
+		}
+		pool.Shutdown(context.Background())
+	}()
+	expected := 0
+	for r := range pool.Results() {
+		if r.Index != expected || r.Value != expected {
+			t.Errorf("Expected result %d. Got index %d value %d.", expected, r.Index, r.Value)
+		}
+		expected++
+	}
+	if expected != 12 {
+		t.Error("Expected 12 results. Got:", expected)
+	}
+}
+
+func TestWorkerPoolBackpressure(t *testing.T) {
+	checkGoroutineLeaks(t)
+	pool := NewWorkerPool[int](1, 1, false)
+	release := make(chan struct{})
+	blocker := func(ctx context.Context) (int, error) {
+		<-release
+		return 0, nil
+	}
+	pool.Submit(context.Background(), blocker) // taken by the worker
+	time.Sleep(time.Millisecond * 10)
+	pool.Submit(context.Background(), blocker) // fills the queue
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+	if _, err := pool.Submit(ctx, blocker); err != context.DeadlineExceeded {
+		t.Error("Expected submit to a full queue to time out. Got:", err)
+	}
+
+	close(release)
+	go pool.Shutdown(context.Background())
+	count := 0
+	for range pool.Results() {
+		count++
+	}
+	if count != 2 {
+		t.Error("Expected results for the 2 queued jobs only. Got:", count)
+	}
+	if _, err := pool.Submit(context.Background(), blocker); err != ErrPoolClosed {
+		t.Error("Expected submit after shutdown to fail. Got:", err)
+	}
+}
+
+func TestWorkerPoolSubmitGivesUpWhileResultsBackUp(t *testing.T) {
+	checkGoroutineLeaks(t)
+	pool := NewWorkerPool[int](1, 1, true)
+	release := make(chan struct{})
+	started := make(chan struct{})
+	done := func(ctx context.Context) (int, error) {
+		return 0, nil
+	}
+	// Nobody reads Results yet: 0 waits in Results, 1 in the collector and 2
+	// in the workers' output by the time 3 starts.
+	for i := 0; i < 3; i++ {
+		pool.Submit(context.Background(), done)
+	}
+	pool.Submit(context.Background(), func(ctx context.Context) (int, error) {
+		close(started)
+		<-release
+		return 0, nil
+	})
+	<-started
+	pool.Submit(context.Background(), done) // fills the queue
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	submitted := make(chan error)
+	go func() {
+		_, err := pool.Submit(ctx, done)
+		submitted <- err
+	}()
+	select {
+	case err := <-submitted:
+		if err != context.Canceled {
+			t.Error("Expected the submit to be cancelled. Got:", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected a cancelled submit to return while results back up.")
+	}
+
+	close(release)
+	go pool.Shutdown(context.Background())
+	expected := 0
+	for r := range pool.Results() {
+		if r.Index != expected {
+			t.Errorf("Expected result %d. Got: %d", expected, r.Index)
+		}
+		expected++
+	}
+	if expected != 5 {
+		t.Error("Expected results for the 5 queued jobs. Got:", expected)
+	}
+}
+
+func TestWorkerPoolRecoversPanics(t *testing.T) {
+	pool := NewWorkerPool[int](1, 1, false)
+	pool.Submit(context.Background(), func(ctx context.Context) (int, error) {
+		panic("bad job")
+	})
+	r := <-pool.Results()
+	var panicErr *PanicError
+	if !errors.As(r.Err, &panicErr) || panicErr.Value != "bad job" {
+		t.Error("Expected a PanicError. Got:", r.Err)
+	}
+	if err := pool.Shutdown(context.Background()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWorkerPoolShutdownKeepsItsDeadline(t *testing.T) {
+	checkGoroutineLeaks(t)
+	pool := NewWorkerPool[int](2, 2, false)
+	for i := 0; i < 4; i++ {
+		pool.Submit(context.Background(), func(ctx context.Context) (int, error) {
+			return 1, nil
+		})
+	}
+	// Nobody reads Results, so the workers can't finish
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+	if err := pool.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Error("Expected shutdown to run out of time. Got:", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Millisecond*500 {
+		t.Error("Expected shutdown to return at its deadline. Took:", elapsed)
+	}
+	count := 0
+	for range pool.Results() {
+		count++
+	}
+	if count != 4 {
+		t.Error("Expected the 4 results to still be delivered. Got:", count)
+	}
+}
+
+func TestWorkerPoolShutdownAbortsInFlightWork(t *testing.T) {
+	checkGoroutineLeaks(t)
+	pool := NewWorkerPool[int](2, 10, false)
+	for i := 0; i < 6; i++ {
+		pool.Submit(context.Background(), func(ctx context.Context) (int, error) {
+			<-ctx.Done()
+			return 0, ctx.Err()
+		})
+	}
+	results := make(chan int)
+	go func() {
+		cancelled := 0
+		for r := range pool.Results() {
+			if r.Err == context.Canceled {
+				cancelled++
+			}
+		}
+		results <- cancelled
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+	if err := pool.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Error("Expected shutdown to run out of time. Got:", err)
+	}
+	if cancelled := <-results; cancelled != 6 {
+		t.Error("Expected all 6 jobs to be cancelled. Got:", cancelled)
+	}
+}